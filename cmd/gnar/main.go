@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/abcdlsj/gnar/internal/client"
 	"github.com/abcdlsj/gnar/internal/server"
@@ -20,8 +21,11 @@ func main() {
 
 	RootCmd.AddCommand(server.Command())
 	RootCmd.AddCommand(client.Command())
+	RootCmd.AddCommand(server.StatusCommand())
 
 	RootCmd.Version = fmt.Sprintf("%s; buildstamp %s", share.GetVersion(), share.BuildStamp)
 
-	RootCmd.Execute()
+	if err := RootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
 }
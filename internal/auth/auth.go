@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/md5"
+	"crypto/subtle"
 	"fmt"
 
 	"github.com/abcdlsj/gnar/pkg/proto"
@@ -11,18 +12,33 @@ type Authenticator interface {
 	VerifyLogin(*proto.MsgLogin) bool
 }
 
+// Func is a callback that verifies logins, e.g. against tokens of a database.
+type Func func(*proto.MsgLogin) bool
+
+func (f Func) VerifyLogin(msg *proto.MsgLogin) bool {
+	return f(msg)
+}
+
+// TokenAuthenticator accepts a login signed with any of the tokens.
 type TokenAuthenticator struct {
-	token string
+	tokens []string
 }
 
-func NewTokenAuthenticator(token string) Authenticator {
-	return &TokenAuthenticator{token: token}
+func NewTokenAuthenticator(tokens ...string) Authenticator {
+	return &TokenAuthenticator{tokens: tokens}
 }
 
 func (t *TokenAuthenticator) VerifyLogin(msg *proto.MsgLogin) bool {
-	hash := md5.New()
-	hash.Write([]byte(t.token + fmt.Sprintf("%d", msg.Timestamp)))
-	return fmt.Sprintf("%x", hash.Sum(nil)) == msg.Token
+	ok := false
+	for _, token := range t.tokens {
+		hash := md5.New()
+		hash.Write([]byte(token + fmt.Sprintf("%d", msg.Timestamp)))
+		expected := fmt.Sprintf("%x", hash.Sum(nil))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(msg.Token)) == 1 {
+			ok = true
+		}
+	}
+	return ok
 }
 
 type Nop struct{}
@@ -1,6 +1,9 @@
 package backoff
 
-import "time"
+import (
+	"math/rand"
+	"time"
+)
 
 type Backoff struct {
 	op       func() error
@@ -25,3 +28,47 @@ func (b *Backoff) Do() error {
 	}
 	return nil
 }
+
+// Exponential doubles the interval from base up to max on every attempt, a
+// random jitter of up to half the interval is subtracted to spread retries.
+type Exponential struct {
+	base    time.Duration
+	max     time.Duration
+	retries int // 0 means retry forever
+	attempt int
+}
+
+func NewExponential(base, max time.Duration, retries int) *Exponential {
+	return &Exponential{
+		base:    base,
+		max:     max,
+		retries: retries,
+	}
+}
+
+// Next returns the interval to wait before the next attempt, false when the
+// retries are used up.
+func (e *Exponential) Next() (time.Duration, bool) {
+	if e.retries > 0 && e.attempt >= e.retries {
+		return 0, false
+	}
+
+	d := e.base << e.attempt
+	if d <= 0 || d > e.max {
+		d = e.max
+	}
+	e.attempt++
+
+	if half := int64(d / 2); half > 0 {
+		d -= time.Duration(rand.Int63n(half))
+	}
+	return d, true
+}
+
+func (e *Exponential) Attempt() int {
+	return e.attempt
+}
+
+func (e *Exponential) Reset() {
+	e.attempt = 0
+}
@@ -2,7 +2,10 @@ package client
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/abcdlsj/gnar/pkg/share"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -13,8 +16,11 @@ func Command() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "client [server-addr] [local-port:remote-port]",
 		Short: "Run gnar client",
-		Long:  "Run gnar client with optional server address and port mapping",
-		Args:  cobra.MaximumNArgs(2),
+		Long: `Run gnar client with optional server address and port mapping
+
+Every option can also be set by GNAR_ prefixed environment variable, e.g. GNAR_SERVER_ADDR.
+Precedence: flags > environment variables > config file > defaults.`,
+		Args: cobra.MaximumNArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			viper.BindPFlags(cmd.PersistentFlags())
 
@@ -23,7 +29,9 @@ func Command() *cobra.Command {
 				return fmt.Errorf("error loading config: %v", err)
 			}
 
-			return newClient(cfg).Run()
+			// a rejected proxy is no usage error
+			cmd.SilenceUsage = true
+			return New(cfg).Run()
 		},
 	}
 
@@ -32,9 +40,83 @@ func Command() *cobra.Command {
 	cmd.PersistentFlags().BoolP("multiplex", "m", false, "multiplex client/server control connection")
 	cmd.PersistentFlags().StringP("token", "t", "", "token")
 	cmd.PersistentFlags().StringP("subdomain", "d", "", "subdomain")
+	cmd.PersistentFlags().String("hostname", "", "full hostname of a tls proxy routed by sni, overrides the subdomain")
+	cmd.PersistentFlags().Bool("terminate-tls", false, "let the server terminate the tls of a tls proxy, the local service gets plain connections")
 	cmd.PersistentFlags().StringP("proxy-name", "n", "", "proxy name")
-	cmd.PersistentFlags().StringP("proxy-type", "y", "tcp", "proxy transport protocol type")
+	cmd.PersistentFlags().StringP("proxy-type", "y", "tcp", "proxy type, tcp, udp, http, tls or socks5")
 	cmd.PersistentFlags().StringP("speed-limit", "", "", "speed limit")
+	cmd.PersistentFlags().String("local-addr", "", "host:port or unix:/path of local service, overrides the local port")
+	cmd.PersistentFlags().StringSlice("allow-ips", nil, "only these cidrs or ips can reach the remote port")
+	cmd.PersistentFlags().StringSlice("deny-ips", nil, "these cidrs or ips can not reach the remote port")
+	cmd.PersistentFlags().Int("max-conns", 0, "max concurrent user conns of the remote port, 0 means unlimited")
+	cmd.PersistentFlags().String("overflow", "reject", "user conns over max-conns, reject or queue")
+	cmd.PersistentFlags().Int("conn-rate", 0, "new user conns per second of every remote ip, 0 means unlimited")
+	cmd.PersistentFlags().Int("conn-burst", 0, "new user conns at once of every remote ip over conn-rate, 0 means conn-rate")
+	cmd.PersistentFlags().Duration("ttl", 0, "ask the server to cancel the proxy after this long, e.g. 1h, 0 means the server default")
+	cmd.PersistentFlags().Int("weight", 0, "share of user conns this client takes when it load balances a proxy with others, 0 means 1")
+	cmd.PersistentFlags().String("proxy-protocol", "", "send a PROXY protocol header with the user addr to the local service, v1 or v2")
+	cmd.PersistentFlags().StringArray("request-header", nil, "header rule of http proxy requests, \"Name: value\" sets and \"-Name\" removes, repeatable")
+	cmd.PersistentFlags().StringArray("response-header", nil, "header rule of http proxy responses, like request-header")
+	cmd.PersistentFlags().Bool("compress", false, "compress tcp tunnel traffic")
+	cmd.PersistentFlags().String("bind-host", "", "ip the server binds the remote port to, empty means all interfaces")
+	cmd.PersistentFlags().String("network", "", "family the server listens on the remote port with, tcp4 or tcp6, empty means both")
+	cmd.PersistentFlags().Bool("health-check", false, "dial the local target before registering and cancel the proxy while it is down")
+	cmd.PersistentFlags().Duration("health-check-interval", 5*time.Second, "interval of the local target health checks")
+	cmd.PersistentFlags().String("resolver", "", "host:port of a dns server resolving the local targets, empty uses the system resolver")
+	cmd.PersistentFlags().Bool("tls", false, "use tls for client/server control connection")
+	cmd.PersistentFlags().Bool("tls-skip-verify", false, "skip server certificate verification, for testing only")
+	cmd.PersistentFlags().String("tls-ca-file", "", "ca file to verify the server certificate with instead of the system roots")
+	cmd.PersistentFlags().String("tls-cert-file", "", "client certificate file, for servers that verify clients")
+	cmd.PersistentFlags().String("tls-key-file", "", "client key file of tls-cert-file")
+
+	cmd.AddCommand(configCommand(cmd))
+	return cmd
+}
+
+// configUsages comments the keys of the example config that have no flag.
+var configUsages = map[string]string{
+	"heartbeat-interval":      "interval of the heartbeats to the server",
+	"heartbeat-timeout":       "reconnect when the server answers no heartbeat within this, 0 disables",
+	"dial-timeout":            "timeout of dialing the server, 0 means none",
+	"keepalive":               "tcp keepalive period of control conns, 0 disables it",
+	"reconnect-interval":      "first wait before reconnecting, doubled on every failed retry",
+	"reconnect-max-interval":  "longest wait between the reconnect retries",
+	"reconnect-max-retries":   "give up after this many failed retries, 0 retries forever",
+	"proxys":                  "the proxys to register, the port mapping argument replaces them",
+	"proxys.remote-port":      "port on the server, 0 lets the server pick one",
+	"proxys.remote-port-end":  "last port of a range from remote-port, mapped to the ports from local-port",
+	"proxys.local-port":       "port of the local service",
+	"proxys.request-headers":  "header rules of http proxy requests, \"Name: value\" sets and \"-Name\" removes",
+	"proxys.response-headers": "header rules of http proxy responses",
+}
 
+// configCommand writes an example config of the client defaults, its
+// comments are the flag usages and configUsages.
+func configCommand(client *cobra.Command) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Manage gnar client config files",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "init",
+		Short: "Write an example config file with the defaults to stdout",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := defaultConfig()
+			if err != nil {
+				return fmt.Errorf("error loading default config: %v", err)
+			}
+			return share.WriteExampleConfig(cmd.OutOrStdout(), cfg, func(key string) string {
+				if usage, ok := configUsages[key]; ok {
+					return usage
+				}
+				// the flags of a proxy set the one of the port mapping argument
+				if f := client.PersistentFlags().Lookup(strings.TrimPrefix(key, "proxys.")); f != nil {
+					return f.Usage
+				}
+				return ""
+			})
+		},
+	})
 	return cmd
 }
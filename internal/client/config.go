@@ -1,42 +1,204 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/abcdlsj/gnar/internal/proxy"
+	"github.com/abcdlsj/gnar/pkg/share"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	SvrAddr   string  `mapstructure:"server-addr"`
-	Token     string  `mapstructure:"token"`
-	Multiplex bool    `mapstructure:"multiplex"`
-	Proxys    []Proxy `mapstructure:"proxys"`
+	SvrAddr   string    `mapstructure:"server-addr"`
+	Token     string    `mapstructure:"token"`
+	Multiplex bool      `mapstructure:"multiplex"`
+	Proxys    []Proxy   `mapstructure:"proxys"`
+	TLS       TLSConfig `mapstructure:",squash"`
+
+	HeartbeatInterval time.Duration   `mapstructure:"heartbeat-interval"`
+	HeartbeatTimeout  time.Duration   `mapstructure:"heartbeat-timeout"` // 0 disables the timeout
+	DialTimeout       time.Duration   `mapstructure:"dial-timeout"`      // 0 means no timeout
+	KeepAlive         time.Duration   `mapstructure:"keepalive"`         // tcp keepalive period of control conns, 0 disables it
+	Reconnect         ReconnectConfig `mapstructure:",squash"`
+
+	// HealthCheck probes the local targets before registering their proxys
+	// and every HealthCheckInterval after, proxys of a down target are
+	// canceled until it is back.
+	HealthCheck         bool          `mapstructure:"health-check"`
+	HealthCheckInterval time.Duration `mapstructure:"health-check-interval"`
+
+	// Resolver is the host:port of the dns server that resolves the names
+	// of the local targets, empty uses the system resolver.
+	Resolver string `mapstructure:"resolver"`
+}
+
+type ReconnectConfig struct {
+	Interval    time.Duration `mapstructure:"reconnect-interval"`
+	MaxInterval time.Duration `mapstructure:"reconnect-max-interval"`
+	MaxRetries  int           `mapstructure:"reconnect-max-retries"` // 0 means retry forever
+}
+
+type TLSConfig struct {
+	Enable     bool   `mapstructure:"tls"`
+	SkipVerify bool   `mapstructure:"tls-skip-verify"`
+	CAFile     string `mapstructure:"tls-ca-file"` // verifies the server certificate instead of the system roots
+
+	// the client certificate, for servers with tls-client-ca-file
+	CertFile string `mapstructure:"tls-cert-file"`
+	KeyFile  string `mapstructure:"tls-key-file"`
+}
+
+func (c Config) healthCheckInterval() time.Duration {
+	if !c.HealthCheck {
+		return 0
+	}
+	return c.HealthCheckInterval
+}
+
+// NetDialer dials control conns with the timeout and keepalive of config.
+func (c Config) NetDialer() *net.Dialer {
+	keepAlive := c.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = -1
+	}
+	return &net.Dialer{Timeout: c.DialTimeout, KeepAlive: keepAlive}
+}
+
+// LocalDialer dials the local targets, resolving their names with the
+// resolver of config.
+func (c Config) LocalDialer() *net.Dialer {
+	d := &net.Dialer{}
+	if c.Resolver != "" {
+		d.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var nd net.Dialer
+				return nd.DialContext(ctx, network, c.Resolver)
+			},
+		}
+	}
+	return d
+}
+
+func (t TLSConfig) ClientConfig() (*tls.Config, error) {
+	if !t.Enable {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: t.SkipVerify}
+	if t.CAFile != "" {
+		pool, err := share.LoadCertPool(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading tls-ca-file: %v", err)
+		}
+		cfg.RootCAs = pool
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading tls client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
 }
 
 type Proxy struct {
-	ProxyName  string `mapstructure:"proxy-name"`
-	Subdomain  string `mapstructure:"subdomain"`
-	RemotePort int    `mapstructure:"remote-port"`
-	LocalPort  int    `mapstructure:"local-port"`
-	SpeedLimit string `mapstructure:"speed-limit"`
-	ProxyType  string `mapstructure:"proxy-type"`
+	ProxyName     string `mapstructure:"proxy-name"`
+	Subdomain     string `mapstructure:"subdomain"`
+	Hostname      string `mapstructure:"hostname"` // full hostname of a tls proxy routed by sni, overrides subdomain
+	RemotePort    int    `mapstructure:"remote-port"`
+	RemotePortEnd int    `mapstructure:"remote-port-end"` // last port of a range from remote-port, mapped to the ports from local-port
+	LocalPort     int    `mapstructure:"local-port"`
+	LocalAddr     string `mapstructure:"local-addr"` // host:port or unix:/path of local service, overrides local-port
+	SpeedLimit    string `mapstructure:"speed-limit"`
+	ProxyType     string `mapstructure:"proxy-type"`
+	BindHost      string `mapstructure:"bind-host"` // ip the server binds the remote port to
+	Network       string `mapstructure:"network"`   // family of the remote port, tcp4 or tcp6, empty or tcp means both
+	Compress      bool   `mapstructure:"compress"`  // compress tcp tunnel traffic
+
+	AllowIPs []string `mapstructure:"allow-ips"` // only these cidrs can reach the remote port
+	DenyIPs  []string `mapstructure:"deny-ips"`  // these cidrs can not reach the remote port
+
+	MaxConns int    `mapstructure:"max-conns"` // concurrent user conns, 0 means unlimited
+	Overflow string `mapstructure:"overflow"`  // conns over max-conns, reject or queue
+
+	ConnRate  int `mapstructure:"conn-rate"`  // new user conns per second of every remote ip, 0 means unlimited
+	ConnBurst int `mapstructure:"conn-burst"` // new user conns at once over conn-rate, 0 means conn-rate
+
+	ProxyProtocol string `mapstructure:"proxy-protocol"` // v1 or v2 PROXY protocol header sent to the local target
+
+	// TerminateTLS lets the server terminate the tls of a tls proxy with a
+	// certificate of its hostname, the local service gets plain conns.
+	TerminateTLS bool `mapstructure:"terminate-tls"`
+
+	// RequestHeaders and ResponseHeaders are header rules of an http proxy,
+	// "Name: value" sets a header and "-Name" removes it.
+	RequestHeaders  []string `mapstructure:"request-headers"`
+	ResponseHeaders []string `mapstructure:"response-headers"`
+
+	Weight int           `mapstructure:"weight"` // share of user conns among load balanced clients, 0 means 1
+	TTL    time.Duration `mapstructure:"ttl"`    // the server cancels the proxy after this long, 0 means its default
+}
+
+// setDefaults sets the keys whose default is not their zero value.
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("server-addr", "localhost:8910")
+	v.SetDefault("multiplex", false)
+	v.SetDefault("heartbeat-interval", "5s")
+	v.SetDefault("heartbeat-timeout", "30s")
+	v.SetDefault("dial-timeout", "10s")
+	v.SetDefault("keepalive", "30s")
+	v.SetDefault("reconnect-interval", "1s")
+	v.SetDefault("reconnect-max-interval", "30s")
+	v.SetDefault("reconnect-max-retries", 0)
+	v.SetDefault("health-check-interval", "5s")
+}
+
+// defaultConfig is the config of the defaults only, without the flags, env
+// and config file LoadConfig reads.
+func defaultConfig() (Config, error) {
+	v := viper.New()
+	setDefaults(v)
+	var config Config
+	err := v.Unmarshal(&config)
+	return config, err
 }
 
 func LoadConfig(cfgFile string, args []string) (config Config, err error) {
-	viper.SetDefault("server-addr", "localhost:8910")
-	viper.SetDefault("multiplex", false)
+	setDefaults(viper.GetViper())
 
+	// flags > env > config file > defaults, empty env vars are ignored
 	viper.AutomaticEnv()
 	viper.SetEnvPrefix("GNAR")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.BindEnv("token")
 	viper.BindEnv("multiplex")
+	viper.BindEnv("tls")
+	viper.BindEnv("tls-skip-verify")
+	viper.BindEnv("tls-ca-file")
+	viper.BindEnv("tls-cert-file")
+	viper.BindEnv("tls-key-file")
+	viper.BindEnv("heartbeat-interval")
+	viper.BindEnv("heartbeat-timeout")
+	viper.BindEnv("dial-timeout")
+	viper.BindEnv("keepalive")
+	viper.BindEnv("reconnect-interval")
+	viper.BindEnv("reconnect-max-interval")
+	viper.BindEnv("reconnect-max-retries")
+	viper.BindEnv("health-check")
+	viper.BindEnv("health-check-interval")
+	viper.BindEnv("resolver")
 
 	if cfgFile != "" {
-		viper.SetConfigFile(cfgFile)
-		viper.SetConfigType("toml")
-		if err := viper.ReadInConfig(); err != nil {
+		if err := share.ReadConfigFile(cfgFile); err != nil {
 			return config, fmt.Errorf("error reading config file: %v", err)
 		}
 	}
@@ -48,14 +210,49 @@ func LoadConfig(cfgFile string, args []string) (config Config, err error) {
 	proxy := Proxy{
 		ProxyName:  viper.GetString("proxy-name"),
 		Subdomain:  viper.GetString("subdomain"),
+		Hostname:   viper.GetString("hostname"),
+		LocalAddr:  viper.GetString("local-addr"),
 		SpeedLimit: viper.GetString("speed-limit"),
 		ProxyType:  viper.GetString("proxy-type"),
+		BindHost:   viper.GetString("bind-host"),
+		Network:    viper.GetString("network"),
+		Compress:   viper.GetBool("compress"),
+		AllowIPs:   viper.GetStringSlice("allow-ips"),
+		DenyIPs:    viper.GetStringSlice("deny-ips"),
+		MaxConns:   viper.GetInt("max-conns"),
+		Overflow:   viper.GetString("overflow"),
+		ConnRate:   viper.GetInt("conn-rate"),
+		ConnBurst:  viper.GetInt("conn-burst"),
+
+		ProxyProtocol: viper.GetString("proxy-protocol"),
+		TerminateTLS:  viper.GetBool("terminate-tls"),
+		Weight:        viper.GetInt("weight"),
+		TTL:           viper.GetDuration("ttl"),
+
+		RequestHeaders:  viper.GetStringSlice("request-header"),
+		ResponseHeaders: viper.GetStringSlice("response-header"),
+	}
+
+	if _, err := config.TLS.ClientConfig(); err != nil {
+		return config, err
+	}
+	if config.HeartbeatTimeout < 0 {
+		return config, fmt.Errorf("invalid heartbeat-timeout: %s", config.HeartbeatTimeout)
+	}
+	if config.HealthCheck && config.HealthCheckInterval <= 0 {
+		return config, fmt.Errorf("invalid health-check-interval: %s", config.HealthCheckInterval)
+	}
+	if config.Resolver != "" {
+		if _, _, err := net.SplitHostPort(config.Resolver); err != nil {
+			return config, fmt.Errorf("invalid resolver: %s, expected host:port", config.Resolver)
+		}
 	}
 
 	if len(args) > 0 {
 		config.SvrAddr = args[0]
 	}
 
+	// the port mapping argument replaces the proxys of config file
 	if len(args) > 1 {
 		localRemote, err := parseProxyArg(args[1])
 		if err != nil {
@@ -63,32 +260,190 @@ func LoadConfig(cfgFile string, args []string) (config Config, err error) {
 		}
 		proxy.LocalPort = localRemote.LocalPort
 		proxy.RemotePort = localRemote.RemotePort
+		proxy.RemotePortEnd = localRemote.RemotePortEnd
+		config.Proxys = []Proxy{proxy}
 	}
 
-	config.Proxys = []Proxy{proxy}
+	for i := range config.Proxys {
+		if err := config.Proxys[i].normalize(); err != nil {
+			return config, fmt.Errorf("invalid proxy #%d: %v", i+1, err)
+		}
+	}
 
 	return config, nil
 }
 
+// normalize fills the defaults and checks that the local target is a host:port.
+func (p *Proxy) normalize() error {
+	if p.ProxyType == "" {
+		p.ProxyType = "tcp"
+	}
+	if p.MaxConns > 0 {
+		if p.Overflow == "" {
+			p.Overflow = "reject"
+		}
+		if p.Overflow != "reject" && p.Overflow != "queue" {
+			return fmt.Errorf("invalid overflow: %s, expected reject or queue", p.Overflow)
+		}
+	} else {
+		p.MaxConns, p.Overflow = 0, ""
+	}
+
+	if p.Weight < 0 {
+		return fmt.Errorf("invalid weight: %d", p.Weight)
+	}
+	if p.TTL < 0 || (p.TTL > 0 && p.TTL < time.Second) {
+		return fmt.Errorf("invalid ttl: %s, expected at least 1s", p.TTL)
+	}
+	if p.ConnRate < 0 || p.ConnBurst < 0 {
+		return fmt.Errorf("invalid conn rate: %d, burst: %d", p.ConnRate, p.ConnBurst)
+	}
+	if p.ConnRate > 0 && p.ProxyType == "udp" {
+		return errors.New("conn rate is not supported by udp proxy")
+	}
+
+	if p.RemotePortEnd != 0 {
+		if p.ProxyType != "tcp" {
+			return fmt.Errorf("port range is not supported by %s proxy", p.ProxyType)
+		}
+		if p.RemotePort <= 0 || p.RemotePortEnd <= p.RemotePort || p.RemotePortEnd > 65535 {
+			return fmt.Errorf("invalid remote port range: %d-%d", p.RemotePort, p.RemotePortEnd)
+		}
+		if strings.HasPrefix(p.LocalAddr, "unix:") {
+			return errors.New("port range is not supported with unix socket local addr")
+		}
+	}
+
+	switch p.Network {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("invalid network: %s, expected tcp, tcp4 or tcp6", p.Network)
+	}
+	if p.Network != "" && p.Network != "tcp" && (p.ProxyType == "http" || p.ProxyType == "tls") {
+		return fmt.Errorf("network is not supported by %s proxy", p.ProxyType)
+	}
+
+	if p.Hostname != "" && p.ProxyType != "tls" {
+		return errors.New("hostname is only supported by tls proxy")
+	}
+	if p.TerminateTLS && p.ProxyType != "tls" {
+		return errors.New("terminate-tls is only supported by tls proxy")
+	}
+
+	switch p.ProxyProtocol {
+	case "":
+	case "v1", "v2":
+		if p.ProxyType != "tcp" && p.ProxyType != "http" && p.ProxyType != "tls" {
+			return fmt.Errorf("proxy protocol is not supported by %s proxy", p.ProxyType)
+		}
+	default:
+		return fmt.Errorf("invalid proxy protocol: %s, expected v1 or v2", p.ProxyProtocol)
+	}
+
+	if len(p.RequestHeaders) > 0 || len(p.ResponseHeaders) > 0 {
+		if p.ProxyType != "http" {
+			return fmt.Errorf("header rules are not supported by %s proxy", p.ProxyType)
+		}
+		if _, err := proxy.ParseHeaderRules(p.RequestHeaders); err != nil {
+			return fmt.Errorf("invalid request-headers: %v", err)
+		}
+		if _, err := proxy.ParseHeaderRules(p.ResponseHeaders); err != nil {
+			return fmt.Errorf("invalid response-headers: %v", err)
+		}
+	}
+
+	// socks5 proxys dial the target of every request
+	if p.ProxyType == "socks5" {
+		p.LocalAddr, p.LocalPort = "", 0
+		return nil
+	}
+
+	if p.LocalAddr == "" {
+		if p.LocalPort <= 0 || p.LocalPort > 65535 {
+			return fmt.Errorf("invalid local port: %d", p.LocalPort)
+		}
+		p.LocalAddr = fmt.Sprintf(":%d", p.LocalPort)
+		return p.checkLocalRange()
+	}
+
+	if path, ok := strings.CutPrefix(p.LocalAddr, "unix:"); ok {
+		if p.ProxyType != "tcp" && p.ProxyType != "http" && p.ProxyType != "tls" {
+			return fmt.Errorf("unix socket local addr is not supported by %s proxy", p.ProxyType)
+		}
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("invalid local addr: unix socket path must be absolute: %q", path)
+		}
+		p.LocalAddr, p.LocalPort = "unix:"+filepath.Clean(path), 0
+		return nil
+	}
+
+	_, port, err := net.SplitHostPort(p.LocalAddr)
+	if err != nil {
+		return fmt.Errorf("invalid local addr: %v", err)
+	}
+	lport, err := strconv.Atoi(port)
+	if err != nil || lport <= 0 || lport > 65535 {
+		return fmt.Errorf("invalid local addr port: %q", port)
+	}
+	p.LocalPort = lport
+	return p.checkLocalRange()
+}
+
+// checkLocalRange checks that the local ports of a range fit, as many as
+// the remote ones.
+func (p *Proxy) checkLocalRange() error {
+	if p.RemotePortEnd != 0 && p.LocalPort+p.RemotePortEnd-p.RemotePort > 65535 {
+		return fmt.Errorf("invalid local port range: %d-%d", p.LocalPort, p.LocalPort+p.RemotePortEnd-p.RemotePort)
+	}
+	return nil
+}
+
 func parseProxyArg(arg string) (Proxy, error) {
 	parts := strings.Split(arg, ":")
 	if len(parts) != 2 {
 		return Proxy{}, fmt.Errorf("invalid proxy format. Expected localPort:remotePort")
 	}
 
-	localPort, err := strconv.Atoi(parts[0])
+	localPort, localEnd, err := parsePortRange(parts[0])
 	if err != nil {
 		return Proxy{}, fmt.Errorf("invalid local port: %v", err)
 	}
 
-	remotePort, err := strconv.Atoi(parts[1])
+	remote := parts[1]
+	if remote == "auto" {
+		// the server picks the port, out of its auto-ports pool if it has one
+		remote = "0"
+	}
+	remotePort, remoteEnd, err := parsePortRange(remote)
 	if err != nil {
 		return Proxy{}, fmt.Errorf("invalid remote port: %v", err)
 	}
 
+	if (localEnd != 0 || remoteEnd != 0) && localEnd-localPort != remoteEnd-remotePort {
+		return Proxy{}, fmt.Errorf("invalid proxy format. Port ranges %s and %s differ in size", parts[0], parts[1])
+	}
+
 	return Proxy{
-		LocalPort:  localPort,
-		RemotePort: remotePort,
-		ProxyType:  "tcp",
+		LocalPort:     localPort,
+		RemotePort:    remotePort,
+		RemotePortEnd: remoteEnd,
+		ProxyType:     "tcp",
 	}, nil
 }
+
+// parsePortRange parses a port or a start-end range, end is 0 for a port.
+func parsePortRange(s string) (int, int, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	start, err := strconv.Atoi(first)
+	if err != nil || !isRange {
+		return start, 0, err
+	}
+	end, err := strconv.Atoi(last)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end <= start {
+		return 0, 0, fmt.Errorf("invalid port range: %s", s)
+	}
+	return start, end, nil
+}
@@ -1,7 +1,9 @@
 package control
 
 import (
+	"crypto/tls"
 	"net"
+	"sync"
 
 	"github.com/abcdlsj/gnar/pkg/proto"
 	"github.com/hashicorp/yamux"
@@ -11,20 +13,73 @@ type AuthSvrDialer interface {
 	Open() (net.Conn, error)
 }
 
+// Dialer opens the conns to the server, a *net.Dialer or e.g. an in memory
+// transport in tests.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// dial connects to the server, using tls when tlsCfg is set, or over
+// websocket for ws:// and wss:// addrs.
+func dial(d Dialer, addr string, tlsCfg *tls.Config) (net.Conn, error) {
+	if isWSAddr(addr) {
+		return dialWS(d, addr, tlsCfg)
+	}
+	if tlsCfg == nil {
+		return d.Dial("tcp", addr)
+	}
+	if nd, ok := d.(*net.Dialer); ok {
+		// the dial timeout bounds the handshake too
+		return tls.DialWithDialer(nd, "tcp", addr, tlsCfg)
+	}
+
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return handshakeTLS(conn, host, tlsCfg)
+}
+
+// handshakeTLS runs the client handshake over conn, host is the name the
+// certificate is verified for when tlsCfg has no ServerName.
+func handshakeTLS(conn net.Conn, host string, tlsCfg *tls.Config) (net.Conn, error) {
+	cfg := &tls.Config{}
+	if tlsCfg != nil {
+		cfg = tlsCfg.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
 type TCPDialer struct {
-	addr  string
-	token string
+	addr   string
+	token  string
+	dialer Dialer
+	tlsCfg *tls.Config
 }
 
-func NewTCPDialer(addr, token string) *TCPDialer {
+func NewTCPDialer(addr, token string, dialer Dialer, tlsCfg *tls.Config) *TCPDialer {
 	return &TCPDialer{
-		addr:  addr,
-		token: token,
+		addr:   addr,
+		token:  token,
+		dialer: dialer,
+		tlsCfg: tlsCfg,
 	}
 }
 
 func (t *TCPDialer) Open() (net.Conn, error) {
-	conn, err := net.Dial("tcp", t.addr)
+	conn, err := dial(t.dialer, t.addr, t.tlsCfg)
 	if err != nil {
 		return nil, err
 	}
@@ -36,32 +91,44 @@ func (t *TCPDialer) Open() (net.Conn, error) {
 	return conn, nil
 }
 
+// MuxDialer opens yamux streams over a single control connection, it is safe
+// to share between proxyers and redials when the session is closed.
 type MuxDialer struct {
 	addr    string
 	token   string
+	dialer  Dialer
+	tlsCfg  *tls.Config
 	session *yamux.Session
+	mu      sync.Mutex
 }
 
-func NewMuxDialer(addr, token string) *MuxDialer {
+func NewMuxDialer(addr, token string, dialer Dialer, tlsCfg *tls.Config) *MuxDialer {
 	return &MuxDialer{
-		addr:  addr,
-		token: token,
+		addr:   addr,
+		token:  token,
+		dialer: dialer,
+		tlsCfg: tlsCfg,
 	}
 }
 
 func (m *MuxDialer) Open() (net.Conn, error) {
-	if m.session == nil {
-		conn, err := net.Dial("tcp", m.addr)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.session == nil || m.session.IsClosed() {
+		conn, err := dial(m.dialer, m.addr, m.tlsCfg)
 		if err != nil {
 			return nil, err
 		}
 
 		if err = proto.Send(conn, proto.NewMsgLogin(m.token)); err != nil {
+			conn.Close()
 			return nil, err
 		}
 
 		session, err := yamux.Client(conn, nil)
 		if err != nil {
+			conn.Close()
 			return nil, err
 		}
 
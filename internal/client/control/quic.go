@@ -0,0 +1,97 @@
+package control
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abcdlsj/gnar/pkg/proto"
+	"github.com/abcdlsj/gnar/pkg/share"
+	"github.com/quic-go/quic-go"
+)
+
+// IsQUICAddr tells a quic:// server addr from a host:port.
+func IsQUICAddr(addr string) bool {
+	return strings.HasPrefix(addr, "quic://")
+}
+
+// QUICDialer opens a stream per conn over one quic connection to the
+// server, every stream logs in like a tcp conn. It is safe to share between
+// proxyers and redials when the connection is closed.
+type QUICDialer struct {
+	addr        string // host:port without the scheme
+	token       string
+	tlsCfg      *tls.Config
+	dialTimeout time.Duration
+	keepAlive   time.Duration
+	conn        quic.Connection
+	mu          sync.Mutex
+}
+
+// NewQUICDialer dials the quic:// addr, the server certificate is verified
+// with tlsCfg or the system roots when it is nil.
+func NewQUICDialer(addr, token string, tlsCfg *tls.Config, dialTimeout, keepAlive time.Duration) *QUICDialer {
+	return &QUICDialer{
+		addr:        strings.TrimPrefix(addr, "quic://"),
+		token:       token,
+		tlsCfg:      tlsCfg,
+		dialTimeout: dialTimeout,
+		keepAlive:   keepAlive,
+	}
+}
+
+func (q *QUICDialer) Open() (net.Conn, error) {
+	conn, err := q.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	qconn := share.NewQUICConn(stream, conn)
+	if err = proto.Send(qconn, proto.NewMsgLogin(q.token)); err != nil {
+		qconn.Close()
+		return nil, err
+	}
+	return qconn, nil
+}
+
+func (q *QUICDialer) connection() (quic.Connection, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.conn != nil && q.conn.Context().Err() == nil {
+		return q.conn, nil
+	}
+
+	cfg := &tls.Config{}
+	if q.tlsCfg != nil {
+		cfg = q.tlsCfg.Clone()
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(q.addr)
+		if err != nil {
+			host = q.addr
+		}
+		cfg.ServerName = host
+	}
+	cfg.NextProtos = []string{share.QUICProto}
+
+	ctx := context.Background()
+	if q.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.dialTimeout)
+		defer cancel()
+	}
+	conn, err := quic.DialAddr(ctx, q.addr, cfg, &quic.Config{KeepAlivePeriod: q.keepAlive})
+	if err != nil {
+		return nil, err
+	}
+	q.conn = conn
+	return conn, nil
+}
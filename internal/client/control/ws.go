@@ -0,0 +1,113 @@
+package control
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// isWSAddr tells a ws:// or wss:// server url from a host:port.
+func isWSAddr(addr string) bool {
+	return strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://")
+}
+
+// dialWS connects to the websocket url of the server, through the http proxy
+// of the HTTPS_PROXY or HTTP_PROXY environment when there is one. wss uses
+// tlsCfg, or the default verification when it is nil.
+func dialWS(d Dialer, rawURL string, tlsCfg *tls.Config) (net.Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server url: %v", err)
+	}
+	httpScheme, port := "http", "80"
+	if u.Scheme == "wss" {
+		httpScheme, port = "https", "443"
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+
+	proxyURL, err := http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: httpScheme, Host: addr}})
+	if err != nil {
+		return nil, fmt.Errorf("invalid http proxy: %v", err)
+	}
+
+	var conn net.Conn
+	if proxyURL != nil {
+		conn, err = dialConnect(d, proxyURL, addr)
+	} else {
+		conn, err = d.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "wss" {
+		if conn, err = handshakeTLS(conn, u.Hostname(), tlsCfg); err != nil {
+			return nil, err
+		}
+	}
+
+	wsCfg, err := websocket.NewConfig(rawURL, fmt.Sprintf("%s://%s", httpScheme, u.Host))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("invalid server url: %v", err)
+	}
+	ws, err := websocket.NewClient(wsCfg, conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error upgrading to websocket: %v", err)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// dialConnect opens a tunnel to addr with a CONNECT request to the http proxy.
+func dialConnect(d Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	conn, err := d.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to http proxy: %v", err)
+	}
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req += fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", auth)
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error sending connect to http proxy: %v", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error reading http proxy response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy refused connect: %s", resp.Status)
+	}
+	// the server speaks after the upgrade request only
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, errors.New("unexpected data from http proxy after connect")
+	}
+	return conn, nil
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/abcdlsj/gnar/internal/client/tunnel"
+)
+
+var errLocalDown = errors.New("local target is down")
+
+// probesLocal tells if the proxy has a local target a tcp or unix dial can
+// check, socks5 dials a target per request and udp accepts no conns.
+func (f *Proxyer) probesLocal() bool {
+	return f.healthCheck > 0 && f.proxyType != "socks5" && f.proxyType != "udp"
+}
+
+// probeLocal dials the local target, the first port of a port range.
+func (f *Proxyer) probeLocal() error {
+	network, addr := tunnel.LocalNetwork(f.localAddr)
+	ctx, cancel := context.WithTimeout(context.Background(), f.healthCheck)
+	defer cancel()
+	conn, err := f.localDialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// waitLocalUp blocks until the local target accepts conns, the proxy is not
+// registered before.
+func (f *Proxyer) waitLocalUp() {
+	err := f.probeLocal()
+	if err == nil {
+		return
+	}
+	f.logger.Warnf("Local target %s is down, not registering the proxy until it is up: %v", f.localAddr, err)
+
+	ticker := time.NewTicker(f.healthCheck)
+	defer ticker.Stop()
+	for range ticker.C {
+		if f.isClosed() {
+			return
+		}
+		if err := f.probeLocal(); err == nil {
+			f.logger.Infof("Local target %s is up, registering the proxy", f.localAddr)
+			return
+		}
+	}
+}
+
+// watchLocal probes the local target of the registered proxy until done is
+// closed. When it is down the proxy is canceled and rConn closed, serve then
+// returns errLocalDown.
+func (f *Proxyer) watchLocal(rConn net.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(f.healthCheck)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		err := f.probeLocal()
+		if err == nil {
+			continue
+		}
+		f.logger.Warnf("Local target %s is down, canceling the proxy: %v", f.localAddr, err)
+
+		f.mu.Lock()
+		f.localDown = true
+		f.mu.Unlock()
+		if err := f.cancel(); err != nil {
+			f.logger.Errorf("Error canceling proxy: %v", err)
+		}
+		rConn.Close()
+		return
+	}
+}
+
+// takeLocalDown reports and clears a cancel of watchLocal.
+func (f *Proxyer) takeLocalDown() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	down := f.localDown
+	f.localDown = false
+	return down
+}
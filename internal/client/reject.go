@@ -0,0 +1,23 @@
+package client
+
+import "github.com/abcdlsj/gnar/pkg/proto"
+
+var rejectHints = map[proto.RejectCode]string{
+	proto.RejectAuth:           "check the token of the client",
+	proto.RejectVersion:        "upgrade the client or the server to a common protocol version",
+	proto.RejectInvalidPort:    "pick a remote port the server allows or reserves for the proxy",
+	proto.RejectInUse:          "another proxy holds the remote port or domain",
+	proto.RejectLimit:          "a limit of the server is reached",
+	proto.RejectUnsupported:    "the server doesn't enable the proxy type",
+	proto.RejectInvalidRequest: "fix the proxy options",
+	proto.RejectDenied:         "the server policy doesn't allow the proxy",
+	proto.RejectInternal:       "the server failed to set up the proxy",
+}
+
+// rejectHint tells what to do about a reject of the server.
+func rejectHint(code proto.RejectCode) string {
+	if hint, ok := rejectHints[code]; ok {
+		return hint
+	}
+	return "code: " + string(code)
+}
@@ -1,193 +1,604 @@
 package client
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
+	"unicode"
 
+	"github.com/abcdlsj/gnar/internal/backoff"
 	"github.com/abcdlsj/gnar/internal/client/control"
 	"github.com/abcdlsj/gnar/internal/client/tunnel"
 	"github.com/abcdlsj/gnar/internal/logger"
+	"github.com/abcdlsj/gnar/internal/pio"
 	"github.com/abcdlsj/gnar/internal/terminal"
 	"github.com/abcdlsj/gnar/pkg/proto"
 	"github.com/abcdlsj/gnar/pkg/share"
 )
 
+// cancelTimeout bounds the proxy cancels on shutdown.
+const cancelTimeout = 5 * time.Second
+
+// errExpired stops re-registering a proxy whose ttl ran out while the
+// client was disconnected.
+var errExpired = errors.New("proxy ttl expired")
+
 type Client struct {
-	cfg Config
+	cfg         Config
+	dialer      control.Dialer
+	localDialer tunnel.Dialer
+	log         *logger.Logger
 }
 
 type Proxyer struct {
-	remotePort int
-	localPort  int
-	token      string
-	svraddr    string // server host:port
-	proxyName  string
-	subdomain  string
-	speedLimit string
-	proxyType  string
-	ctrlDialer control.AuthSvrDialer
-	logger     *logger.Logger
+	remotePort  int
+	remoteEnd   int // last remote port of a range, 0 for one port
+	localPort   int
+	localAddr   string
+	token       string
+	svraddr     string // server host:port
+	proxyName   string
+	subdomain   string
+	hostname    string
+	terminate   bool // the server terminates the tls of the proxy
+	speedLimit  string
+	proxyType   string
+	bindHost    string
+	network     string
+	compress    bool // negotiated with server on every registration
+	allowIPs    []string
+	denyIPs     []string
+	maxConns    int
+	connRate    int
+	connBurst   int
+	overflow    string
+	proxyProto  string
+	reqHeaders  []string
+	respHeaders []string
+	weight      int
+	ttl         time.Duration
+	expires     time.Time // when the server cancels the proxy, zero without a ttl
+	ctrlDialer  control.AuthSvrDialer
+	localDialer tunnel.Dialer
+	heartbeat   time.Duration
+	hbTimeout   time.Duration // of reading the control conn, 0 disables it
+	healthCheck time.Duration // interval of the local target probes, 0 disables them
+	retry       *backoff.Exponential
+	logger      *logger.Logger
+
+	closed    bool
+	localDown bool          // canceled by the local target probes
+	ctrl      net.Conn      // control conn of the registered proxy, nil while it is not registered
+	served    chan struct{} // closed when the proxy of ctrl stops being served
+	mu        sync.Mutex
+}
 
-	mu sync.Mutex
+// Option configures a Client at creation.
+type Option func(*Client)
+
+// WithLogger makes the client and its proxyers write their logs to l instead
+// of the default logger.
+func WithLogger(l *logger.Logger) Option {
+	return func(c *Client) {
+		c.log = l
+	}
 }
 
-func newClient(cfg Config) *Client {
-	return &Client{
-		cfg: cfg,
+// WithDialer makes the client open its conns to the server with d instead
+// of a net.Dialer of the config, e.g. an in memory transport in tests.
+func WithDialer(d control.Dialer) Option {
+	return func(c *Client) {
+		c.dialer = d
 	}
 }
 
-func newProxyer(svraddr string, token string, mux bool, f Proxy) *Proxyer {
+// WithLocalDialer makes the client dial the local targets with d instead of
+// a net.Dialer with the resolver of the config, e.g. to reach them from
+// another network namespace or to fake them in tests.
+func WithLocalDialer(d tunnel.Dialer) Option {
+	return func(c *Client) {
+		c.localDialer = d
+	}
+}
+
+// New creates a client of cfg, start with the one of LoadConfig for the
+// defaults.
+func New(cfg Config, opts ...Option) *Client {
+	c := &Client{
+		cfg:         cfg,
+		dialer:      cfg.NetDialer(),
+		localDialer: cfg.LocalDialer(),
+		log:         logger.New(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func newProxyer(cfg Config, ctrlDialer control.AuthSvrDialer, localDialer tunnel.Dialer, f Proxy, log *logger.Logger) *Proxyer {
 	logPrefix := fmt.Sprintf("%s [%d:%d]", strings.ToUpper(f.ProxyType), f.LocalPort, f.RemotePort)
+	if network, path := tunnel.LocalNetwork(f.LocalAddr); network == "unix" {
+		logPrefix = fmt.Sprintf("%s [%s:%d]", strings.ToUpper(f.ProxyType), path, f.RemotePort)
+	}
+	if f.RemotePortEnd != 0 {
+		logPrefix = fmt.Sprintf("%s [%d-%d:%d-%d]", strings.ToUpper(f.ProxyType),
+			f.LocalPort, f.LocalPort+f.RemotePortEnd-f.RemotePort, f.RemotePort, f.RemotePortEnd)
+	}
 	if f.ProxyName != "" {
 		logPrefix = fmt.Sprintf("%s [%s]", strings.ToUpper(f.ProxyType), f.ProxyName)
 	}
 
 	proxyer := &Proxyer{
-		token:      token,
-		svraddr:    svraddr,
-		proxyName:  f.ProxyName,
-		subdomain:  f.Subdomain,
-		remotePort: f.RemotePort,
-		localPort:  f.LocalPort,
-		speedLimit: f.SpeedLimit,
-		proxyType:  f.ProxyType,
-		logger:     logger.New(logPrefix),
-		ctrlDialer: control.NewTCPDialer(svraddr, token),
-	}
-
-	if mux {
-		proxyer.ctrlDialer = control.NewMuxDialer(svraddr, token)
+		token:       cfg.Token,
+		svraddr:     cfg.SvrAddr,
+		proxyName:   f.ProxyName,
+		subdomain:   f.Subdomain,
+		hostname:    f.Hostname,
+		terminate:   f.TerminateTLS,
+		remotePort:  f.RemotePort,
+		remoteEnd:   f.RemotePortEnd,
+		localPort:   f.LocalPort,
+		localAddr:   f.LocalAddr,
+		speedLimit:  f.SpeedLimit,
+		proxyType:   f.ProxyType,
+		bindHost:    f.BindHost,
+		network:     f.Network,
+		compress:    f.Compress,
+		allowIPs:    f.AllowIPs,
+		denyIPs:     f.DenyIPs,
+		maxConns:    f.MaxConns,
+		connRate:    f.ConnRate,
+		connBurst:   f.ConnBurst,
+		overflow:    f.Overflow,
+		proxyProto:  f.ProxyProtocol,
+		reqHeaders:  f.RequestHeaders,
+		respHeaders: f.ResponseHeaders,
+		weight:      f.Weight,
+		ttl:         f.TTL,
+		logger:      log.CloneAdd(logPrefix),
+		ctrlDialer:  ctrlDialer,
+		localDialer: localDialer,
+		heartbeat:   cfg.HeartbeatInterval,
+		hbTimeout:   cfg.HeartbeatTimeout,
+		healthCheck: cfg.healthCheckInterval(),
+		retry:       backoff.NewExponential(cfg.Reconnect.Interval, cfg.Reconnect.MaxInterval, cfg.Reconnect.MaxRetries),
 	}
 
 	return proxyer
 }
 
-func (f *Proxyer) cancel() {
+func (f *Proxyer) isClosed() bool {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	return f.closed
+}
 
-	conn, err := f.ctrlDialer.Open()
-	if err != nil {
-		logger.Fatalf("Error connecting to remote: %v", err)
+func (f *Proxyer) close() error {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+
+	return f.cancel()
+}
+
+// cancel tells the server on the control conn of the proxy to release it,
+// only a registered proxy is canceled, the port may be another client's.
+func (f *Proxyer) cancel() error {
+	f.mu.Lock()
+	ctrl, served, remotePort := f.ctrl, f.served, f.remotePort
+	f.mu.Unlock()
+	if ctrl == nil {
+		return nil
+	}
+
+	// a hung server must not hold the shutdown
+	ctrl.SetWriteDeadline(time.Now().Add(cancelTimeout))
+	if err := proto.Send(ctrl, proto.NewMsgCancel("", f.proxyName, remotePort)); err != nil {
+		ctrl.Close()
+		return fmt.Errorf("error sending cancel msg to remote: %v", err)
 	}
-	if err = proto.Send(conn, proto.NewMsgCancel(f.token, f.proxyName, f.remotePort)); err != nil {
-		logger.Fatalf("Error sending cancel msg to remote: %v", err)
+	// the server closes the control conn once the port is released
+	select {
+	case <-served:
+	case <-time.After(cancelTimeout):
+		ctrl.Close()
+		return fmt.Errorf("no cancel ack from remote in %s", cancelTimeout)
 	}
 
-	logger.Infof("Close connection to server, local port: %d, remote port: %d", f.localPort, f.remotePort)
+	f.logger.Infof("Close connection to server, local port: %d, remote port: %d", f.localPort, remotePort)
+	return nil
 }
 
+// Run serves the proxys until the process gets a signal to shutdown.
 func (c *Client) Run() error {
 	c.printMetaInfo()
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, os.Interrupt, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		c.log.Infof("Receive signal %s to shutdown", <-sc)
+		cancel()
+	}()
+	if len(c.cfg.Proxys) != 0 {
+		c.log.Info("Press Ctrl+C to shutdown")
+	}
+	return c.Serve(ctx)
+}
+
+// Serve registers the proxys and serves them until ctx is done, then cancels
+// them on the server. A proxy rejected for good, or out of retries, stops the
+// others too and its error is returned.
+func (c *Client) Serve(ctx context.Context) error {
 	if len(c.cfg.Proxys) == 0 {
-		logger.Error("No proxy config found, please check your config")
+		c.log.Error("No proxy config found, please check your config")
 		return nil
 	}
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, os.Interrupt, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
-	cancelFns := make([]func(), 0)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(c.cfg.Proxys))
+
+	// all proxyers share the dialer, with multiplex they share one control connection
+	ctrlDialer := c.newCtrlDialer()
+	proxyers := make([]*Proxyer, 0, len(c.cfg.Proxys))
 	for _, proxy := range c.cfg.Proxys {
-		proxyer := newProxyer(c.cfg.SvrAddr, c.cfg.Token, c.cfg.Multiplex, proxy)
-		go proxyer.Run()
+		proxyer := newProxyer(c.cfg, ctrlDialer, c.localDialer, proxy, c.log)
+		go func() {
+			if err := proxyer.Run(); err != nil {
+				proxyer.logger.Errorf("Proxy stopped: %v", err)
+				errs <- err
+				cancel()
+			}
+		}()
+		proxyers = append(proxyers, proxyer)
+	}
+	<-ctx.Done()
+
+	// cancel every proxy at once so the server releases the ports right away
+	var wg sync.WaitGroup
+	for _, proxyer := range proxyers {
+		wg.Add(1)
+		go func(proxyer *Proxyer) {
+			defer wg.Done()
+			if err := proxyer.close(); err != nil {
+				proxyer.logger.Errorf("Error canceling proxy: %v", err)
+			}
+		}(proxyer)
+	}
 
-		cancelFns = append(cancelFns, func() {
-			proxyer.cancel()
-		})
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	// the cancel conns time out first, this bounds a dial that hangs
+	select {
+	case <-done:
+		c.log.Info("Shutdown success")
+	case <-time.After(cancelTimeout + time.Second):
+		c.log.Warn("Shutdown timed out, the server frees the left proxys on heartbeat timeout")
 	}
-	logger.Info("Press Ctrl+C to shutdown")
-	logger.Infof("Receive signal %s to shutdown", <-sc)
 
-	for _, cancelFn := range cancelFns {
-		cancelFn()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
 	}
+}
 
-	logger.Info("Shutdown success")
-	return nil
+func (c *Client) newCtrlDialer() control.AuthSvrDialer {
+	tlsCfg, _ := c.cfg.TLS.ClientConfig() // validated with the config
+	if control.IsQUICAddr(c.cfg.SvrAddr) {
+		// the streams of the quic connection multiplex already
+		return control.NewQUICDialer(c.cfg.SvrAddr, c.cfg.Token, tlsCfg, c.cfg.DialTimeout, c.cfg.KeepAlive)
+	}
+	if c.cfg.Multiplex {
+		return control.NewMuxDialer(c.cfg.SvrAddr, c.cfg.Token, c.dialer, tlsCfg)
+	}
+	return control.NewTCPDialer(c.cfg.SvrAddr, c.cfg.Token, c.dialer, tlsCfg)
 }
 
-func (f *Proxyer) Run() {
+// Run serves the proxy until it is closed or expires, it returns the error of
+// a reject that retrying can't fix or of the last retry.
+func (f *Proxyer) Run() (err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			f.logger.Fatalf("Proxy panic: %v", r)
+			err = fmt.Errorf("proxy panic: %v", r)
 		}
 	}()
 
+	for {
+		if f.probesLocal() {
+			if f.waitLocalUp(); f.isClosed() {
+				return nil
+			}
+		}
+		err := f.serve()
+		if f.isClosed() {
+			return nil
+		}
+		if errors.Is(err, errLocalDown) {
+			continue
+		}
+		if errors.Is(err, errExpired) {
+			f.logger.Warn("Proxy ttl expired, stop serving")
+			return nil
+		}
+		var reject *proto.RejectError
+		if errors.As(err, &reject) {
+			if !reject.Code.Temporary() {
+				return fmt.Errorf("proxy rejected, won't reconnect: %v, %s", err, rejectHint(reject.Code))
+			}
+			f.logger.Errorf("Proxy rejected: %v, %s", err, rejectHint(reject.Code))
+		} else {
+			f.logger.Errorf("Proxy disconnected: %v", err)
+		}
+
+		wait, ok := f.retry.Next()
+		if !ok {
+			return fmt.Errorf("give up reconnecting to server after %d retries", f.retry.Attempt())
+		}
+		f.logger.Infof("Reconnecting to server in %s, attempt %d", wait.Round(time.Millisecond), f.retry.Attempt())
+		time.Sleep(wait)
+	}
+}
+
+// serve registers the proxy and handles server messages until the control
+// connection is broken.
+func (f *Proxyer) serve() error {
 	rConn, err := f.ctrlDialer.Open()
 	if err != nil {
-		f.logger.Fatalf("Error open svr connection to remote: %v", err)
+		return fmt.Errorf("error open svr connection to remote: %v", err)
+	}
+	defer rConn.Close()
+
+	if err := f.newProxy(rConn); err != nil {
+		return err
 	}
+	served := make(chan struct{})
+	f.mu.Lock()
+	if f.closed {
+		// shut down while registering, the disconnect releases the port
+		f.mu.Unlock()
+		return nil
+	}
+	f.ctrl, f.served = rConn, served
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.ctrl = nil
+		f.mu.Unlock()
+		close(served)
+	}()
+	f.retry.Reset()
+	go f.tickHeart(rConn)
 
-	f.mustNewProxy(rConn)
+	if f.probesLocal() {
+		done := make(chan struct{})
+		defer close(done)
+		go f.watchLocal(rConn, done)
+	}
 
 	for {
+		// the server sends heartbeats, nothing read for so long is a dead link
+		if f.hbTimeout > 0 {
+			rConn.SetReadDeadline(time.Now().Add(f.hbTimeout))
+		}
 		p, buf, err := proto.Read(rConn)
 		if err != nil {
-			f.logger.Errorf("Error reading msg from remote: %v", err)
-			f.cancel()
-			return
+			if f.takeLocalDown() {
+				return errLocalDown
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return fmt.Errorf("no heartbeat from remote in %s", f.hbTimeout)
+			}
+			// the server releases the port on the disconnect, a late cancel could
+			// hit the proxy of another client on it
+			return fmt.Errorf("error reading msg from remote: %v", err)
 		}
 
 		nlogger := f.logger.CloneAdd(p.String())
-		switch p {
-		case proto.PacketExchange:
-			msg := &proto.MsgExchange{}
-			if err := json.Unmarshal(buf, msg); err != nil {
-				nlogger.Errorf("Error reading exchange msg from remote: %v", err)
-				f.cancel()
-				return
+		msg, err := proto.Unmarshal(p, buf)
+		if errors.Is(err, proto.ErrUnknownPacket) {
+			// a newer server, the packet is of a feature this client lacks
+			nlogger.Debugf("Skipping packet: %v", err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s msg from remote: %v", p, err)
+		}
+
+		switch msg := msg.(type) {
+		case *proto.MsgExchange:
+			f.handleExchange(rConn, msg, nlogger)
+		case *proto.MsgProxyCancel:
+			f.mu.Lock()
+			f.closed = true
+			f.mu.Unlock()
+
+			if msg.Reason != "" {
+				nlogger.Warnf("Proxy canceled by server: %s, stop serving", msg.Reason)
+				return nil
 			}
+			nlogger.Warn("Proxy canceled by server, stop serving")
+			return nil
+		case *proto.MsgBanner:
+			f.logBanner(msg.Text)
+		case *proto.MsgHeartbeat:
+			nlogger.Debug("")
+		}
+	}
+}
 
-			f.handleExchange(msg, nlogger)
-		case proto.PacketHeartbeat:
-			msg := &proto.MsgHeartbeat{}
-			if err := json.Unmarshal(buf, msg); err != nil {
-				nlogger.Errorf("Error reading heartbeat msg from remote: %v", err)
-				f.cancel()
-				return
+// logBanner logs the message of the server operator line by line, with the
+// control chars dropped.
+func (f *Proxyer) logBanner(text string) {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
 			}
+			return r
+		}, line)
+		if line != "" {
+			f.logger.Warnf("Server banner: %s", line)
+		}
+	}
+}
 
-			nlogger.Debug("")
+func (f *Proxyer) tickHeart(rConn net.Conn) {
+	if f.heartbeat <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(f.heartbeat)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := proto.Send(rConn, proto.NewMsgHeartbeat()); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				f.logger.Warnf("Error sending heartbeat msg to remote: %v", err)
+			}
+			return
 		}
 	}
 }
 
-func (f *Proxyer) handleExchange(msg *proto.MsgExchange, nlogger *logger.Logger) {
-	nlogger.Infof("Receive user conn from server, start proxying, conn_id: %s", msg.ConnId)
+// handleExchange claims the user conn of msg on a new conn to the server, a
+// failure is told on ctrl for the server to drop the user conn at once.
+func (f *Proxyer) handleExchange(ctrl net.Conn, msg *proto.MsgExchange, nlogger *logger.Logger) {
+	nlogger = nlogger.WithConnId(msg.ConnId)
+	nlogger.Info("Receive user conn from server, start proxying")
+
+	localAddr := f.localAddr
+	if msg.Port != 0 {
+		var err error
+		if localAddr, err = f.rangeLocalAddr(msg.Port); err != nil {
+			nlogger.Errorf("Error mapping user conn to local port: %v", err)
+			f.failExchange(ctrl, msg.ConnId, err, nlogger)
+			return
+		}
+	}
+
 	rConn, err := f.ctrlDialer.Open()
 	if err != nil {
 		nlogger.Errorf("Error connecting to remote: %v", err)
+		f.failExchange(ctrl, msg.ConnId, err, nlogger)
 		return
 	}
 
 	if err = proto.Send(rConn, proto.NewMsgExchange(msg.ConnId, f.proxyType)); err != nil {
 		nlogger.Infof("Error sending exchange msg to remote: %v", err)
+		rConn.Close()
+		f.failExchange(ctrl, msg.ConnId, err, nlogger)
 		return
 	}
 
-	go tunnel.RunTunnel(f.localPort, msg.ProxyType, f.speedLimit, nlogger, rConn)
+	go tunnel.RunTunnel(f.localDialer, localAddr, msg.ProxyType, f.speedLimit, f.compress, nlogger, rConn)
+}
+
+// failExchange tells the server the client can't claim the user conn of
+// connId, servers before the exchange fails skip it and let it expire.
+func (f *Proxyer) failExchange(ctrl net.Conn, connId string, reason error, nlogger *logger.Logger) {
+	if err := proto.Send(ctrl, proto.NewMsgExchangeFail(connId, reason.Error())); err != nil {
+		nlogger.Warnf("Error sending exchange fail msg to remote: %v", err)
+	}
+}
+
+// rangeLocalAddr maps the remote port a user conn of a port range came in on
+// to the local port at the same offset.
+func (f *Proxyer) rangeLocalAddr(port int) (string, error) {
+	if f.remoteEnd == 0 || port < f.remotePort || port > f.remoteEnd {
+		return "", fmt.Errorf("port %d is not in the remote port range", port)
+	}
+	host, _, err := net.SplitHostPort(f.localAddr)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(f.localPort+port-f.remotePort)), nil
 }
 
-func (f *Proxyer) mustNewProxy(rConn net.Conn) {
-	if err := proto.Send(rConn, proto.NewMsgProxy(f.proxyName, f.subdomain,
-		f.proxyType, f.remotePort)); err != nil {
-		f.logger.Fatalf("Error send proxy msg to remote: %v", err)
+func (f *Proxyer) newProxy(rConn net.Conn) error {
+	rateLimit := 0
+	if f.speedLimit != "" {
+		rateLimit = pio.LimitTransfer(f.speedLimit)
+	}
+
+	req := proto.NewMsgProxy(f.proxyName, f.subdomain, f.proxyType, f.bindHost, f.remotePort, rateLimit, f.compress)
+	req.AllowIPs, req.DenyIPs = f.allowIPs, f.denyIPs
+	req.MaxConns, req.Overflow = f.maxConns, f.overflow
+	req.ConnRate, req.ConnBurst = f.connRate, f.connBurst
+	req.ProxyProtocol = f.proxyProto
+	req.RequestHeaders, req.ResponseHeaders = f.reqHeaders, f.respHeaders
+	req.Weight = f.weight
+	req.TTL = int((f.ttl + time.Second - 1) / time.Second)
+	if !f.expires.IsZero() {
+		// a re-registration lives until the first one would have expired
+		left := time.Until(f.expires)
+		if left <= 0 {
+			return errExpired
+		}
+		req.TTL = int((left + time.Second - 1) / time.Second)
+	}
+	req.Hostname = f.hostname
+	req.TerminateTLS = f.terminate
+	req.RemotePortEnd = f.remoteEnd
+	req.Network = f.network
+	if err := proto.Send(rConn, req); err != nil {
+		return fmt.Errorf("error send proxy msg to remote: %v", err)
 	}
 
 	pxyResp := &proto.MsgProxyResp{}
 	if err := proto.Recv(rConn, pxyResp); err != nil {
-		f.logger.Fatal("Error reading proxy resp msg from remote, please check your config")
+		return fmt.Errorf("error reading proxy resp msg from remote, please check your config: %w", err)
+	}
+
+	if err := pxyResp.Err(); err != nil {
+		return fmt.Errorf("proxy create failed, remote port: %d: %w", f.remotePort, err)
 	}
 
-	if pxyResp.Status != "success" {
-		f.logger.Fatalf("Proxy create failed, status: %s, remote port: %d", pxyResp.Status, f.remotePort)
+	if f.compress && !pxyResp.Compress {
+		f.logger.Warn("Server does not support compression, proxying uncompressed")
+	}
+	f.compress = pxyResp.Compress
+
+	if f.proxyProto != "" && pxyResp.ProxyProtocol != f.proxyProto {
+		f.logger.Warnf("Server does not support proxy protocol %s, local service sees the tunnel addr", f.proxyProto)
+	}
+	if (len(f.reqHeaders) > 0 || len(f.respHeaders) > 0) && !pxyResp.Headers {
+		f.logger.Warn("Server does not support header rules, proxying the headers as is")
+	}
+	if f.terminate && !pxyResp.TerminateTLS {
+		f.logger.Warn("Server does not terminate tls, local service gets the tls of the users")
+	}
+
+	if pxyResp.RemotePort != 0 && pxyResp.RemotePort != f.remotePort {
+		f.logger.Infof("Server assigned remote port: %d", pxyResp.RemotePort)
+		// cancel reads it on shutdown
+		f.mu.Lock()
+		f.remotePort = pxyResp.RemotePort
+		f.mu.Unlock()
+	}
+
+	if pxyResp.TTL > 0 {
+		ttl := time.Duration(pxyResp.TTL) * time.Second
+		if f.expires.IsZero() {
+			f.expires = time.Now().Add(ttl)
+		}
+		f.logger.Infof("Proxy expires in %s", ttl)
 	}
 
 	if pxyResp.Domain != "" {
@@ -195,6 +606,7 @@ func (f *Proxyer) mustNewProxy(rConn net.Conn) {
 	} else {
 		f.logger.Info("Proxy create success!")
 	}
+	return nil
 }
 
 func (c *Client) printMetaInfo() {
@@ -204,6 +616,10 @@ func (c *Client) printMetaInfo() {
 	fmt.Printf("Server Address: %s\n", c.cfg.SvrAddr)
 	fmt.Printf("Token Authentication: %v\n", c.cfg.Token != "")
 	fmt.Printf("Multiplex: %v\n", c.cfg.Multiplex)
+	fmt.Printf("TLS: %v\n", c.cfg.TLS.Enable)
+	if c.cfg.HealthCheck {
+		fmt.Printf("Health Check: every %s\n", c.cfg.HealthCheckInterval)
+	}
 	fmt.Println("Proxies:")
 	for _, proxy := range c.cfg.Proxys {
 		name := proxy.ProxyName
@@ -211,11 +627,53 @@ func (c *Client) printMetaInfo() {
 			name = "<empty>"
 		}
 		fmt.Printf("  - Name: %s\n", name)
-		fmt.Printf("    Local Port: %d\n", proxy.LocalPort)
-		fmt.Printf("    Remote Port: %d\n", proxy.RemotePort)
+		fmt.Printf("    Local Addr: %s\n", proxy.LocalAddr)
+		if proxy.RemotePortEnd != 0 {
+			fmt.Printf("    Remote Port: %d-%d\n", proxy.RemotePort, proxy.RemotePortEnd)
+		} else {
+			fmt.Printf("    Remote Port: %d\n", proxy.RemotePort)
+		}
 		fmt.Printf("    Type: %s\n", proxy.ProxyType)
 		fmt.Printf("    Subdomain: %s\n", getValueOrEmpty(proxy.Subdomain))
+		if proxy.Hostname != "" {
+			fmt.Printf("    Hostname: %s\n", proxy.Hostname)
+		}
+		if proxy.TerminateTLS {
+			fmt.Printf("    Terminate TLS: %v\n", proxy.TerminateTLS)
+		}
 		fmt.Printf("    Speed Limit: %s\n", getValueOrEmpty(proxy.SpeedLimit))
+		fmt.Printf("    Bind Host: %s\n", getValueOrEmpty(proxy.BindHost))
+		if proxy.Network != "" {
+			fmt.Printf("    Network: %s\n", proxy.Network)
+		}
+		fmt.Printf("    Compress: %v\n", proxy.Compress)
+		if len(proxy.AllowIPs) > 0 {
+			fmt.Printf("    Allow IPs: %s\n", strings.Join(proxy.AllowIPs, ", "))
+		}
+		if len(proxy.DenyIPs) > 0 {
+			fmt.Printf("    Deny IPs: %s\n", strings.Join(proxy.DenyIPs, ", "))
+		}
+		if proxy.ProxyProtocol != "" {
+			fmt.Printf("    Proxy Protocol: %s\n", proxy.ProxyProtocol)
+		}
+		if len(proxy.RequestHeaders) > 0 {
+			fmt.Printf("    Request Headers: %s\n", strings.Join(proxy.RequestHeaders, ", "))
+		}
+		if len(proxy.ResponseHeaders) > 0 {
+			fmt.Printf("    Response Headers: %s\n", strings.Join(proxy.ResponseHeaders, ", "))
+		}
+		if proxy.MaxConns > 0 {
+			fmt.Printf("    Max Conns: %d, overflow: %s\n", proxy.MaxConns, proxy.Overflow)
+		}
+		if proxy.ConnRate > 0 {
+			fmt.Printf("    Conn Rate: %d/s, burst: %d\n", proxy.ConnRate, proxy.ConnBurst)
+		}
+		if proxy.Weight > 0 {
+			fmt.Printf("    Weight: %d\n", proxy.Weight)
+		}
+		if proxy.TTL > 0 {
+			fmt.Printf("    TTL: %s\n", proxy.TTL)
+		}
 	}
 	fmt.Println("---")
 }
@@ -0,0 +1,204 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/abcdlsj/gnar/internal/logger"
+	"github.com/abcdlsj/gnar/internal/proxy"
+)
+
+// SOCKS5 serves a socks5 (RFC 1928) CONNECT request read from the tunnel,
+// so every user conn can reach its own target from the client side. Only the
+// no authentication method is supported, restrict the remote port with ip
+// rules or bind host.
+type SOCKS5 struct {
+	dialer Dialer
+	rconn  io.ReadWriteCloser
+	logger *logger.Logger
+}
+
+const (
+	socks5Version = 0x05
+
+	socks5NoAuth       = 0x00
+	socks5NoAcceptable = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5Succeeded          = 0x00
+	socks5GeneralFailure     = 0x01
+	socks5NetworkUnreachable = 0x03
+	socks5HostUnreachable    = 0x04
+	socks5ConnectionRefused  = 0x05
+	socks5CmdNotSupported    = 0x07
+	socks5AtypNotSupported   = 0x08
+
+	socks5DialTimeout = 10 * time.Second
+)
+
+func NewSOCKS5(d Dialer, rconn io.ReadWriteCloser, tlogger *logger.Logger) *SOCKS5 {
+	return &SOCKS5{
+		dialer: d,
+		rconn:  rconn,
+		logger: tlogger,
+	}
+}
+
+func (s *SOCKS5) Run() {
+	target, err := s.handshake()
+	if err != nil {
+		s.logger.Errorf("Error reading socks5 request: %v", err)
+		s.rconn.Close()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), socks5DialTimeout)
+	lConn, err := s.dialer.DialContext(ctx, "tcp", target)
+	cancel()
+	if err != nil {
+		s.logger.Errorf("Error connecting to socks5 target: %v, addr: %s", err, target)
+		s.reply(dialErrorReply(err), nil)
+		s.rconn.Close()
+		return
+	}
+
+	if err := s.reply(socks5Succeeded, lConn.LocalAddr()); err != nil {
+		s.logger.Errorf("Error sending socks5 reply: %v", err)
+		lConn.Close()
+		s.rconn.Close()
+		return
+	}
+
+	s.logger.Debugf("Socks5 connected to %s", target)
+	if _, err := proxy.Stream(s.rconn, lConn); err != nil {
+		s.logger.Warnf("Error proxying to socks5 target: %v, addr: %s", err, target)
+	}
+}
+
+// handshake negotiates the method and returns the host:port of the CONNECT request.
+func (s *SOCKS5) handshake() (string, error) {
+	// fits the longest field, 255 methods or a 255 bytes domain with their lengths
+	buf := make([]byte, 2+255)
+
+	// VER NMETHODS METHODS...
+	if _, err := io.ReadFull(s.rconn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != socks5Version {
+		return "", fmt.Errorf("unsupported socks version: %d", buf[0])
+	}
+	methods := buf[2 : 2+int(buf[1])]
+	if _, err := io.ReadFull(s.rconn, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socks5NoAcceptable)
+	for _, m := range methods {
+		if m == socks5NoAuth {
+			method = socks5NoAuth
+		}
+	}
+	if _, err := s.rconn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5NoAcceptable {
+		return "", errors.New("no acceptable socks5 auth method")
+	}
+
+	// VER CMD RSV ATYP
+	if _, err := io.ReadFull(s.rconn, buf[:4]); err != nil {
+		return "", err
+	}
+	if buf[0] != socks5Version {
+		return "", fmt.Errorf("unsupported socks version: %d", buf[0])
+	}
+	cmd, atyp := buf[1], buf[3]
+
+	var host string
+	switch atyp {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(s.rconn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		if _, err := io.ReadFull(s.rconn, buf[:1]); err != nil {
+			return "", err
+		}
+		domain := buf[1 : 1+int(buf[0])]
+		if _, err := io.ReadFull(s.rconn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		s.reply(socks5AtypNotSupported, nil)
+		return "", fmt.Errorf("unsupported socks5 address type: %d", atyp)
+	}
+
+	if _, err := io.ReadFull(s.rconn, buf[:2]); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+
+	if cmd != socks5CmdConnect {
+		s.reply(socks5CmdNotSupported, nil)
+		return "", fmt.Errorf("unsupported socks5 command: %d", cmd)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// reply sends the reply of the request, bind is the local addr of the target conn.
+func (s *SOCKS5) reply(rep byte, bind net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if addr, ok := bind.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+
+	atyp := byte(socks5AtypIPv4)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		atyp = socks5AtypIPv6
+	}
+
+	buf := append([]byte{socks5Version, rep, 0x00, atyp}, ip...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(port))
+	_, err := s.rconn.Write(buf)
+	return err
+}
+
+func dialErrorReply(err error) byte {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5NetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socks5HostUnreachable
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return socks5HostUnreachable
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socks5HostUnreachable
+	}
+	return socks5GeneralFailure
+}
@@ -1,34 +1,50 @@
 package tunnel
 
 import (
-	"fmt"
+	"context"
 	"io"
-	"net"
+	"strings"
 
 	"github.com/abcdlsj/gnar/internal/logger"
 	"github.com/abcdlsj/gnar/internal/proxy"
 )
 
+// LocalNetwork splits a local addr into the network and address to dial, a
+// "unix:" prefixed addr is the path of a unix socket, others are tcp host:port.
+func LocalNetwork(laddr string) (string, string) {
+	if path, ok := strings.CutPrefix(laddr, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", laddr
+}
+
 type TCP struct {
-	lport  int
+	dialer Dialer
+	laddr  string
 	rconn  io.ReadWriteCloser
 	logger *logger.Logger
 }
 
-func NewTCP(lport int, rconn io.ReadWriteCloser, tlogger *logger.Logger) *TCP {
+func NewTCP(d Dialer, laddr string, rconn io.ReadWriteCloser, tlogger *logger.Logger) *TCP {
 	return &TCP{
-		lport:  lport,
+		dialer: d,
+		laddr:  laddr,
 		rconn:  rconn,
 		logger: tlogger,
 	}
 }
 
 func (t *TCP) Run() {
-	lConn, err := net.Dial("tcp", fmt.Sprintf(":%d", t.lport))
+	network, addr := LocalNetwork(t.laddr)
+	lConn, err := t.dialer.DialContext(context.Background(), network, addr)
 	if err != nil {
-		t.logger.Errorf("Error connecting to local: %v, port: %d", err, t.lport)
+		t.logger.Errorf("Error connecting to local: %v, addr: %s", err, t.laddr)
+		// the server closes the user conn with it
+		t.rconn.Close()
 		return
 	}
 
-	proxy.Stream(t.rconn, lConn)
+	if _, err := proxy.Stream(t.rconn, lConn); err != nil {
+		t.logger.Warnf("Error proxying to local: %v, addr: %s", err, t.laddr)
+	}
 }
@@ -1,6 +1,7 @@
 package tunnel
 
 import (
+	"context"
 	"io"
 	"net"
 
@@ -8,8 +9,17 @@ import (
 	"github.com/abcdlsj/gnar/internal/pio"
 )
 
-func RunTunnel(lport int, proxyType, speedLimit string, tlogger *logger.Logger, rconn net.Conn) {
+// Dialer opens the conns to the local targets, a *net.Dialer or e.g. one
+// resolving with another dns server or a fake in tests.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func RunTunnel(d Dialer, laddr string, proxyType, speedLimit string, compress bool, tlogger *logger.Logger, rconn net.Conn) {
 	var rwc io.ReadWriteCloser = rconn
+	if compress {
+		rwc = pio.NewCompressReadWriter(rwc)
+	}
 	if speedLimit != "" {
 		limit := pio.LimitTransfer(speedLimit)
 		tlogger.Debugf("Proxying with limit: %s, transfered limit: %d", speedLimit, limit)
@@ -18,9 +28,11 @@ func RunTunnel(lport int, proxyType, speedLimit string, tlogger *logger.Logger,
 
 	switch proxyType {
 	case "udp":
-		go NewUDP(lport, rwc, tlogger).Run()
-	case "tcp":
-		go NewTCP(lport, rwc, tlogger).Run()
+		go NewUDP(d, laddr, rwc, tlogger).Run()
+	case "tcp", "http", "tls":
+		go NewTCP(d, laddr, rwc, tlogger).Run()
+	case "socks5":
+		go NewSOCKS5(d, rwc, tlogger).Run()
 	default:
 		tlogger.Errorf("Unknown proxy type: %s", proxyType)
 	}
@@ -1,6 +1,7 @@
 package tunnel
 
 import (
+	"context"
 	"io"
 	"net"
 
@@ -9,31 +10,32 @@ import (
 )
 
 type UDP struct {
-	lport  int
+	dialer Dialer
+	laddr  string
 	rconn  io.ReadWriteCloser
 	logger *logger.Logger
 }
 
-func NewUDP(lport int, rconn io.ReadWriteCloser, tlogger *logger.Logger) *UDP {
+func NewUDP(d Dialer, laddr string, rconn io.ReadWriteCloser, tlogger *logger.Logger) *UDP {
 	return &UDP{
-		lport:  lport,
+		dialer: d,
+		laddr:  laddr,
 		rconn:  rconn,
 		logger: tlogger,
 	}
 }
 
 func (u *UDP) Run() {
-	lConn, err := net.DialUDP("udp", nil, &net.UDPAddr{
-		IP:   net.ParseIP("0.0.0.0"),
-		Port: u.lport,
-	})
-
-	if err != nil {
-		u.logger.Errorf("Error connecting to local: %v, port: %d", err, u.lport)
-		return
+	dial := func() (net.Conn, error) {
+		lConn, err := u.dialer.DialContext(context.Background(), "udp", u.laddr)
+		if err != nil {
+			u.logger.Errorf("Error connecting to local: %v, addr: %s", err, u.laddr)
+			return nil, err
+		}
+		return lConn, nil
 	}
 
-	if err := proxy.UDPClientDatagram(u.rconn, lConn); err != nil {
+	if err := proxy.UDPClientDatagram(u.rconn, dial, u.logger); err != nil {
 		u.logger.Errorf("Error proxying udp: %v", err)
 		return
 	}
@@ -0,0 +1,36 @@
+package logger
+
+import "time"
+
+// Record is one log line, as passed to a Handler.
+type Record struct {
+	Time    time.Time
+	Level   Level
+	Prefixs []string
+	Fields  []any // key-value pairs
+	Msg     string
+}
+
+// Handler writes the log lines of a Logger, plug one in with NewWithHandler
+// to send the lines to another logging library or capture them in tests.
+// FATAL lines are always handled, the process exits after them.
+type Handler interface {
+	Enabled(level Level) bool
+	Handle(r Record)
+}
+
+// stdHandler writes to the shared outputs, in the level and format set by
+// SetLevel and SetFormat.
+type stdHandler struct{}
+
+func (stdHandler) Enabled(level Level) bool {
+	return level >= gLevel
+}
+
+func (stdHandler) Handle(r Record) {
+	if gFormat == JSON {
+		jsonOutput.Print(jsonLine(r.Time, r.Prefixs, r.Fields, r.Level, r.Msg))
+	} else {
+		textOutput.Print(header(r.Prefixs, r.Level) + r.Msg + textFields(r.Fields))
+	}
+}
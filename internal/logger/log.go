@@ -1,10 +1,13 @@
 package logger
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/abcdlsj/cr"
 )
@@ -36,6 +39,23 @@ func (l Level) String() string {
 	return cr.PLBlack("???")
 }
 
+func (l Level) name() string {
+	switch l {
+	case DEBUG:
+		return "debug"
+	case INFO:
+		return "info"
+	case WARN:
+		return "warn"
+	case ERROR:
+		return "error"
+	case FATAL:
+		return "fatal"
+	}
+
+	return "unknown"
+}
+
 func fromLevel(s string) Level {
 	s = strings.ToLower(s)
 	switch s {
@@ -54,15 +74,45 @@ func fromLevel(s string) Level {
 	}
 }
 
+type Format int
+
+const (
+	TEXT Format = iota
+	JSON
+)
+
+func fromFormat(s string) Format {
+	if strings.ToLower(s) == "json" {
+		return JSON
+	}
+	return TEXT
+}
+
+// all loggers share the outputs, log.Logger serializes the writes so lines
+// from different goroutines never interleave.
+var (
+	textOutput = log.New(os.Stderr, "", log.LstdFlags)
+	jsonOutput = log.New(os.Stderr, "", 0)
+)
+
 type Logger struct {
 	prefixs []string
-	logger  *log.Logger
+	fields  []any   // key-value pairs
+	handler Handler // nil writes to the shared outputs
 }
 
 func New(prefixs ...string) *Logger {
 	return &Logger{
 		prefixs: prefixs,
-		logger:  log.New(os.Stderr, "", log.LstdFlags),
+	}
+}
+
+// NewWithHandler returns a logger whose lines, and the ones of the loggers
+// derived from it, are written by h instead of the shared outputs.
+func NewWithHandler(h Handler, prefixs ...string) *Logger {
+	return &Logger{
+		prefixs: prefixs,
+		handler: h,
 	}
 }
 
@@ -72,27 +122,59 @@ func (l *Logger) Add(prefix string) {
 
 func (l *Logger) CloneAdd(prefix string) *Logger {
 	return &Logger{
-		prefixs: append(l.prefixs, prefix),
-		logger:  log.New(os.Stderr, "", log.LstdFlags),
+		prefixs: append(append([]string{}, l.prefixs...), prefix),
+		fields:  l.fields,
+		handler: l.handler,
 	}
 }
 
+// With returns a copy of the logger that attaches the key-value pairs to every line.
+func (l *Logger) With(kv ...any) *Logger {
+	return &Logger{
+		prefixs: l.prefixs,
+		fields:  append(append([]any{}, l.fields...), kv...),
+		handler: l.handler,
+	}
+}
+
+// WithConnId returns a copy of the logger bound to a user conn id, so every
+// line of one proxied connection can be found by the id.
+func (l *Logger) WithConnId(id string) *Logger {
+	return l.With("conn_id", id)
+}
+
+func WithConnId(id string) *Logger {
+	return defatLogger.WithConnId(id)
+}
+
 var defatLogger *Logger
 
 func init() {
 	if val := os.Getenv("LOG_LEVEL"); val != "" {
 		SetLevel(fromLevel(val))
 	}
+	if val := os.Getenv("LOG_FORMAT"); val != "" {
+		SetFormat(val)
+	}
 
 	defatLogger = New()
 }
 
-var gLevel = INFO
+var (
+	gLevel  = INFO
+	gFormat = TEXT
+)
 
 func SetLevel(level Level) {
 	gLevel = level
 }
 
+// SetFormat switches the output format, "json" writes one json object per line,
+// anything else is the human-readable text.
+func SetFormat(format string) {
+	gFormat = fromFormat(format)
+}
+
 func header(prefixs []string, level Level) string {
 	rainbow := []func(string) string{
 		cr.PLGreen,
@@ -117,62 +199,119 @@ func header(prefixs []string, level Level) string {
 	return fmt.Sprintf("%s %s", level, apply(prefixs...))
 }
 
-func buildF(logger *log.Logger, prefixs []string, level Level, format string, v ...any) {
-	if level == FATAL {
-		logger.Fatalf(header(prefixs, level)+format, v...)
+func textFields(fields []any) string {
+	var sb strings.Builder
+	for i := 0; i < len(fields); i += 2 {
+		sb.WriteString(fmt.Sprintf(" %v=%v", fields[i], fieldValue(fields, i+1)))
+	}
+	return sb.String()
+}
+
+func jsonLine(t time.Time, prefixs []string, fields []any, level Level, msg string) string {
+	var buf bytes.Buffer
+	write := func(key string, value any) {
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		buf.WriteByte(',')
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+
+	buf.WriteString(`{"time":"` + t.Format(time.RFC3339) + `"`)
+	write("level", level.name())
+	if len(prefixs) != 0 {
+		write("prefix", strings.Join(prefixs, " "))
 	}
-	if gLevel <= level {
-		logger.Printf(header(prefixs, level)+format, v...)
+	write("msg", msg)
+	for i := 0; i < len(fields); i += 2 {
+		write(fmt.Sprint(fields[i]), fieldValue(fields, i+1))
 	}
+	buf.WriteByte('}')
+
+	return buf.String()
 }
 
-func build(logger *log.Logger, prefixs []string, level Level, v ...any) {
-	if level == FATAL {
-		logger.Fatalf(header(prefixs, level) + fmt.Sprintln(v...))
+func fieldValue(fields []any, i int) any {
+	if i >= len(fields) {
+		return nil
+	}
+	if err, ok := fields[i].(error); ok {
+		return err.Error()
+	}
+	return fields[i]
+}
+
+func (l *Logger) output(level Level, msg string) {
+	h := l.handler
+	if h == nil {
+		h = stdHandler{}
+	}
+
+	if level == FATAL || h.Enabled(level) {
+		h.Handle(Record{
+			Time:    time.Now(),
+			Level:   level,
+			Prefixs: l.prefixs,
+			Fields:  l.fields,
+			Msg:     msg,
+		})
 	}
-	if gLevel <= level {
-		logger.Print(header(prefixs, level) + fmt.Sprintln(v...))
+
+	if level == FATAL {
+		os.Exit(1)
 	}
 }
 
+func buildF(l *Logger, level Level, format string, v ...any) {
+	l.output(level, fmt.Sprintf(format, v...))
+}
+
+func build(l *Logger, level Level, v ...any) {
+	l.output(level, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
 func (l *Logger) Debugf(format string, v ...any) {
-	buildF(l.logger, l.prefixs, DEBUG, format, v...)
+	buildF(l, DEBUG, format, v...)
 }
 
 func (l *Logger) Infof(format string, v ...any) {
-	buildF(l.logger, l.prefixs, INFO, format, v...)
+	buildF(l, INFO, format, v...)
 }
 
 func (l *Logger) Warnf(format string, v ...any) {
-	buildF(l.logger, l.prefixs, WARN, format, v...)
+	buildF(l, WARN, format, v...)
 }
 
 func (l *Logger) Errorf(format string, v ...any) {
-	buildF(l.logger, l.prefixs, ERROR, format, v...)
+	buildF(l, ERROR, format, v...)
 }
 
 func (l *Logger) Fatalf(format string, v ...any) {
-	buildF(l.logger, l.prefixs, FATAL, format, v...)
+	buildF(l, FATAL, format, v...)
 }
 
 func (l *Logger) Debug(v ...any) {
-	build(l.logger, l.prefixs, DEBUG, v...)
+	build(l, DEBUG, v...)
 }
 
 func (l *Logger) Info(v ...any) {
-	build(l.logger, l.prefixs, INFO, v...)
+	build(l, INFO, v...)
 }
 
 func (l *Logger) Warn(v ...any) {
-	build(l.logger, l.prefixs, WARN, v...)
+	build(l, WARN, v...)
 }
 
 func (l *Logger) Error(v ...any) {
-	build(l.logger, l.prefixs, ERROR, v...)
+	build(l, ERROR, v...)
 }
 
 func (l *Logger) Fatal(v ...any) {
-	build(l.logger, l.prefixs, FATAL, v...)
+	build(l, FATAL, v...)
 }
 
 func Debugf(format string, v ...any) {
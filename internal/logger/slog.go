@@ -0,0 +1,52 @@
+//go:build go1.21
+
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// LevelFatal is the slog level of FATAL lines.
+const LevelFatal = slog.LevelError + 4
+
+// SlogHandler writes the log lines to a slog.Handler, the prefixs go to the
+// "prefix" attr and the fields become attrs.
+type SlogHandler struct {
+	h slog.Handler
+}
+
+func NewSlogHandler(h slog.Handler) *SlogHandler {
+	return &SlogHandler{h: h}
+}
+
+func (s *SlogHandler) Enabled(level Level) bool {
+	return s.h.Enabled(context.Background(), slogLevel(level))
+}
+
+func (s *SlogHandler) Handle(r Record) {
+	rec := slog.NewRecord(r.Time, slogLevel(r.Level), r.Msg, 0)
+	if len(r.Prefixs) != 0 {
+		rec.AddAttrs(slog.String("prefix", strings.Join(r.Prefixs, " ")))
+	}
+	for i := 0; i < len(r.Fields); i += 2 {
+		rec.AddAttrs(slog.Any(fmt.Sprint(r.Fields[i]), fieldValue(r.Fields, i+1)))
+	}
+	s.h.Handle(context.Background(), rec)
+}
+
+func slogLevel(level Level) slog.Level {
+	switch level {
+	case DEBUG:
+		return slog.LevelDebug
+	case WARN:
+		return slog.LevelWarn
+	case ERROR:
+		return slog.LevelError
+	case FATAL:
+		return LevelFatal
+	}
+	return slog.LevelInfo
+}
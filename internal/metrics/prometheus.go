@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Reasons of the failed logins and proxy registrations.
+const (
+	FailAuth        = "auth"         // invalid token
+	FailVersion     = "version"      // protocol version not supported
+	FailInvalidPort = "invalid_port" // remote port out of the allowed range
+	FailBind        = "bind"         // remote port in use or not bindable
+	FailRead        = "read"         // control conn read error
+)
+
+var failReasons = []string{FailAuth, FailVersion, FailInvalidPort, FailBind, FailRead}
+
+// Prometheus holds the server collectors, they are registered to an own
+// registry so that multiple servers do not collide in one process.
+type Prometheus struct {
+	registry *prometheus.Registry
+
+	ProxiedBytes      *prometheus.CounterVec
+	StreamErrors      *prometheus.CounterVec
+	ActiveConns       prometheus.Gauge
+	ProxyRegistered   prometheus.Counter
+	ProxyCanceled     prometheus.Counter
+	ControlConnErrors prometheus.Counter
+	Failures          *prometheus.CounterVec
+
+	// the failures again, for the json api
+	failures map[string]*atomic.Int64
+}
+
+func NewPrometheus() *Prometheus {
+	p := &Prometheus{
+		registry: prometheus.NewRegistry(),
+		ProxiedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gnar_proxied_bytes_total",
+			Help: "Total bytes proxied, labeled by proxy port and direction.",
+		}, []string{"port", "direction"}),
+		StreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gnar_stream_errors_total",
+			Help: "Total user connections that ended with an error, labeled by proxy port.",
+		}, []string{"port"}),
+		ActiveConns: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gnar_active_connections",
+			Help: "Number of user connections being proxied.",
+		}),
+		ProxyRegistered: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gnar_proxies_registered_total",
+			Help: "Total proxies registered by clients.",
+		}),
+		ProxyCanceled: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gnar_proxies_canceled_total",
+			Help: "Total proxies canceled.",
+		}),
+		ControlConnErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gnar_control_conn_errors_total",
+			Help: "Total errors on client control connections.",
+		}),
+		Failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gnar_registration_failures_total",
+			Help: "Total failed logins and proxy registrations, labeled by reason.",
+		}, []string{"reason"}),
+		failures: make(map[string]*atomic.Int64),
+	}
+	for _, reason := range failReasons {
+		// export the zeros, alerts need the series before the first failure
+		p.Failures.WithLabelValues(reason)
+		p.failures[reason] = &atomic.Int64{}
+	}
+
+	p.registry.MustRegister(
+		// go_goroutines and process_open_fds among others, for finding leaks
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		p.ProxiedBytes,
+		p.StreamErrors,
+		p.ActiveConns,
+		p.ProxyRegistered,
+		p.ProxyCanceled,
+		p.ControlConnErrors,
+		p.Failures,
+	)
+
+	return p
+}
+
+func (p *Prometheus) AddTraffic(t Traffic) {
+	port := strconv.Itoa(t.Port)
+	p.ProxiedBytes.WithLabelValues(port, "up").Add(float64(t.UpwardBytes))
+	p.ProxiedBytes.WithLabelValues(port, "down").Add(float64(t.DownwardBytes))
+	if t.Failed {
+		p.StreamErrors.WithLabelValues(port).Inc()
+	}
+}
+
+// Fail counts a failure of reason, one of the Fail constants.
+func (p *Prometheus) Fail(reason string) {
+	p.Failures.WithLabelValues(reason).Inc()
+	p.failures[reason].Add(1)
+}
+
+// FailureCounts returns the failures so far by reason.
+func (p *Prometheus) FailureCounts() map[string]int64 {
+	counts := make(map[string]int64, len(p.failures))
+	for reason, n := range p.failures {
+		counts[reason] = n.Load()
+	}
+	return counts
+}
+
+func (p *Prometheus) Handler() http.Handler {
+	return promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Merge sums summaries of the same port.
+func Merge(summaries ...[]TrafficSummary) []TrafficSummary {
+	idx := make(map[int]int)
+	ret := []TrafficSummary{}
+	for _, ss := range summaries {
+		for _, s := range ss {
+			i, ok := idx[s.Port]
+			if !ok {
+				i = len(ret)
+				idx[s.Port] = i
+				ret = append(ret, TrafficSummary{Port: s.Port})
+			}
+			ret[i].UpwardBytes += s.UpwardBytes
+			ret[i].DownwardBytes += s.DownwardBytes
+			ret[i].Conns += s.Conns
+			ret[i].Seconds += s.Seconds
+			ret[i].Errors += s.Errors
+		}
+	}
+	return ret
+}
+
+// LoadSummaries reads the summaries saved by SaveSummaries, a missing file is
+// not an error.
+func LoadSummaries(path string) ([]TrafficSummary, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var summaries []TrafficSummary
+	if err := json.Unmarshal(buf, &summaries); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", path, err)
+	}
+	return summaries, nil
+}
+
+// SaveSummaries writes to a temp file and renames it, a crash never leaves a
+// half written file behind.
+func SaveSummaries(path string, summaries []TrafficSummary) error {
+	buf, err := json.MarshalIndent(summaries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
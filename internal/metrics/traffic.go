@@ -1,10 +1,63 @@
 package metrics
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
+// Traffic of one proxied connection, upward is user -> client and downward is
+// client -> user.
 type Traffic struct {
-	upwardBytes, downwardBytes int64
-	st, et                     int64
+	Port          int       `json:"port"`
+	UpwardBytes   int64     `json:"upward_bytes"`
+	DownwardBytes int64     `json:"downward_bytes"`
+	StartTime     time.Time `json:"start_time"`
+	EndTime       time.Time `json:"end_time"`
+	Failed        bool      `json:"failed,omitempty"` // the copy ended with an error, e.g. a reset, not an EOF
+}
+
+func NewTraffic(upwardBytes, downwardBytes int64, st, et time.Time) Traffic {
+	return Traffic{
+		UpwardBytes:   upwardBytes,
+		DownwardBytes: downwardBytes,
+		StartTime:     st,
+		EndTime:       et,
+	}
+}
+
+func (t Traffic) Duration() time.Duration {
+	return t.EndTime.Sub(t.StartTime)
+}
+
+// TrafficSummary is the traffic of all connections of one proxy port.
+type TrafficSummary struct {
+	Port          int     `json:"port"`
+	UpwardBytes   int64   `json:"upward_bytes"`
+	DownwardBytes int64   `json:"downward_bytes"`
+	Conns         int     `json:"conns"`
+	Seconds       float64 `json:"seconds"` // sum of connection durations
+	Errors        int     `json:"errors"`  // connections that failed
+}
+
+func Summarize(traffics []Traffic) []TrafficSummary {
+	idx := make(map[int]int)
+	ret := []TrafficSummary{}
+	for _, t := range traffics {
+		i, ok := idx[t.Port]
+		if !ok {
+			i = len(ret)
+			idx[t.Port] = i
+			ret = append(ret, TrafficSummary{Port: t.Port})
+		}
+		ret[i].UpwardBytes += t.UpwardBytes
+		ret[i].DownwardBytes += t.DownwardBytes
+		ret[i].Conns++
+		ret[i].Seconds += t.Duration().Seconds()
+		if t.Failed {
+			ret[i].Errors++
+		}
+	}
+	return ret
 }
 
 func CalculateBandwidth(traffics []Traffic) (string, string, string) {
@@ -12,20 +65,20 @@ func CalculateBandwidth(traffics []Traffic) (string, string, string) {
 	dnBytes := int64(0)
 	sumElapsedNano := int64(0)
 	for _, t := range traffics {
-		upBytes += t.upwardBytes
-		dnBytes += t.downwardBytes
-		sumElapsedNano += t.et - t.st
+		upBytes += t.UpwardBytes
+		dnBytes += t.DownwardBytes
+		sumElapsedNano += t.Duration().Nanoseconds()
 	}
 
 	avgElapsedTime := float64(sumElapsedNano) / float64(len(traffics)) // nanosecond
 	upbw := float64(upBytes) / avgElapsedTime * 1e9
 	dnbw := float64(dnBytes) / avgElapsedTime * 1e9
 
-	return humanBytes(upbw) + "/s", humanBytes(dnbw) + "/s",
-		humanBytes(float64(upBytes) + float64(dnBytes))
+	return HumanBytes(upbw) + "/s", HumanBytes(dnbw) + "/s",
+		HumanBytes(float64(upBytes) + float64(dnBytes))
 }
 
-func humanBytes(b float64) string {
+func HumanBytes(b float64) string {
 	units := []string{"B", "KB", "MB", "GB", "TB", "PB"}
 	i := 0
 	for b > 1024 {
@@ -0,0 +1,144 @@
+package pio
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	compressChunk = 16 * 1024
+
+	frameRaw   byte = 0
+	frameFlate byte = 1
+)
+
+// CompressReadWriter sends every write as flate compressed frames, a frame is
+// 1 byte type + 2 bytes length + payload. Chunks that do not shrink are sent
+// raw, incompressible payloads only cost the frame header.
+type CompressReadWriter struct {
+	rw io.ReadWriteCloser
+
+	fw   *flate.Writer
+	wbuf bytes.Buffer
+
+	fr    io.ReadCloser
+	hdr   [3]byte
+	frame []byte
+	dbuf  bytes.Buffer
+	rbuf  []byte // decoded bytes not read yet
+}
+
+func NewCompressReadWriter(rw io.ReadWriteCloser) *CompressReadWriter {
+	fw, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return &CompressReadWriter{
+		rw: rw,
+		fw: fw,
+	}
+}
+
+func (c *CompressReadWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := len(p)
+		if n > compressChunk {
+			n = compressChunk
+		}
+		if err := c.writeFrame(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *CompressReadWriter) writeFrame(p []byte) error {
+	c.wbuf.Reset()
+	c.wbuf.Write([]byte{frameFlate, 0, 0})
+	c.fw.Reset(&c.wbuf)
+	if _, err := c.fw.Write(p); err != nil {
+		return err
+	}
+	if err := c.fw.Close(); err != nil {
+		return err
+	}
+
+	if c.wbuf.Len()-len(c.hdr) >= len(p) {
+		c.wbuf.Reset()
+		c.wbuf.Write([]byte{frameRaw, 0, 0})
+		c.wbuf.Write(p)
+	}
+
+	frame := c.wbuf.Bytes()
+	binary.BigEndian.PutUint16(frame[1:3], uint16(len(frame)-len(c.hdr)))
+	_, err := c.rw.Write(frame)
+	return err
+}
+
+func (c *CompressReadWriter) Read(p []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *CompressReadWriter) readFrame() error {
+	if _, err := io.ReadFull(c.rw, c.hdr[:]); err != nil {
+		return err
+	}
+
+	size := int(binary.BigEndian.Uint16(c.hdr[1:]))
+	if cap(c.frame) < size {
+		c.frame = make([]byte, size)
+	}
+	c.frame = c.frame[:size]
+	if _, err := io.ReadFull(c.rw, c.frame); err != nil {
+		return err
+	}
+
+	switch c.hdr[0] {
+	case frameRaw:
+		c.rbuf = c.frame
+	case frameFlate:
+		if c.fr == nil {
+			c.fr = flate.NewReader(bytes.NewReader(c.frame))
+		} else if err := c.fr.(flate.Resetter).Reset(bytes.NewReader(c.frame), nil); err != nil {
+			return err
+		}
+
+		c.dbuf.Reset()
+		// a frame never holds more than one chunk, refuse anything bigger
+		if _, err := c.dbuf.ReadFrom(io.LimitReader(c.fr, compressChunk+1)); err != nil {
+			return fmt.Errorf("error decompressing frame: %v", err)
+		}
+		if c.dbuf.Len() > compressChunk {
+			return fmt.Errorf("compressed frame too large")
+		}
+		c.rbuf = c.dbuf.Bytes()
+	default:
+		return fmt.Errorf("invalid compress frame type: %d", c.hdr[0])
+	}
+
+	return nil
+}
+
+func (c *CompressReadWriter) Close() error {
+	return c.rw.Close()
+}
+
+// SetReadDeadline passes the deadline to the underlying conn if it supports one.
+func (c *CompressReadWriter) SetReadDeadline(t time.Time) error {
+	if d, ok := c.rw.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return fmt.Errorf("read deadline not supported")
+}
@@ -0,0 +1,45 @@
+package pio
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+)
+
+type bufConn struct {
+	bytes.Buffer
+}
+
+func (b *bufConn) Close() error {
+	return nil
+}
+
+func TestCompress(t *testing.T) {
+	text := []byte(strings.Repeat("Genshin Start! ", 4096))
+	random := make([]byte, 40*1024)
+	rand.Read(random)
+
+	for _, data := range [][]byte{text, random} {
+		conn := &bufConn{}
+		c := NewCompressReadWriter(conn)
+		if _, err := c.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("Raw len: %d, compressed len: %d", len(data), conn.Len())
+
+		// incompressible data should only cost the frame headers
+		if conn.Len() > len(data)+len(data)/compressChunk*3+3 {
+			t.Fatalf("compressed len %d larger than expected", conn.Len())
+		}
+
+		got, err := io.ReadAll(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("decompressed data not match, len: %d != %d", len(got), len(data))
+		}
+	}
+}
@@ -2,8 +2,10 @@ package pio
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"strconv"
+	"time"
 
 	"golang.org/x/time/rate"
 )
@@ -135,6 +137,14 @@ func (s *LimitReadWriter) Close() error {
 	return s.rw.Close()
 }
 
+// SetReadDeadline passes the deadline to the underlying conn if it supports one.
+func (s *LimitReadWriter) SetReadDeadline(t time.Time) error {
+	if d, ok := s.rw.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return fmt.Errorf("read deadline not supported")
+}
+
 func (r *LimitReader) Read(p []byte) (int, error) {
 	if r.limiter == nil {
 		return r.r.Read(p)
@@ -1,12 +1,32 @@
 package proxy
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBufSize is the copy buffer size of the streams, one buffer per direction.
+const DefaultBufSize = 32 * 1024
 
 type Buf struct {
 	buf []byte
 }
 
-var bufPool = newBufPool(512) // TODO: benchmark this?
+var bufPool atomic.Pointer[sync.Pool]
+
+func init() {
+	bufPool.Store(newBufPool(DefaultBufSize))
+}
+
+// SetBufSize changes the copy buffer size of the streams started after it,
+// the running ones keep their buffers. Servers embedded in one process
+// share the size.
+func SetBufSize(size int) {
+	if size <= 0 {
+		return
+	}
+	bufPool.Store(newBufPool(size))
+}
 
 func newBufPool(size int) *sync.Pool {
 	return &sync.Pool{
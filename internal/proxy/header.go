@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HeaderRule sets a header to Value, or removes it.
+type HeaderRule struct {
+	Name   string
+	Value  string // {remote_ip} and {host} are replaced by the ones of the request
+	Remove bool
+}
+
+// ParseHeaderRules parses rules of the form "Name: value" to set a header
+// and "-Name" to remove it. The headers framing the message can't be changed.
+func ParseHeaderRules(rules []string) ([]HeaderRule, error) {
+	parsed := make([]HeaderRule, 0, len(rules))
+	for _, rule := range rules {
+		var r HeaderRule
+		if name, ok := strings.CutPrefix(rule, "-"); ok {
+			r = HeaderRule{Name: name, Remove: true}
+		} else {
+			name, value, ok := strings.Cut(rule, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid header rule: %q, expected \"Name: value\" or \"-Name\"", rule)
+			}
+			r = HeaderRule{Name: name, Value: strings.TrimSpace(value)}
+		}
+
+		if !validHeaderName(r.Name) {
+			return nil, fmt.Errorf("invalid header name in rule: %q", rule)
+		}
+		if strings.ContainsAny(r.Value, "\r\n") {
+			return nil, fmt.Errorf("invalid header value in rule: %q", rule)
+		}
+		switch http.CanonicalHeaderKey(r.Name) {
+		case "Content-Length", "Transfer-Encoding", "Connection", "Upgrade":
+			return nil, fmt.Errorf("header %s can not be changed", r.Name)
+		}
+		r.Name = http.CanonicalHeaderKey(r.Name)
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			continue
+		}
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func applyHeaderRules(h http.Header, rules []HeaderRule, vars *strings.Replacer) {
+	for _, r := range rules {
+		if r.Remove {
+			h.Del(r.Name)
+			continue
+		}
+		h.Set(r.Name, vars.Replace(r.Value))
+	}
+}
+
+// headerMsg is a request sent to the target, for reading its response.
+type headerMsg struct {
+	method  string
+	host    string
+	upgrade bool
+}
+
+// HeaderConn applies header rules to the http/1 requests read from a user
+// conn and the responses written to it. A conn switching protocols, e.g. to
+// websocket, is passed as is after the upgrade request.
+type HeaderConn struct {
+	conn     io.ReadWriteCloser
+	reqRules []HeaderRule
+	remoteIP string
+
+	// the rewritten requests, read with the read deadline
+	reqs     chan []byte
+	pending  []byte
+	reqErr   error
+	deadline time.Time
+	mu       sync.Mutex
+
+	// the responses of the target, rewritten to conn
+	respW *io.PipeWriter
+	msgs  chan headerMsg
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewHeaderConn rewrites the http traffic of conn, a user conn from remoteIP,
+// with the request and response rules.
+func NewHeaderConn(conn io.ReadWriteCloser, reqRules, respRules []HeaderRule, remoteIP string) *HeaderConn {
+	respR, respW := io.Pipe()
+	c := &HeaderConn{
+		conn:     conn,
+		reqRules: reqRules,
+		remoteIP: remoteIP,
+		reqs:     make(chan []byte),
+		respW:    respW,
+		msgs:     make(chan headerMsg, 64),
+		closed:   make(chan struct{}),
+	}
+	go c.readRequests()
+	go c.writeResponses(respR, respRules)
+	return c
+}
+
+func (c *HeaderConn) readRequests() {
+	defer close(c.msgs)
+	w := chanWriter{c: c}
+	br := bufio.NewReader(c.conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			c.reqErr = err
+			close(c.reqs)
+			return
+		}
+
+		vars := strings.NewReplacer("{remote_ip}", c.remoteIP, "{host}", req.Host)
+		applyHeaderRules(req.Header, c.reqRules, vars)
+		if host := req.Header.Get("Host"); host != "" {
+			req.Host = host
+			req.Header.Del("Host")
+		}
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// an empty one keeps Write from adding its default
+			req.Header["User-Agent"] = []string{""}
+		}
+		upgrade := req.Header.Get("Upgrade") != ""
+
+		select {
+		case c.msgs <- headerMsg{method: req.Method, host: req.Host, upgrade: upgrade}:
+		case <-c.closed:
+			c.reqErr = io.ErrClosedPipe
+			close(c.reqs)
+			return
+		}
+		err = req.Write(w)
+		if err == nil && upgrade {
+			_, err = io.Copy(w, br)
+		}
+		if err != nil || upgrade {
+			if err == nil {
+				err = io.EOF
+			}
+			c.reqErr = err
+			close(c.reqs)
+			return
+		}
+	}
+}
+
+func (c *HeaderConn) writeResponses(respR *io.PipeReader, rules []HeaderRule) {
+	br := bufio.NewReader(respR)
+	err := func() error {
+		for {
+			msg, ok := <-c.msgs
+			if !ok {
+				_, err := io.Copy(c.conn, br)
+				return err
+			}
+
+			for {
+				resp, err := http.ReadResponse(br, &http.Request{Method: msg.method})
+				if err != nil {
+					return err
+				}
+				applyHeaderRules(resp.Header, rules, strings.NewReplacer("{remote_ip}", c.remoteIP, "{host}", msg.host))
+				if err := resp.Write(c.conn); err != nil {
+					return err
+				}
+				if msg.upgrade {
+					_, err := io.Copy(c.conn, br)
+					return err
+				}
+				if resp.Close {
+					return c.conn.Close()
+				}
+				// 100 continue and the like come before the response
+				if resp.StatusCode >= 200 {
+					break
+				}
+			}
+		}
+	}()
+	if err == nil {
+		err = io.EOF
+	}
+	respR.CloseWithError(err)
+}
+
+// chanWriter hands the rewritten requests to Read.
+type chanWriter struct {
+	c *HeaderConn
+}
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	select {
+	case w.c.reqs <- append([]byte(nil), p...):
+		return len(p), nil
+	case <-w.c.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+// Read reads the rewritten requests.
+func (c *HeaderConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	if len(c.pending) == 0 {
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case b, ok := <-c.reqs:
+			if !ok {
+				return 0, c.reqErr
+			}
+			c.pending = b
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write writes the responses of the target, they reach the user conn once
+// rewritten.
+func (c *HeaderConn) Write(p []byte) (int, error) {
+	return c.respW.Write(p)
+}
+
+// SetReadDeadline bounds the Reads, the requests keep being read meanwhile.
+func (c *HeaderConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *HeaderConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.respW.CloseWithError(errors.New("header conn closed"))
+	})
+	return c.conn.Close()
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseHeaderRules(t *testing.T) {
+	rules, err := ParseHeaderRules([]string{"x-forwarded-for: {remote_ip}", "-Server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []HeaderRule{{Name: "X-Forwarded-For", Value: "{remote_ip}"}, {Name: "Server", Remove: true}}
+	if len(rules) != len(want) || rules[0] != want[0] || rules[1] != want[1] {
+		t.Fatalf("got %+v, want %+v", rules, want)
+	}
+
+	for _, rule := range []string{"X-Token", "X Token: a", "-", "Content-Length: 1", "-transfer-encoding"} {
+		if _, err := ParseHeaderRules([]string{rule}); err == nil {
+			t.Errorf("rule %q: expected error", rule)
+		}
+	}
+}
+
+func TestHeaderConn(t *testing.T) {
+	reqRules, _ := ParseHeaderRules([]string{"X-Forwarded-For: {remote_ip}", "X-Forwarded-Host: {host}", "-Cookie"})
+	respRules, _ := ParseHeaderRules([]string{"-Server", "X-Frame-Options: DENY"})
+
+	user, conn := net.Pipe()
+	defer user.Close()
+	hc := NewHeaderConn(conn, reqRules, respRules, "203.0.113.7")
+	defer hc.Close()
+
+	// the target answers two requests of one keep-alive conn
+	targetErr := make(chan error, 1)
+	go func() {
+		br := bufio.NewReader(hc)
+		for i := 0; i < 2; i++ {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				targetErr <- err
+				return
+			}
+			body, _ := io.ReadAll(req.Body)
+			if req.Header.Get("X-Forwarded-For") != "203.0.113.7" || req.Header.Get("X-Forwarded-Host") != "app.example.com" ||
+				req.Header.Get("Cookie") != "" || req.Header.Get("User-Agent") != "curl" {
+				t.Errorf("request %d headers: %v", i, req.Header)
+			}
+			io.WriteString(hc, "HTTP/1.1 200 OK\r\nServer: nginx\r\nContent-Length: "+
+				strconv.Itoa(len(body))+"\r\n\r\n"+string(body))
+		}
+		targetErr <- nil
+	}()
+
+	br := bufio.NewReader(user)
+	for _, body := range []string{"a", "bc"} {
+		io.WriteString(user, "POST / HTTP/1.1\r\nHost: app.example.com\r\nUser-Agent: curl\r\nCookie: secret\r\n"+
+			"X-Forwarded-For: 10.0.0.1\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		if string(got) != body {
+			t.Fatalf("got body %q, want %q", got, body)
+		}
+		if resp.Header.Get("Server") != "" || resp.Header.Get("X-Frame-Options") != "DENY" {
+			t.Fatalf("response headers: %v", resp.Header)
+		}
+	}
+	if err := <-targetErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHeaderConnUpgrade(t *testing.T) {
+	user, conn := net.Pipe()
+	defer user.Close()
+	hc := NewHeaderConn(conn, nil, nil, "203.0.113.7")
+	defer hc.Close()
+
+	go func() {
+		br := bufio.NewReader(hc)
+		if _, err := http.ReadRequest(br); err != nil {
+			return
+		}
+		io.WriteString(hc, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		// echo the upgraded stream
+		line, _ := br.ReadString('\n')
+		io.WriteString(hc, strings.ToUpper(line))
+	}()
+
+	io.WriteString(user, "GET /ws HTTP/1.1\r\nHost: app\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	br := bufio.NewReader(user)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	io.WriteString(user, "hello\n")
+	if line, _ := br.ReadString('\n'); line != "HELLO\n" {
+		t.Fatalf("got %q after upgrade", line)
+	}
+}
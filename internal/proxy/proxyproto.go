@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyHeader returns the PROXY protocol header of a conn from src to dst, so
+// the target behind the tunnel still sees the real client address. Non tcp
+// addrs or mixed ip families are sent as unknown, the target then uses the
+// addrs of its own conn.
+func ProxyHeader(version string, src, dst net.Addr) ([]byte, error) {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	known := sok && dok && (s.IP.To4() == nil) == (d.IP.To4() == nil)
+
+	switch version {
+	case ProxyProtocolV1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		family := "TCP4"
+		if s.IP.To4() == nil {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, s.IP, d.IP, s.Port, d.Port)), nil
+	case ProxyProtocolV2:
+		buf := append([]byte{}, proxyV2Signature...)
+		if !known {
+			// LOCAL command, no addresses
+			return append(buf, 0x20, 0x00, 0x00, 0x00), nil
+		}
+
+		var addrs []byte
+		family := byte(0x11) // TCP over IPv4
+		if sip, dip := s.IP.To4(), d.IP.To4(); sip != nil {
+			addrs = append(append(addrs, sip...), dip...)
+		} else {
+			family = 0x21 // TCP over IPv6
+			addrs = append(append(addrs, s.IP.To16()...), d.IP.To16()...)
+		}
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(s.Port))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(d.Port))
+
+		buf = append(buf, 0x21, family) // version 2, PROXY command
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(addrs)))
+		return append(buf, addrs...), nil
+	default:
+		return nil, fmt.Errorf("invalid proxy protocol version: %s, expected v1 or v2", version)
+	}
+}
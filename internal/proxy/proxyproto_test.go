@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyHeaderV1(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9001}
+
+	header, err := ProxyHeader(ProxyProtocolV1, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "PROXY TCP4 203.0.113.7 10.0.0.1 51234 9001\r\n"; string(header) != want {
+		t.Fatalf("got %q, want %q", header, want)
+	}
+
+	header, _ = ProxyHeader(ProxyProtocolV1, src, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 9001})
+	if want := "PROXY UNKNOWN\r\n"; string(header) != want {
+		t.Fatalf("mixed families: got %q, want %q", header, want)
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9001}
+
+	header, err := ProxyHeader(ProxyProtocolV2, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x11, 0x00, 0x0c,
+		203, 0, 113, 7, 10, 0, 0, 1, 0xc8, 0x22, 0x23, 0x29)
+	if !bytes.Equal(header, want) {
+		t.Fatalf("got %x, want %x", header, want)
+	}
+
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2}
+	header, _ = ProxyHeader(ProxyProtocolV2, src6, dst6)
+	if len(header) != 16+36 || header[13] != 0x21 {
+		t.Fatalf("ipv6 header: %x", header)
+	}
+}
+
+func TestProxyHeaderInvalid(t *testing.T) {
+	if _, err := ProxyHeader("v3", nil, nil); err == nil {
+		t.Fatal("expected error for invalid version")
+	}
+}
@@ -1,33 +1,147 @@
 package proxy
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abcdlsj/gnar/internal/logger"
+	"github.com/abcdlsj/gnar/internal/metrics"
 )
 
-func Stream(s1, s2 io.ReadWriteCloser) {
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// Stream copies data between s1 and s2 until one side is done, then closes both.
+// The returned traffic counts s2 -> s1 as upward and s1 -> s2 as downward bytes.
+// The error is the first one of the copies that is no clean end: an EOF, the
+// close of the other direction or the idle timeout return nil, a reset or a
+// failed write don't.
+func Stream(s1, s2 io.ReadWriteCloser) (metrics.Traffic, error) {
+	return StreamIdle(s1, s2, 0, logger.New())
+}
+
+// StreamIdle is Stream that also closes both sides when neither of them moves
+// data for the idle timeout, 0 disables the timeout.
+func StreamIdle(s1, s2 io.ReadWriteCloser, idle time.Duration, slogger *logger.Logger) (metrics.Traffic, error) {
+	return StreamContext(context.Background(), s1, s2, idle, slogger)
+}
+
+// StreamContext is StreamIdle that also closes both sides when ctx is done,
+// the returned traffic counts the bytes copied until then.
+func StreamContext(ctx context.Context, s1, s2 io.ReadWriteCloser, idle time.Duration, slogger *logger.Logger) (metrics.Traffic, error) {
+	d1, _ := s1.(readDeadliner)
+	d2, _ := s2.(readDeadliner)
+	if d1 == nil || d2 == nil {
+		idle = 0
+	}
+
 	s1 = rwcWrap(s1)
 	s2 = rwcWrap(s2)
 
-	defer s1.Close()
-	defer s2.Close()
+	st := time.Now()
+
+	var lastActive atomic.Int64
+	lastActive.Store(st.UnixNano())
+
+	copyIdle := func(src io.Reader, srcd readDeadliner, dst io.Writer, buf []byte) (int64, error) {
+		var written int64
+		for {
+			srcd.SetReadDeadline(time.Now().Add(idle))
+			n, err := src.Read(buf)
+			if n > 0 {
+				lastActive.Store(time.Now().UnixNano())
+				w, werr := dst.Write(buf[:n])
+				written += int64(w)
+				if werr != nil {
+					return written, werr
+				}
+			}
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					// the other direction may still be busy
+					if time.Since(time.Unix(0, lastActive.Load())) < idle {
+						continue
+					}
+					slogger.Debugf("Stream idle for %s, closing", idle)
+					return written, nil
+				}
+				if err == io.EOF {
+					err = nil
+				}
+				return written, err
+			}
+		}
+	}
+
+	copy := func(src io.Reader, srcd readDeadliner, dst io.Writer) (int64, error) {
+		pool := bufPool.Load()
+		buf := pool.Get().(*Buf)
+		defer pool.Put(buf)
 
-	copy := func(src io.Reader, dst io.Writer) {
-		buf := bufPool.Get().(*Buf)
-		defer bufPool.Put(buf)
+		if idle > 0 {
+			return copyIdle(src, srcd, dst, buf.buf)
+		}
 
+		var written int64
 		for {
 			n, err := io.CopyBuffer(dst, src, buf.buf)
-			if err == io.EOF || n == 0 {
-				break
+			written += n
+			if err != nil || n == 0 {
+				return written, err
 			}
 		}
 	}
 
+	var (
+		wg             sync.WaitGroup
+		up, down       int64
+		upErr, downErr error
+		upDone         = make(chan struct{})
+		closing        atomic.Bool // the errors after it come from the close below
+	)
+	wg.Add(2)
 	go func() {
-		copy(s1, s2)
+		defer wg.Done()
+		var err error
+		if down, err = copy(s1, d1, s2); !closing.Load() {
+			downErr = err
+		}
 	}()
+	go func() {
+		defer wg.Done()
+		defer close(upDone)
+		var err error
+		if up, err = copy(s2, d2, s1); !closing.Load() {
+			upErr = err
+		}
+	}()
+
+	select {
+	case <-upDone:
+	case <-ctx.Done():
+		slogger.Debugf("Stream canceled: %v", ctx.Err())
+	}
+
+	// closing unblocks the copies, they return what is written so far
+	closing.Store(true)
+	s1.Close()
+	s2.Close()
+	wg.Wait()
 
-	copy(s2, s1)
+	traffic := metrics.NewTraffic(up, down, st, time.Now())
+	switch {
+	case upErr != nil:
+		return traffic, fmt.Errorf("upward copy: %w", upErr)
+	case downErr != nil:
+		return traffic, fmt.Errorf("downward copy: %w", downErr)
+	}
+	return traffic, nil
 }
 
 // rwcWrap Remove io.ReaderFrom and io.WriterTo from io.ReadWriteCloser (https://github.com/golang/go/issues/16474)
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// memConn reads from r and discards the writes.
+type memConn struct {
+	r io.Reader
+}
+
+func (c *memConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *memConn) Write(p []byte) (int, error) { return len(p), nil }
+func (c *memConn) Close() error                { return nil }
+
+func benchmarkStream(b *testing.B, size int) {
+	SetBufSize(size)
+	defer SetBufSize(DefaultBufSize)
+
+	data := make([]byte, 1<<20)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Stream(&memConn{r: bytes.NewReader(data)}, &memConn{r: bytes.NewReader(nil)})
+	}
+}
+
+func BenchmarkStream512B(b *testing.B) { benchmarkStream(b, 512) }
+func BenchmarkStream32KB(b *testing.B) { benchmarkStream(b, 32*1024) }
+
+func TestStreamBufPool(t *testing.T) {
+	data := make([]byte, 64*1024)
+	stream := func() {
+		traffic, err := Stream(&memConn{r: bytes.NewReader(data)}, &memConn{r: bytes.NewReader(nil)})
+		if err != nil {
+			t.Fatalf("stream ended with an error: %v", err)
+		}
+		if traffic.DownwardBytes != int64(len(data)) {
+			t.Fatalf("downward bytes: got %d, want %d", traffic.DownwardBytes, len(data))
+		}
+	}
+	stream()
+
+	// the buffers of both directions come from the pool, far less than their size is allocated
+	res := testing.Benchmark(func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			stream()
+		}
+	})
+	if per := res.AllocedBytesPerOp(); per >= DefaultBufSize {
+		t.Fatalf("stream allocated %d bytes per op, buffers are not reused", per)
+	}
+}
+
+// failConn returns err once its reader is done.
+type failConn struct {
+	memConn
+	err error
+}
+
+func (c *failConn) Read(p []byte) (int, error) {
+	n, err := c.memConn.Read(p)
+	if err == io.EOF {
+		err = c.err
+	}
+	return n, err
+}
+
+func TestStreamError(t *testing.T) {
+	// the user side is reset while the other side still waits for data
+	user := &failConn{memConn: memConn{r: bytes.NewReader([]byte("req"))}, err: syscall.ECONNRESET}
+	target, client := net.Pipe()
+	go io.Copy(io.Discard, client)
+	traffic, err := Stream(target, user)
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("got error %v, want a reset", err)
+	}
+	if traffic.UpwardBytes != 3 {
+		t.Fatalf("upward bytes: got %d, want 3", traffic.UpwardBytes)
+	}
+}
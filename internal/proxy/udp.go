@@ -4,74 +4,200 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/abcdlsj/gnar/internal/logger"
 	"github.com/abcdlsj/gnar/pkg/proto"
 )
 
-func UDPClientDatagram(tcp, udp io.ReadWriteCloser) error {
-	go func() {
-		for {
-			msg := proto.MsgUDPDatagram{}
-			if err := proto.Recv(tcp, &msg); err != nil {
-				logger.Warnf("Msg udp datagram recv failed: %v", err)
-				return
+const (
+	// MaxDatagramSize is the largest udp payload that still fits a proto packet
+	// once it is json (base64) encoded, bigger datagrams are dropped.
+	MaxDatagramSize = 45 * 1024
+	UDPIdleTimeout  = 60 * time.Second
+
+	udpReadBufSize = 64 * 1024
+)
+
+type udpSessions struct {
+	seen map[string]time.Time
+	mu   sync.Mutex
+}
+
+func newUDPSessions() *udpSessions {
+	return &udpSessions{
+		seen: make(map[string]time.Time),
+	}
+}
+
+func (s *udpSessions) touch(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seen[addr] = time.Now()
+}
+
+func (s *udpSessions) alive(addr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.seen[addr]
+	return ok && time.Since(t) < UDPIdleTimeout
+}
+
+func (s *udpSessions) expire(done <-chan struct{}, plogger *logger.Logger) {
+	ticker := time.NewTicker(UDPIdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			for addr, t := range s.seen {
+				if time.Since(t) >= UDPIdleTimeout {
+					plogger.Debugf("UDP session %s idle timeout", addr)
+					delete(s.seen, addr)
+				}
 			}
-			logger.Debugf("Msg udp datagram recv [%s]", strings.TrimSpace(string(msg.Payload)))
-			n, err := udp.Write(msg.Payload)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// UDPClientDatagram relays datagrams between the tunnel and local udp service,
+// every remote address gets its own local conn so that responses can be routed back.
+func UDPClientDatagram(tcp io.ReadWriteCloser, dial func() (net.Conn, error), plogger *logger.Logger) error {
+	var (
+		wmu      sync.Mutex
+		smu      sync.Mutex
+		sessions = make(map[string]net.Conn)
+	)
+
+	defer func() {
+		smu.Lock()
+		defer smu.Unlock()
+		for _, conn := range sessions {
+			conn.Close()
+		}
+	}()
+
+	relay := func(key string, addr *net.UDPAddr, lConn net.Conn) {
+		defer func() {
+			smu.Lock()
+			delete(sessions, key)
+			smu.Unlock()
+			lConn.Close()
+		}()
+
+		buf := make([]byte, udpReadBufSize)
+		for {
+			lConn.SetReadDeadline(time.Now().Add(UDPIdleTimeout))
+			n, err := lConn.Read(buf)
 			if err != nil {
-				logger.Warnf("UDP write failed: %v", err)
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					plogger.Debugf("UDP session %s idle timeout", key)
+				} else {
+					plogger.Warnf("UDP read failed: %v", err)
+				}
 				return
 			}
+			if n > MaxDatagramSize {
+				plogger.Warnf("UDP datagram too large, dropped: %d > %d", n, MaxDatagramSize)
+				continue
+			}
+			plogger.Debugf("UDP read %d bytes, [%s]", n, strings.TrimSpace(string(buf[:n])))
 
-			if n != len(msg.Payload) {
-				logger.Warnf("UDP write failed: %d != %d", n, len(msg.Payload))
+			wmu.Lock()
+			err = proto.Send(tcp, proto.NewMsgUDPDatagram(addr, buf[:n]))
+			wmu.Unlock()
+			if err != nil {
+				plogger.Warnf("Msg udp datagram send failed: %v", err)
 				return
 			}
 		}
-	}()
+	}
 
 	for {
-		buf := make([]byte, 4096)
-		n, err := udp.Read(buf)
-		if err != nil {
-			logger.Warnf("UDP read failed: %v", err)
+		msg := proto.MsgUDPDatagram{}
+		if err := proto.Recv(tcp, &msg); err != nil {
+			plogger.Warnf("Msg udp datagram recv failed: %v", err)
 			return err
 		}
-		logger.Debugf("UDP read %d bytes from %v, [%s]", n, strings.TrimSpace(string(buf[:n])))
-		if err = proto.Send(tcp, proto.NewMsgUDPDatagram(nil, buf[:n])); err != nil {
-			logger.Warnf("Msg udp datagram send failed: %v", err)
-			return err
+		plogger.Debugf("Msg udp datagram recv [%s]", strings.TrimSpace(string(msg.Payload)))
+
+		key := ""
+		if msg.Addr != nil {
+			key = msg.Addr.String()
+		}
+
+		smu.Lock()
+		lConn, ok := sessions[key]
+		if !ok {
+			var err error
+			if lConn, err = dial(); err != nil {
+				smu.Unlock()
+				plogger.Warnf("UDP dial local failed: %v", err)
+				return err
+			}
+			sessions[key] = lConn
+			go relay(key, msg.Addr, lConn)
+		}
+		smu.Unlock()
+
+		n, err := lConn.Write(msg.Payload)
+		if err != nil {
+			plogger.Warnf("UDP write failed: %v", err)
+			continue
+		}
+
+		if n != len(msg.Payload) {
+			plogger.Warnf("UDP write failed: %d != %d", n, len(msg.Payload))
 		}
 	}
 }
 
-func UDPDatagram(tcp io.ReadWriteCloser, udp *net.UDPConn) error {
+func UDPDatagram(tcp io.ReadWriteCloser, udp *net.UDPConn, plogger *logger.Logger) error {
+	sessions := newUDPSessions()
+	done := make(chan struct{})
+	defer close(done)
+	go sessions.expire(done, plogger)
+
+	go func() {
+		for {
+			msg := proto.MsgUDPDatagram{}
+			if err := proto.Recv(tcp, &msg); err != nil {
+				plogger.Warnf("Msg udp datagram recv failed: %v", err)
+				udp.Close()
+				return
+			}
+			if msg.Addr == nil || !sessions.alive(msg.Addr.String()) {
+				plogger.Debugf("Msg udp datagram for unknown or expired session, dropped")
+				continue
+			}
+			plogger.Debugf("Msg udp datagram recv [%s]", strings.TrimSpace(string(msg.Payload)))
+			if _, err := udp.WriteToUDP(msg.Payload, msg.Addr); err != nil {
+				plogger.Warnf("UDP write failed: %v", err)
+			}
+		}
+	}()
+
+	buf := make([]byte, udpReadBufSize)
 	for {
-		buf := make([]byte, 4096)
 		n, addr, err := udp.ReadFromUDP(buf)
 		if err != nil {
-			logger.Warnf("UDP read failed: %v", err)
+			plogger.Warnf("UDP read failed: %v", err)
 			return err
 		}
-		logger.Debugf("UDP read %d bytes from %v, [%s]", n, addr, strings.TrimSpace(string(buf[:n])))
+		if n > MaxDatagramSize {
+			plogger.Warnf("UDP datagram from %v too large, dropped: %d > %d", addr, n, MaxDatagramSize)
+			continue
+		}
+		plogger.Debugf("UDP read %d bytes from %v, [%s]", n, addr, strings.TrimSpace(string(buf[:n])))
+		sessions.touch(addr.String())
 		if err = proto.Send(tcp, proto.NewMsgUDPDatagram(addr, buf[:n])); err != nil {
-			logger.Warnf("Msg udp datagram send failed: %v", err)
+			plogger.Warnf("Msg udp datagram send failed: %v", err)
 			return err
 		}
-
-		go func() {
-			msg := proto.MsgUDPDatagram{}
-			if err := proto.Recv(tcp, &msg); err != nil {
-				logger.Warnf("Msg udp datagram recv failed: %v", err)
-				return
-			}
-			logger.Debugf("Msg udp datagram recv [%s]", strings.TrimSpace(string(msg.Payload)))
-			_, err := udp.WriteTo(msg.Payload, addr)
-			if err != nil {
-				logger.Warnf("UDP write failed: %v", err)
-				return
-			}
-		}()
 	}
 }
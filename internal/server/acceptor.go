@@ -0,0 +1,68 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// Acceptor yields the control conns of a transport, they are served like
+// the ones of the server port. Close makes a blocked Accept return
+// net.ErrClosed. Every net.Listener is one, the server port is a tcp
+// listener.
+type Acceptor interface {
+	Accept() (net.Conn, error)
+	Close() error
+}
+
+// WithAcceptor serves the control conns of a next to the server port, e.g.
+// of a custom transport or a fake one in tests. Like the ones of
+// WithListener the conns get the tls of the server. The server closes a on
+// shutdown.
+func WithAcceptor(a Acceptor) Option {
+	return func(s *Server) {
+		s.ownAcceptors = append(s.ownAcceptors, a)
+	}
+}
+
+// startAcceptors serves the acceptors of WithAcceptor.
+func (s *Server) startAcceptors() error {
+	for i, a := range s.ownAcceptors {
+		if s.tlsCfg != nil {
+			a = &tlsAcceptor{Acceptor: a, cfg: s.tlsCfg}
+		}
+		s.serveAcceptor(a, nil, fmt.Sprintf("acceptor #%d", i))
+	}
+	return nil
+}
+
+// serveAcceptor accepts control conns from a until it is closed, they log in
+// with the token and port range of lc. name is the one of the logs.
+func (s *Server) serveAcceptor(a Acceptor, lc *ListenerConfig, name string) {
+	s.mu.Lock()
+	s.acceptors = append(s.acceptors, a)
+	s.mu.Unlock()
+
+	go func() {
+		err := s.acceptLoop(a, func(conn net.Conn) {
+			s.handleConnection(conn, lc)
+		})
+		if err != nil && !s.isClosing() {
+			s.log.Errorf("Error accepting on %s: %v", name, err)
+		}
+	}()
+}
+
+// tlsAcceptor is tls.NewListener for an acceptor without an addr.
+type tlsAcceptor struct {
+	Acceptor
+	cfg *tls.Config
+}
+
+func (a *tlsAcceptor) Accept() (net.Conn, error) {
+	conn, err := a.Acceptor.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(conn, a.cfg), nil
+}
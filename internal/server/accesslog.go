@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/abcdlsj/gnar/internal/metrics"
+)
+
+// accessEntry is one line of the access log, written when a user conn closes.
+type accessEntry struct {
+	Time          time.Time `json:"time"`
+	ConnId        string    `json:"conn_id"`
+	Proxy         string    `json:"proxy,omitempty"`
+	Type          string    `json:"type"`
+	Port          int       `json:"port"`
+	Domain        string    `json:"domain,omitempty"`
+	RemoteAddr    string    `json:"remote_addr"`
+	UpwardBytes   int64     `json:"upward_bytes"`
+	DownwardBytes int64     `json:"downward_bytes"`
+	DurationMs    int64     `json:"duration_ms"`
+}
+
+// accessLog writes one json object per user conn to the access-log file,
+// apart from the logs of the server. A nil accessLog writes nothing.
+type accessLog struct {
+	path string
+	f    *os.File
+	mu   sync.Mutex
+}
+
+func openAccessLog(path string) (*accessLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	l := &accessLog{path: path}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reopen starts a new file at the path, e.g. after logrotate moved the old one.
+func (l *accessLog) reopen() error {
+	if l == nil {
+		return nil
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("error opening access log: %v", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f = f
+	return nil
+}
+
+func (l *accessLog) write(e accessEntry) error {
+	if l == nil {
+		return nil
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.f.Write(append(line, '\n'))
+	return err
+}
+
+func (l *accessLog) close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.f.Close()
+}
+
+// logAccess records the closed user conn of port.
+func (s *Server) logAccess(connId, proxyType string, port int, remote string, traffic metrics.Traffic) {
+	if s.accessLog == nil {
+		return
+	}
+	e := accessEntry{
+		Time:          traffic.EndTime,
+		ConnId:        connId,
+		Type:          proxyType,
+		Port:          port,
+		RemoteAddr:    remote,
+		UpwardBytes:   traffic.UpwardBytes,
+		DownwardBytes: traffic.DownwardBytes,
+		DurationMs:    traffic.EndTime.Sub(traffic.StartTime).Milliseconds(),
+	}
+	if p, ok := s.resources.portProxy(port); ok {
+		e.Proxy, e.Domain = p.Name, p.Domain
+	}
+	if err := s.accessLog.write(e); err != nil {
+		s.log.Warnf("Error writing access log: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ipACL filters user conns by remote ip. With allow rules only matching ips are
+// accepted, deny rules reject matching ips and accept the rest.
+type ipACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newIPACL parses the cidr rules, a plain ip is a single host rule. It returns
+// nil when there is no rule.
+func newIPACL(allow, deny []string) (*ipACL, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	acl := &ipACL{}
+	var err error
+	if acl.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if acl.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func parseCIDRs(rules []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(rules))
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if !strings.Contains(rule, "/") {
+			ip := net.ParseIP(rule)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip rule: %q", rule)
+			}
+			if ip.To4() != nil {
+				rule += "/32"
+			} else {
+				rule += "/128"
+			}
+		}
+
+		_, ipnet, err := net.ParseCIDR(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip rule: %q", rule)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func (a *ipACL) allowed(addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,15 +1,22 @@
 package server
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
 	"embed"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
 	"strconv"
+	"strings"
 
-	"github.com/abcdlsj/gnar/internal/logger"
+	"github.com/abcdlsj/gnar/internal/metrics"
 )
 
 var (
@@ -17,18 +24,37 @@ var (
 	tmplFs embed.FS
 )
 
-func (s *Server) startAdmin() {
-	tmpl := template.Must(template.New("").ParseFS(tmplFs, "tmpl/*.html"))
+// startAdmin binds the admin port and socket and serves the admin handlers
+// on them, the error is of a port or socket that can't be bound.
+func (s *Server) startAdmin() error {
+	tmpl := template.Must(template.New("").Funcs(template.FuncMap{
+		"bytes": func(b int64) string {
+			return metrics.HumanBytes(float64(b))
+		},
+	}).ParseFS(tmplFs, "tmpl/*.html"))
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	// an own mux, net/http/pprof registers its handlers on the default one
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if err := tmpl.ExecuteTemplate(w, "index.html", map[string]any{
-			"proxys": s.resources.proxys, // 更改 s.rm 为 s.resources
+			"proxys": s.proxyStats(),
 		}); err != nil {
-			logger.Errorf("execute index.html error: %v", err)
+			s.log.Errorf("execute index.html error: %v", err)
 		}
 	})
 
-	http.HandleFunc("/admin/tunnel/close", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/admin/tunnel/close", func(w http.ResponseWriter, r *http.Request) {
+		// the same guard as /api/forwards/delete, it cancels proxys too
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/json" || !sameOrigin(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
 		type Req struct {
 			Port int `json:"port"`
 		}
@@ -51,14 +77,292 @@ func (s *Server) startAdmin() {
 			return
 		}
 
-		logger.Infof("Receive close admin call, close proxy, port %d", req.Port)
-		s.resources.removeProxy(req.Port)
+		s.log.Infof("Receive close admin call, close proxy, port %d", req.Port)
+		s.resources.cancelProxy(req.Port, "canceled by admin")
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(msg))
 	})
 
-	logger.Infof("Admin server start %d", s.cfg.AdminPort)
-	if err := http.ListenAndServe(":"+strconv.Itoa(s.cfg.AdminPort), nil); err != nil {
-		logger.Fatalf("Admin server error: %v", err)
+	mux.HandleFunc("/api/forwards", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.writeJSON(w, s.proxyStats())
+	})
+
+	mux.HandleFunc("/api/forwards/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		port, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/forwards/"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid port: %s", strings.TrimPrefix(r.URL.Path, "/api/forwards/")), http.StatusBadRequest)
+			return
+		}
+		detail, ok := s.proxyDetail(port)
+		if !ok {
+			http.Error(w, fmt.Sprintf("proxy not found: %d", port), http.StatusNotFound)
+			return
+		}
+		s.writeJSON(w, detail)
+	})
+
+	mux.HandleFunc("/api/forwards/delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		// html forms can not post json, and browsers send the origin on cross-site requests
+		if r.Header.Get("Content-Type") != "application/json" || !sameOrigin(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var req struct {
+			Port int `json:"port"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		s.log.Infof("Receive delete admin call, cancel proxy, port %d", req.Port)
+		if !s.resources.cancelProxy(req.Port, "canceled by admin") {
+			http.Error(w, fmt.Sprintf("proxy not found: %d", req.Port), http.StatusNotFound)
+			return
+		}
+		s.writeJSON(w, s.proxyStats())
+	})
+
+	mux.HandleFunc("/api/traffics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.writeJSON(w, s.resources.listTraffics())
+	})
+
+	mux.HandleFunc("/api/traffics/history", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.writeJSON(w, s.resources.traffics.history())
+	})
+
+	mux.HandleFunc("/api/failures", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.writeJSON(w, s.prom.FailureCounts())
+	})
+
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveEvents(w, r)
+	})
+
+	mux.Handle("/metrics", s.prom.Handler())
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		health := struct {
+			Listening bool  `json:"listening"`
+			Closing   bool  `json:"closing"`
+			Proxys    int64 `json:"proxys"`
+		}{
+			Listening: s.listening.Load(),
+			Closing:   s.isClosing(),
+			Proxys:    s.resources.nproxys.Load(),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !health.Listening || health.Closing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(health)
+	})
+
+	if s.cfg.EnableProfiling {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	if s.cfg.AdminSocket != "" {
+		if err := s.startAdminSocket(mux); err != nil {
+			return err
+		}
+	}
+	if s.cfg.AdminPort == 0 {
+		return nil
+	}
+
+	if !s.cfg.AdminAuth.Enabled() {
+		s.log.Warn("Admin server is unauthenticated, set admin-user and admin-password or admin-token to protect it")
+	}
+
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(s.cfg.AdminPort))
+	if err != nil {
+		return fmt.Errorf("error listening admin port: %v", err)
+	}
+	if s.cfg.AdminTLS {
+		listener = tls.NewListener(listener, s.edge.tls)
+	}
+	s.log.Infof("Admin server start %d", s.cfg.AdminPort)
+	go func() {
+		if err := s.serveAdmin(listener, adminAuth(s.cfg.AdminAuth, mux)); err != nil {
+			s.log.Errorf("Admin server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// serveAdmin serves handler on listener until Shutdown, the http server is
+// kept so Shutdown lets the requests in flight finish.
+func (s *Server) serveAdmin(listener net.Listener, handler http.Handler) error {
+	srv := &http.Server{Handler: handler}
+
+	s.mu.Lock()
+	if s.isClosing() {
+		s.mu.Unlock()
+		return listener.Close()
+	}
+	s.adminServers = append(s.adminServers, srv)
+	s.mu.Unlock()
+
+	if err := srv.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// startAdminSocket serves the admin handlers on the unix socket too, for
+// local tools. Only the user of the server can connect to it, so it asks for
+// no admin auth. Shutting down its http server removes the socket file.
+func (s *Server) startAdminSocket(handler http.Handler) error {
+	// a socket left by a killed server blocks the bind, one still served is kept
+	if info, err := os.Lstat(s.cfg.AdminSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", s.cfg.AdminSocket); err == nil {
+			conn.Close()
+			return fmt.Errorf("admin socket %s is in use by another server", s.cfg.AdminSocket)
+		}
+		os.Remove(s.cfg.AdminSocket)
+	}
+
+	listener, err := net.Listen("unix", s.cfg.AdminSocket)
+	if err != nil {
+		return fmt.Errorf("error listening admin socket: %v", err)
+	}
+	if err := os.Chmod(s.cfg.AdminSocket, 0o600); err != nil {
+		listener.Close()
+		return fmt.Errorf("error setting admin socket permissions: %v", err)
+	}
+
+	s.log.Infof("Admin server start on socket %s", s.cfg.AdminSocket)
+	go func() {
+		if err := s.serveAdmin(listener, handler); err != nil {
+			s.log.Errorf("Error serving admin socket: %v", err)
+		}
+	}()
+	return nil
+}
+
+type proxyStat struct {
+	Proxy
+	UpwardBytes   int64 `json:"upward_bytes"`
+	DownwardBytes int64 `json:"downward_bytes"`
+	Conns         int   `json:"conns"`
+	Errors        int   `json:"errors"`  // user conns that ended with an error
+	Clients       int   `json:"clients"` // clients serving the proxy, more than 1 with load balance
+
+	ClientInfos []ClientInfo `json:"client_infos"`
+}
+
+func (s *Server) proxyStats() []proxyStat {
+	traffics := make(map[int]metrics.TrafficSummary)
+	for _, t := range s.resources.listTraffics() {
+		traffics[t.Port] = t
+	}
+
+	stats := []proxyStat{}
+	for _, p := range s.resources.listProxys() {
+		stats = append(stats, proxyStat{
+			Proxy:         p,
+			UpwardBytes:   traffics[p.Port].UpwardBytes,
+			DownwardBytes: traffics[p.Port].DownwardBytes,
+			Conns:         traffics[p.Port].Conns,
+			Errors:        traffics[p.Port].Errors,
+			Clients:       p.backends.len(),
+			ClientInfos:   p.backends.clientInfos(),
+		})
+	}
+	return stats
+}
+
+// proxyDetail is the stat of one proxy with its live user conns.
+type proxyDetail struct {
+	proxyStat
+	Sessions []sessionStat `json:"sessions"`
+}
+
+func (s *Server) proxyDetail(port int) (proxyDetail, bool) {
+	for _, stat := range s.proxyStats() {
+		if stat.hasPort(port) {
+			return proxyDetail{proxyStat: stat, Sessions: s.sessions.list(stat.Port)}, true
+		}
+	}
+	return proxyDetail{}, false
+}
+
+// adminAuth guards every admin endpoint, requests pass with the basic auth
+// credentials or the bearer token.
+func adminAuth(auth AdminAuth, next http.Handler) http.Handler {
+	if !auth.Enabled() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth.Token != "" {
+			if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && secureEqual(token, auth.Token) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if auth.User != "" || auth.Password != "" {
+			if user, password, ok := r.BasicAuth(); ok && secureEqual(user, auth.User) && secureEqual(password, auth.Password) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="gnar admin", charset="UTF-8"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.log.Errorf("Write json response error: %v", err)
 	}
 }
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxBanIPs bounds the ips the auth bans track, like maxRateIPs.
+const maxBanIPs = 10000
+
+// authBans counts the failed logins of every ip in a sliding window, an ip
+// with the limit of them is banned for a while. The windows of the ips are
+// read from the config on every call, so a reload applies at once.
+type authBans struct {
+	ips map[string]*list.Element
+	lru *list.List // of *ipFailures, the most recently failed first
+	mu  sync.Mutex
+}
+
+type ipFailures struct {
+	ip       string
+	failures []time.Time // within the window, the oldest first
+	until    time.Time   // end of the ban, zero when not banned
+}
+
+func newAuthBans() *authBans {
+	return &authBans{
+		ips: make(map[string]*list.Element),
+		lru: list.New(),
+	}
+}
+
+// fail counts a failed login of the ip of addr, it reports true when the ip
+// is banned by it.
+func (b *authBans) fail(addr net.Addr, limit int, window, ban time.Duration) bool {
+	if limit <= 0 {
+		return false
+	}
+	ip := hostname(addr.String())
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var f *ipFailures
+	if e, ok := b.ips[ip]; ok {
+		b.lru.MoveToFront(e)
+		f = e.Value.(*ipFailures)
+	} else {
+		if b.lru.Len() >= maxBanIPs {
+			oldest := b.lru.Back()
+			b.lru.Remove(oldest)
+			delete(b.ips, oldest.Value.(*ipFailures).ip)
+		}
+		f = &ipFailures{ip: ip}
+		b.ips[ip] = b.lru.PushFront(f)
+	}
+
+	i := 0
+	for i < len(f.failures) && now.Sub(f.failures[i]) >= window {
+		i++
+	}
+	f.failures = append(f.failures[i:], now)
+	if len(f.failures) < limit {
+		return false
+	}
+	f.failures = nil
+	f.until = now.Add(ban)
+	return true
+}
+
+// banned reports whether the ip of addr is banned right now.
+func (b *authBans) banned(addr net.Addr) bool {
+	ip := hostname(addr.String())
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.ips[ip]
+	if !ok {
+		return false
+	}
+	return time.Now().Before(e.Value.(*ipFailures).until)
+}
+
+// authFailed counts a failed login of the client at addr to its ban.
+func (s *Server) authFailed(addr net.Addr) {
+	cfg := s.config()
+	if s.bans.fail(addr, cfg.AuthFailLimit, cfg.AuthFailWindow, cfg.AuthBanDuration) {
+		s.log.Warnf("Banned %s for %s after %d failed logins within %s", hostname(addr.String()), cfg.AuthBanDuration,
+			cfg.AuthFailLimit, cfg.AuthFailWindow)
+	}
+}
+
+// closeBanned closes a control conn of a banned ip before anything is read.
+func (s *Server) closeBanned(conn net.Conn) bool {
+	if s.config().AuthFailLimit <= 0 || !s.bans.banned(conn.RemoteAddr()) {
+		return false
+	}
+	s.log.Debugf("Closed conn of banned client addr: %s", conn.RemoteAddr())
+	conn.Close()
+	return true
+}
+
+func validAuthBans(cfg Config) error {
+	if cfg.AuthFailLimit < 0 || cfg.AuthFailWindow < 0 || cfg.AuthBanDuration < 0 {
+		return fmt.Errorf("invalid auth ban: limit %d, window %s, duration %s", cfg.AuthFailLimit, cfg.AuthFailWindow, cfg.AuthBanDuration)
+	}
+	return nil
+}
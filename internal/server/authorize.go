@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/abcdlsj/gnar/pkg/proto"
+)
+
+// Authorizer decides if the client may register the proxy of req, it is
+// called after the login and the checks of the config, before the port is
+// bound. The error is sent to the client, a *proto.RejectError picks the
+// reject code, others are denied.
+type Authorizer func(clientID string, req *proto.MsgProxyReq) error
+
+// AllowAll is the default Authorizer, it allows every proxy.
+func AllowAll(string, *proto.MsgProxyReq) error {
+	return nil
+}
+
+// WithAuthorizer enforces the policy of a on the proxy requests, e.g. quotas
+// of an application embedding the server.
+func WithAuthorizer(a Authorizer) Option {
+	return func(s *Server) {
+		s.authorize = a
+	}
+}
+
+// checkAuthorized runs the Authorizer on the proxy request of client.
+func (s *Server) checkAuthorized(client string, msg *proto.MsgProxyReq) (proto.RejectCode, error) {
+	err := s.authorize(client, msg)
+	if err == nil {
+		return "", nil
+	}
+	var reject *proto.RejectError
+	if !errors.As(err, &reject) {
+		return proto.RejectDenied, err
+	}
+	if reject.Reason == "" {
+		return reject.Code, fmt.Errorf("proxy of client %s not authorized", client)
+	}
+	return reject.Code, errors.New(reject.Reason)
+}
+
+// clientID identifies the client of a control conn for the Authorizer, the
+// common name of its verified certificate, or the ip it connects from.
+func clientID(conn net.Conn) string {
+	// a *tls.Conn or a quic stream
+	if tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			if cn := certs[0].Subject.CommonName; cn != "" {
+				return cn
+			}
+			return certs[0].Subject.String()
+		}
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
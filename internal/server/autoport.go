@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// parseAutoPorts parses the start-end pool of auto-ports.
+func parseAutoPorts(s string) (int, int, error) {
+	first, last, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid auto ports: %q, expected start-end", s)
+	}
+	start, err := strconv.Atoi(first)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid auto ports: %q", s)
+	}
+	end, err := strconv.Atoi(last)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid auto ports: %q", s)
+	}
+	if start < 1 || end > 65535 || start > end {
+		return 0, 0, fmt.Errorf("invalid auto ports: %d-%d", start, end)
+	}
+	return start, end, nil
+}
+
+func validAutoPorts(cfg Config) error {
+	if cfg.AutoPorts == "" {
+		return nil
+	}
+	_, _, err := parseAutoPorts(cfg.AutoPorts)
+	return err
+}
+
+// autoPortPool hands out the ports of auto-ports to the proxys asking for
+// port 0, a port is used from the claim until the proxy is closed.
+type autoPortPool struct {
+	used map[int]bool
+	next int // where the next claim starts looking, so freed ports are reused last
+	mu   sync.Mutex
+}
+
+func newAutoPortPool() *autoPortPool {
+	return &autoPortPool{used: make(map[int]bool)}
+}
+
+// claim marks the next free port of start-end used and returns it, 0 when
+// all of them are used. free reports the ports that no proxy listens on.
+func (p *autoPortPool) claim(start, end int, free func(int) bool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.next < start || p.next > end {
+		p.next = start
+	}
+	for i := 0; i <= end-start; i++ {
+		port := p.next
+		if p.next++; p.next > end {
+			p.next = start
+		}
+		if !p.used[port] && free(port) {
+			p.used[port] = true
+			return port
+		}
+	}
+	return 0
+}
+
+func (p *autoPortPool) release(port int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.used, port)
+}
+
+// claimAutoPort picks the remote port of a proxy asking for port 0 out of
+// the pool, within the port range of cfg. The port must be released once
+// the proxy is closed.
+func (s *Server) claimAutoPort(cfg Config) (int, error) {
+	// validated
+	start, end, _ := parseAutoPorts(cfg.AutoPorts)
+	if start < cfg.MinPort {
+		start = cfg.MinPort
+	}
+	if end > cfg.MaxPort {
+		end = cfg.MaxPort
+	}
+	port := s.autoPorts.claim(start, end, s.resources.isAvailablePort)
+	if port == 0 {
+		return 0, fmt.Errorf("no free port in auto ports %s", cfg.AutoPorts)
+	}
+	return port, nil
+}
@@ -0,0 +1,34 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const backlogSupported = true
+
+// setBacklog listens on the socket of l again with backlog, the kernel takes
+// the new queue length for a socket already listening. It is capped at
+// net.core.somaxconn on linux, kern.ipc.somaxconn on the bsds.
+func setBacklog(l net.Listener, backlog int) error {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("listener %T has no socket", l)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var lerr error
+	if err := rc.Control(func(fd uintptr) {
+		lerr = unix.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+	return lerr
+}
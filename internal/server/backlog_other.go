@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package server
+
+import "net"
+
+const backlogSupported = false
+
+// setBacklog keeps the backlog the runtime listened with.
+func setBacklog(l net.Listener, backlog int) error {
+	return nil
+}
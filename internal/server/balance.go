@@ -0,0 +1,381 @@
+package server
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abcdlsj/gnar/pkg/proto"
+)
+
+const (
+	balanceRoundRobin = "round-robin"
+	balanceLeastConns = "least-conns"
+	balanceSourceIP   = "source-ip"
+
+	// maxAffinityIPs bounds the ips a proxy remembers the client of, the
+	// least recently seen one is forgotten first.
+	maxAffinityIPs = 10000
+)
+
+func validBalance(strategy string) error {
+	switch strategy {
+	case "", balanceRoundRobin, balanceLeastConns, balanceSourceIP:
+		return nil
+	default:
+		return fmt.Errorf("invalid load balance strategy: %s", strategy)
+	}
+}
+
+// backend is a client serving a proxy, over its control connection.
+type backend struct {
+	ctrl    net.Conn
+	client  string // id of the Authorizer, quotas count by it
+	zone    int    // listener the client logged in on, see ListenerConfig.id
+	info    ClientInfo
+	req     *proto.MsgProxyReq
+	conns   atomic.Int64 // user conns sent to the client and not closed yet
+	current int          // smooth round-robin credit, under the group lock
+}
+
+// weight is the share of user conns the client declared, at least 1.
+func (b *backend) weight() int {
+	if b.req.Weight > 0 {
+		return b.req.Weight
+	}
+	return 1
+}
+
+// backendGroup holds the clients serving one proxy, with load balance on
+// clients registering the same proxy name and port share it.
+type backendGroup struct {
+	strategy  string
+	proxyType string       // of the first client, the others join with the same
+	limit     *connLimit   // shared by the clients, checked before picking one
+	rate      *ipRateLimit // new user conns per ip, checked before the limit
+	affinity  *affinity    // user ip to client, with source-ip
+	backends  []*backend
+	mu        sync.Mutex
+}
+
+func newBackendGroup(strategy string, b *backend, rate *ipRateLimit, affinityTimeout time.Duration) *backendGroup {
+	g := &backendGroup{
+		strategy:  strategy,
+		proxyType: b.req.ProxyType,
+		limit:     newConnLimit(b.req.MaxConns, b.req.Overflow),
+		rate:      rate,
+		backends:  []*backend{b},
+	}
+	if strategy == balanceSourceIP && affinityTimeout > 0 {
+		g.affinity = newAffinity(affinityTimeout)
+	}
+	return g
+}
+
+func (g *backendGroup) add(b *backend) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.backends = append(g.backends, b)
+}
+
+// remove drops the backend of ctrl, it reports whether it was found and how
+// many backends are left.
+func (g *backendGroup) remove(ctrl net.Conn) (bool, int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, b := range g.backends {
+		if b.ctrl == ctrl {
+			g.backends = append(g.backends[:i], g.backends[i+1:]...)
+			return true, len(g.backends)
+		}
+	}
+	return false, len(g.backends)
+}
+
+func (g *backendGroup) has(ctrl net.Conn) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, b := range g.backends {
+		if b.ctrl == ctrl {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *backendGroup) len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.backends)
+}
+
+// first is the backend that registered the proxy, or the oldest one left.
+func (g *backendGroup) first() *backend {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.backends[0]
+}
+
+func (g *backendGroup) list() []*backend {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]*backend{}, g.backends...)
+}
+
+// pick returns the backend of the next user conn from addr, nil when no
+// client is left. The clients get user conns in proportion to their weights.
+func (g *backendGroup) pick(addr net.Addr) *backend {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.backends) == 0 {
+		return nil
+	}
+
+	switch g.strategy {
+	case balanceLeastConns:
+		// the fewest conns per weight
+		least := g.backends[0]
+		for _, b := range g.backends[1:] {
+			if b.conns.Load()*int64(least.weight()) < least.conns.Load()*int64(b.weight()) {
+				least = b
+			}
+		}
+		return least
+	case balanceSourceIP:
+		ip := addrIP(addr)
+		b := g.affinity.get(ip)
+		if b == nil || !g.serving(b) {
+			b = g.hashed(ip)
+		}
+		g.affinity.set(ip, b)
+		return b
+	}
+
+	// smooth weighted round-robin, every client gets its turns spread out
+	total := 0
+	var best *backend
+	for _, b := range g.backends {
+		b.current += b.weight()
+		total += b.weight()
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// hashed maps ip to a backend by weight, the same ip gets the same backend
+// while the clients stay the same. It must be called with g.mu held.
+func (g *backendGroup) hashed(ip string) *backend {
+	total := 0
+	for _, b := range g.backends {
+		total += b.weight()
+	}
+	h := fnv.New32a()
+	h.Write([]byte(ip))
+	n := int(h.Sum32() % uint32(total))
+	for _, b := range g.backends {
+		if n -= b.weight(); n < 0 {
+			return b
+		}
+	}
+	return g.backends[0]
+}
+
+// serving tells if b still serves the proxy, it must be called with g.mu held.
+func (g *backendGroup) serving(b *backend) bool {
+	for _, cur := range g.backends {
+		if cur == b {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP is the ip of addr, or addr as is when it has no port.
+func addrIP(addr net.Addr) string {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
+// affinity remembers the client a user ip was sent to, until the ip opens
+// no conn for the timeout. It is guarded by the group lock, a nil affinity
+// remembers nothing.
+type affinity struct {
+	timeout time.Duration
+	ips     map[string]*list.Element
+	lru     *list.List // of *affinityEntry, the most recently seen first
+}
+
+type affinityEntry struct {
+	ip   string
+	b    *backend
+	seen time.Time
+}
+
+func newAffinity(timeout time.Duration) *affinity {
+	return &affinity{
+		timeout: timeout,
+		ips:     make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (a *affinity) get(ip string) *backend {
+	if a == nil {
+		return nil
+	}
+	a.expire()
+	if e, ok := a.ips[ip]; ok {
+		return e.Value.(*affinityEntry).b
+	}
+	return nil
+}
+
+func (a *affinity) set(ip string, b *backend) {
+	if a == nil {
+		return
+	}
+	if e, ok := a.ips[ip]; ok {
+		entry := e.Value.(*affinityEntry)
+		entry.b, entry.seen = b, time.Now()
+		a.lru.MoveToFront(e)
+		return
+	}
+	if a.lru.Len() >= maxAffinityIPs {
+		a.remove(a.lru.Back())
+	}
+	a.ips[ip] = a.lru.PushFront(&affinityEntry{ip: ip, b: b, seen: time.Now()})
+}
+
+// expire forgets the ips idle for longer than the timeout.
+func (a *affinity) expire() {
+	for e := a.lru.Back(); e != nil && time.Since(e.Value.(*affinityEntry).seen) > a.timeout; e = a.lru.Back() {
+		a.remove(e)
+	}
+}
+
+func (a *affinity) remove(e *list.Element) {
+	a.lru.Remove(e)
+	delete(a.ips, e.Value.(*affinityEntry).ip)
+}
+
+// track counts conn as a user conn of the backend until it is closed.
+func (b *backend) track(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	b.conns.Add(1)
+	return &trackedConn{deadlineConn: deadlineConn{conn}, done: func() { b.conns.Add(-1) }}
+}
+
+type trackedConn struct {
+	deadlineConn
+	once sync.Once
+	done func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.done)
+	return c.ReadWriteCloser.Close()
+}
+
+var errBalanceMismatch = errors.New("shared proxy options do not match the serving clients")
+
+// joinProxy adds the client as another backend of the proxy with the same
+// name on the same port or domain, it reports false when there is none to join.
+func (s *Server) joinProxy(cConn net.Conn, info ClientInfo, zone int, msg *proto.MsgProxyReq) (bool, error) {
+	if s.cfg.LoadBalance == "" || msg.ProxyName == "" || msg.ProxyType == "udp" {
+		return false, nil
+	}
+
+	domain := ""
+	if routedType(msg.ProxyType) {
+		if domain = routedDomain(msg, s.cfg.Domain); domain == "" {
+			return false, nil
+		}
+	}
+	p, ok, err := s.resources.join(msg.ProxyName, msg.RemotePort, domain, &backend{ctrl: cConn, client: info.ID, zone: zone, info: info, req: msg})
+	if !ok {
+		return false, nil
+	}
+	if err != nil {
+		return true, s.rejectProxy(cConn, proto.RejectInvalidRequest, err)
+	}
+
+	resp := proto.NewMsgProxyResp(p.Domain, "success", p.Port, p.Compress)
+	resp.ProxyProtocol = msg.ProxyProtocol
+	resp.Headers = hasHeaderRules(msg)
+	resp.TerminateTLS = p.TerminateTLS
+	if err := proto.Send(cConn, resp); err != nil {
+		s.resources.removeCtrlProxy(p.Port, cConn, reclaimDisconnect)
+		return true, fmt.Errorf("error sending proxy accept message: %v", err)
+	}
+	if err := s.sendBanner(cConn); err != nil {
+		s.resources.removeCtrlProxy(p.Port, cConn, reclaimDisconnect)
+		return true, err
+	}
+
+	from := cConn.RemoteAddr().String()
+	s.log.Infof("Client %s joined proxy %s on port %d, %d clients serving", from, displayName(msg.ProxyName), p.Port, p.backends.len())
+
+	hlogger := s.log.CloneAdd(fmt.Sprintf("[:%d]", p.Port)).With("port", p.Port, "name", msg.ProxyName, "remote_addr", from)
+	go tickHeart(cConn, s.cfg.HeartbeatInterval, hlogger)
+	go s.watchHeartbeat(cConn, p.Port, hlogger)
+	return true, nil
+}
+
+// join adds b to the proxy named name on port, or on domain for http proxys,
+// it reports false when there is no such proxy. Clients of another listener
+// can't join it.
+func (rm *resourceManager) join(name string, port int, domain string, b *backend) (Proxy, bool, error) {
+	rm.m.Lock()
+	defer rm.m.Unlock()
+	for _, p := range rm.proxys {
+		matched := port != 0 && p.Port == port
+		if domain != "" {
+			matched = p.Domain == domain
+		}
+		if !matched {
+			continue
+		}
+
+		req, msg := p.backends.first().req, b.req
+		if req.ProxyName != name || p.backends.first().zone != b.zone {
+			return Proxy{}, false, nil
+		}
+		// the clients share one listener and one tunnel format
+		if req.ProxyType != msg.ProxyType || req.Compress != msg.Compress || req.BindHost != msg.BindHost ||
+			!equalStrings(req.AllowIPs, msg.AllowIPs) || !equalStrings(req.DenyIPs, msg.DenyIPs) ||
+			req.MaxConns != msg.MaxConns || req.Overflow != msg.Overflow || req.ProxyProtocol != msg.ProxyProtocol || req.Hostname != msg.Hostname ||
+			req.TerminateTLS != msg.TerminateTLS ||
+			req.ConnRate != msg.ConnRate || req.ConnBurst != msg.ConnBurst || req.Network != msg.Network ||
+			!equalStrings(req.RequestHeaders, msg.RequestHeaders) || !equalStrings(req.ResponseHeaders, msg.ResponseHeaders) {
+			return p, true, errBalanceMismatch
+		}
+
+		p.backends.add(b)
+		return p, true, nil
+	}
+	return Proxy{}, false, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"unicode"
+
+	"github.com/abcdlsj/gnar/pkg/proto"
+)
+
+// maxClientInfoLen bounds the strings a client tells of itself.
+const maxClientInfoLen = 64
+
+// ClientInfo is what a control conn told of its client in the login, shown
+// by the admin api to spot clients that need an upgrade.
+type ClientInfo struct {
+	ID       string `json:"id"` // of the Authorizer
+	Addr     string `json:"addr"`
+	Version  string `json:"version"`
+	Platform string `json:"platform,omitempty"` // os/arch, empty for clients that don't send it
+}
+
+func newClientInfo(conn net.Conn, client string, login *proto.MsgLogin) ClientInfo {
+	return ClientInfo{
+		ID:       client,
+		Addr:     conn.RemoteAddr().String(),
+		Version:  sanitizeClientInfo(login.Version),
+		Platform: sanitizeClientInfo(login.Platform),
+	}
+}
+
+// sanitizeClientInfo drops the unprintable runes of s and cuts it, the
+// strings come from the client as is.
+func sanitizeClientInfo(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, s)
+	if runes := []rune(s); len(runes) > maxClientInfoLen {
+		s = string(runes[:maxClientInfoLen])
+	}
+	return s
+}
+
+// clientInfos returns the clients serving the backends of g.
+func (g *backendGroup) clientInfos() []ClientInfo {
+	infos := []ClientInfo{}
+	for _, b := range g.list() {
+		infos = append(infos, b.info)
+	}
+	return infos
+}
@@ -1,20 +1,31 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/abcdlsj/gnar/pkg/share"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
+const shutdownTimeout = 10 * time.Second
+
 func Command() *cobra.Command {
 	var cfgFile string
 
 	cmd := &cobra.Command{
 		Use:   "server [port]",
 		Short: "Run gnar server",
-		Long:  "Run gnar server with optional port argument",
-		Args:  cobra.MaximumNArgs(1),
+		Long: `Run gnar server with optional port argument
+
+Every option can also be set by GNAR_ prefixed environment variable, e.g. GNAR_ADMIN_PORT.
+Precedence: flags > environment variables > config file > defaults.`,
+		Args: cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			viper.BindPFlags(cmd.PersistentFlags())
 
@@ -23,18 +34,198 @@ func Command() *cobra.Command {
 				return fmt.Errorf("error loading config: %v", err)
 			}
 
-			return newServer(cfg).Run()
+			if validate, _ := cmd.Flags().GetBool("validate"); validate {
+				cmd.SilenceUsage = true
+				return printValidation(cfg)
+			}
+
+			// errors of a server that can't start are no usage errors
+			cmd.SilenceUsage = true
+			srv := New(cfg)
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- srv.Run()
+			}()
+
+			sc := make(chan os.Signal, 1)
+			signal.Notify(sc, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+			for {
+				select {
+				case err := <-errCh:
+					return err
+				case sig := <-sc:
+					if sig == syscall.SIGHUP {
+						srv.log.Infof("Receive signal %s to reload config", sig)
+						reloadConfig(srv, cfgFile, args)
+						continue
+					}
+
+					srv.log.Infof("Receive signal %s to shutdown", sig)
+					ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+					defer cancel()
+					return srv.Shutdown(ctx)
+				}
+			}
 		},
 	}
 
 	cmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file")
+	cmd.Flags().Bool("validate", false, "check the config and exit without starting the server")
 	cmd.PersistentFlags().IntP("port", "p", 8910, "server port")
 	cmd.PersistentFlags().IntP("admin-port", "a", 0, "admin server port")
+	cmd.PersistentFlags().String("admin-user", "", "basic auth user of admin server")
+	cmd.PersistentFlags().String("admin-password", "", "basic auth password of admin server")
+	cmd.PersistentFlags().String("admin-token", "", "bearer token of admin server")
+	cmd.PersistentFlags().String("admin-socket", "", "unix socket path the admin server also listens on, without admin auth")
+	cmd.PersistentFlags().Bool("no-backend-response", false, "send a 502 page to users of http proxys no client serves instead of closing the conn")
+	cmd.PersistentFlags().String("no-backend-page", "", "html file of the no-backend-response page, empty uses a built in one")
+	cmd.PersistentFlags().Bool("enable-profiling", false, "serve pprof profiles on the admin server under /debug/pprof/")
 	cmd.PersistentFlags().BoolP("domain-tunnel", "d", false, "enable domain tunnel")
 	cmd.PersistentFlags().StringP("domain", "D", "", "domain name")
 	cmd.PersistentFlags().StringP("token", "t", "", "token")
+	cmd.PersistentFlags().String("token-grace-period", "5m", "how long old tokens are accepted after a reload changed them")
 	cmd.PersistentFlags().BoolP("multiplex", "m", false, "multiplex client/server control connection")
 	cmd.PersistentFlags().StringP("caddy-srv-name", "s", "srv0", "caddy server name")
+	cmd.PersistentFlags().String("bind-host", "", "default ip to bind proxy ports, empty means all interfaces")
+	cmd.PersistentFlags().Bool("reuse-port", false, "bind ports with SO_REUSEPORT so a new server can take them over before the old one exits")
+	cmd.PersistentFlags().Int("listen-backlog", 0, "connections a tcp port queues before they are accepted, 0 is the system default")
+	cmd.PersistentFlags().Int("accept-workers", 1, "goroutines accepting connections on each tcp port")
+	cmd.PersistentFlags().Int("http-port", 0, "shared port of http proxys routed by subdomain, 0 disables")
+	cmd.PersistentFlags().Int("https-port", 0, "shared port of tls proxys routed by sni, the tls is terminated only for proxys asking for it, 0 disables")
+	cmd.PersistentFlags().Int("ws-port", 0, "port accepting client control connections over websocket, 0 disables")
+	cmd.PersistentFlags().String("ws-path", "/ws", "http path of the websocket control connections")
+	cmd.PersistentFlags().Int("quic-port", 0, "udp port accepting clients over quic, needs the tls files, 0 disables")
+	cmd.PersistentFlags().Int("max-proxys", 0, "max proxys on server, 0 means unlimited")
+	cmd.PersistentFlags().String("proxy-ttl", "0s", "cancel proxys that ask for no ttl after this long, 0 keeps them")
+	cmd.PersistentFlags().String("max-proxy-ttl", "0s", "reject proxys that ask for a longer ttl, 0 means unlimited")
+	cmd.PersistentFlags().String("load-balance", "", "let clients share a proxy name and port, round-robin, least-conns or source-ip")
+	cmd.PersistentFlags().String("affinity-timeout", "10m", "how long source-ip load balance keeps an idle user ip on its client, 0 hashes every conn")
+	cmd.PersistentFlags().Int("min-port", 1, "lowest remote port clients may request")
+	cmd.PersistentFlags().Int("max-port", 65535, "highest remote port clients may request")
+	cmd.PersistentFlags().Int("max-port-range", 100, "most ports clients may request in one port range, 0 disables ranges")
+	cmd.PersistentFlags().String("banner", "", "message clients log when their proxy is registered, e.g. a maintenance window")
+	cmd.PersistentFlags().Int("auth-fail-limit", 0, "ban ips with this many failed logins within auth-fail-window, 0 disables bans")
+	cmd.PersistentFlags().String("auth-fail-window", "1m", "window the failed logins of an ip are counted in")
+	cmd.PersistentFlags().String("auth-ban-duration", "10m", "how long a banned ip's connections are closed at once")
+	cmd.PersistentFlags().Bool("acme", false, "get the certificates of tls proxys terminated on the https port from an acme directory")
+	cmd.PersistentFlags().String("acme-email", "", "contact email of the acme account")
+	cmd.PersistentFlags().String("acme-cache-dir", "acme", "directory the acme account and certificates are kept in")
+	cmd.PersistentFlags().String("acme-directory", "", "url of the acme directory, empty is let's encrypt")
+	cmd.PersistentFlags().StringSlice("acme-hosts", nil, "hostnames acme gets certificates for besides the tls proxys, e.g. of http proxys or the admin server")
+	cmd.PersistentFlags().Bool("admin-tls", false, "serve the admin port over https with the edge certs and acme")
+	cmd.PersistentFlags().String("subdomain-policy", "allow", "what clients asking for a subdomain nobody reserved get, allow, random or reject")
+	cmd.PersistentFlags().String("auto-ports", "", "pool the remote ports of clients asking for auto are handed out from, e.g. 20000-21000")
+	cmd.PersistentFlags().String("speed-limit", "", "global speed limit of every proxy, e.g. 1mb")
+	cmd.PersistentFlags().Int("conn-rate", 0, "new user conns per second of every remote ip on a proxy, 0 means unlimited")
+	cmd.PersistentFlags().Int("conn-burst", 0, "new user conns at once of every remote ip over conn-rate, 0 means conn-rate")
+	cmd.PersistentFlags().String("access-log", "", "file that gets a json line for every closed user conn, empty disables it")
+	cmd.PersistentFlags().String("trace-endpoint", "", "otlp http collector url to export traces, e.g. http://localhost:4318, empty disables tracing")
+	cmd.PersistentFlags().String("tls-cert-file", "", "tls certificate file for control connection")
+	cmd.PersistentFlags().String("tls-key-file", "", "tls key file for control connection")
+	cmd.PersistentFlags().String("tls-client-ca-file", "", "ca file clients must present a certificate signed by, empty asks for none")
 
+	cmd.AddCommand(configCommand(cmd))
 	return cmd
 }
+
+// configUsages comments the keys of the example config that have no flag.
+var configUsages = map[string]string{
+	"heartbeat-interval":        "interval of the heartbeats to clients",
+	"heartbeat-timeout":         "close clients that send no heartbeat within this, 0 disables",
+	"keepalive":                 "tcp keepalive period of accepted conns, 0 disables it",
+	"exchange-timeout":          "close user conns the client does not pick up within this",
+	"handshake-timeout":         "close client conns that send no complete login and first packet within this, 0 disables",
+	"copy-buffer-size":          "bytes of the copy buffer per direction of a proxied conn",
+	"max-packet-size":           "largest control packet read, conns declaring longer ones are closed",
+	"bind-retries":              "bind a remote port still in use this many more times before rejecting the proxy",
+	"bind-retry-delay":          "wait between the bind retries",
+	"idle-timeout":              "close user conns that transfer nothing for this long, 0 disables",
+	"cancel-grace-period":       "how long the user conns of a closed proxy may run, 0 lets them run until they end",
+	"traffic-cap":               "cancel and reject all proxys once the server moved this many bytes, e.g. 1tb",
+	"proxy-traffic-cap":         "cancel and reject the proxy of a remote port once it moved this many bytes",
+	"client-max-proxys":         "most proxys one client may serve at once, 0 means unlimited",
+	"client-max-conns":          "most user conns open to one client at once, 0 means unlimited",
+	"client-traffic-cap":        "reject the proxys and user conns of a client once it moved this many bytes",
+	"metrics-file":              "keep traffic totals across restarts in this file",
+	"metrics-flush-interval":    "how often traffic totals are written to metrics-file",
+	"proxys":                    "reserve remote ports, when set clients can only proxy these ports",
+	"proxys.remote-port":        "the reserved port",
+	"proxys.proxy-name":         "only this proxy name can use the port",
+	"proxys.token":              "overrides the server token for this port",
+	"proxys.traffic-cap":        "overrides proxy-traffic-cap for this port",
+	"listeners":                 "accept control conns on more ports, e.g. one per tenant",
+	"listeners.port":            "control port of the listener",
+	"listeners.token":           "logins on this port need this token instead of the server ones",
+	"listeners.min-port":        "overrides min-port for clients of this port",
+	"listeners.max-port":        "overrides max-port for clients of this port",
+	"subdomains":                "subdomains reserved for clients, they get them on every connect",
+	"edge-certs":                "certificates of the tls proxys the server terminates the tls of",
+	"edge-certs.hostname":       "hostname of the proxys, *.example.com covers one label below",
+	"edge-certs.cert-file":      "pem certificate chain",
+	"edge-certs.key-file":       "pem private key",
+	"subdomains.subdomain":      "the reserved subdomain of domain",
+	"subdomains.token":          "clients logging in with this token get it, also a login token",
+	"subdomains.client":         "or the client ip, or the common name of its certificate with tls-client-ca-file",
+	"client-quotas":             "quotas of single clients, override the client-* ones",
+	"client-quotas.client":      "the client ip, or the common name of its certificate with tls-client-ca-file",
+	"client-quotas.max-proxys":  "overrides client-max-proxys",
+	"client-quotas.max-conns":   "overrides client-max-conns",
+	"client-quotas.traffic-cap": "overrides client-traffic-cap",
+}
+
+// configCommand writes an example config of the server defaults, its
+// comments are the flag usages and configUsages.
+func configCommand(server *cobra.Command) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Manage gnar server config files",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "init",
+		Short: "Write an example config file with the defaults to stdout",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := defaultConfig()
+			if err != nil {
+				return fmt.Errorf("error loading default config: %v", err)
+			}
+			return share.WriteExampleConfig(cmd.OutOrStdout(), cfg, func(key string) string {
+				if usage, ok := configUsages[key]; ok {
+					return usage
+				}
+				if f := server.PersistentFlags().Lookup(key); f != nil {
+					return f.Usage
+				}
+				return ""
+			})
+		},
+	})
+	return cmd
+}
+
+// printValidation prints what validateConfig checked, the error makes the
+// command exit non-zero.
+func printValidation(cfg Config) error {
+	checked, err := validateConfig(cfg)
+	for _, line := range checked {
+		fmt.Printf("ok   %s\n", line)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	fmt.Println("Config is valid")
+	return nil
+}
+
+// reloadConfig keeps the running config when the new one is invalid.
+func reloadConfig(srv *Server, cfgFile string, args []string) {
+	cfg, err := LoadConfig(cfgFile, args)
+	if err != nil {
+		srv.log.Errorf("Error reloading config, keep the running one: %v", err)
+		return
+	}
+	if err := srv.Reload(cfg); err != nil {
+		srv.log.Errorf("Error reloading config, keep the running one: %v", err)
+	}
+}
@@ -3,41 +3,323 @@ package server
 import (
 	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/abcdlsj/gnar/internal/proxy"
+	"github.com/abcdlsj/gnar/pkg/proto"
+	"github.com/abcdlsj/gnar/pkg/share"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Port         int    `mapstructure:"port"`
-	AdminPort    int    `mapstructure:"admin-port"`
-	DomainTunnel bool   `mapstructure:"domain-tunnel"`
-	Domain       string `mapstructure:"domain"`
-	Token        string `mapstructure:"token"`
-	Multiplex    bool   `mapstructure:"multiplex"`
-	CaddySrvName string `mapstructure:"caddy-srv-name"`
+	Port            int       `mapstructure:"port"`
+	AdminPort       int       `mapstructure:"admin-port"`
+	AdminAuth       AdminAuth `mapstructure:",squash"`
+	AdminSocket     string    `mapstructure:"admin-socket"`     // unix socket path of the admin server, empty disables
+	EnableProfiling bool      `mapstructure:"enable-profiling"` // serve net/http/pprof on the admin server under /debug/pprof/
+	DomainTunnel    bool      `mapstructure:"domain-tunnel"`
+	Domain          string    `mapstructure:"domain"`
+	Token           string    `mapstructure:"token"`
+	// TokenGracePeriod keeps the old tokens valid after a reload changed them.
+	TokenGracePeriod time.Duration `mapstructure:"token-grace-period"`
+	Multiplex        bool          `mapstructure:"multiplex"`
+	CaddySrvName     string        `mapstructure:"caddy-srv-name"`
+	SpeedLimit       string        `mapstructure:"speed-limit"`
+	BindHost         string        `mapstructure:"bind-host"`      // default ip of proxy ports, empty means all interfaces
+	MaxProxys        int           `mapstructure:"max-proxys"`     // 0 means unlimited
+	MaxPortRange     int           `mapstructure:"max-port-range"` // most ports of a range registration, 0 disables ranges
+	LoadBalance      string        `mapstructure:"load-balance"`   // round-robin, least-conns or source-ip, empty disables sharing proxys
+	HTTPPort         int           `mapstructure:"http-port"`      // shared port of http proxys routed by subdomain, 0 disables
+	HTTPSPort        int           `mapstructure:"https-port"`     // shared port of tls proxys routed by sni, 0 disables
+	WSPort           int           `mapstructure:"ws-port"`        // port accepting control conns over websocket, 0 disables
+	WSPath           string        `mapstructure:"ws-path"`        // http path of the websocket upgrades
+	QUICPort         int           `mapstructure:"quic-port"`      // udp port accepting clients over quic, needs tls, 0 disables
+	MinPort          int           `mapstructure:"min-port"`       // lowest remote port clients may request
+	MaxPort          int           `mapstructure:"max-port"`       // highest remote port clients may request
+	TLS              TLSConfig     `mapstructure:",squash"`
+
+	HeartbeatInterval time.Duration `mapstructure:"heartbeat-interval"`
+	HeartbeatTimeout  time.Duration `mapstructure:"heartbeat-timeout"` // 0 disables the timeout
+	KeepAlive         time.Duration `mapstructure:"keepalive"`         // tcp keepalive period of accepted conns, 0 disables it
+	ReusePort         bool          `mapstructure:"reuse-port"`        // bind the ports with SO_REUSEPORT, for handing them over to a new server
+	ListenBacklog     int           `mapstructure:"listen-backlog"`    // queue of conns a tcp port holds before they are accepted, 0 is the system default
+	AcceptWorkers     int           `mapstructure:"accept-workers"`    // goroutines accepting on each tcp port
+	ExchangeTimeout   time.Duration `mapstructure:"exchange-timeout"`  // user conns not claimed by the client within it are closed
+	HandshakeTimeout  time.Duration `mapstructure:"handshake-timeout"` // control conns not sending their first packet within it are closed, 0 disables
+	CopyBufferSize    int           `mapstructure:"copy-buffer-size"`  // bytes of the buffer per direction of a proxied conn
+	MaxPacketSize     int           `mapstructure:"max-packet-size"`   // largest control packet read, longer ones close the conn
+
+	// EdgeCerts are the certificates of the tls proxys asking the server to
+	// terminate their tls, by hostname. With ACME the hostnames without one
+	// get a certificate of the acme directory, its tls-alpn-01 challenge is
+	// answered on the https port, so that must be reachable on 443.
+	EdgeCerts     []EdgeCert `mapstructure:"edge-certs"`
+	ACME          bool       `mapstructure:"acme"`
+	ACMEEmail     string     `mapstructure:"acme-email"`     // contact of the acme account, optional
+	ACMECacheDir  string     `mapstructure:"acme-cache-dir"` // directory the account and the certificates are kept in
+	ACMEDirectory string     `mapstructure:"acme-directory"` // url of the acme directory, empty is let's encrypt
+
+	// ACMEHosts are the hostnames ACME gets certificates for besides the
+	// ones of the tls proxys, e.g. of http proxys served on the https port
+	// or of the admin server, "*.example.com" allows the names one label
+	// below. AdminTLS serves the admin port over https with these
+	// certificates and the edge certs.
+	ACMEHosts []string `mapstructure:"acme-hosts"`
+	AdminTLS  bool     `mapstructure:"admin-tls"`
+
+	// Banner is a message the clients log on every registered proxy, e.g. a
+	// maintenance window, empty sends none.
+	Banner string `mapstructure:"banner"`
+
+	// AuthFailLimit bans an ip with this many failed logins within
+	// AuthFailWindow for AuthBanDuration, its control conns are closed
+	// before anything is read. 0 disables bans.
+	AuthFailLimit   int           `mapstructure:"auth-fail-limit"`
+	AuthFailWindow  time.Duration `mapstructure:"auth-fail-window"`
+	AuthBanDuration time.Duration `mapstructure:"auth-ban-duration"`
+
+	// AutoPorts is the start-end pool the remote ports of clients asking for
+	// port 0 are handed out from, e.g. 20000-21000, so they fall in the ports
+	// the firewall allows. Empty picks any free port of min-port to max-port.
+	AutoPorts string `mapstructure:"auto-ports"`
+
+	// BindRetries is how many more times a remote port still in use is bound,
+	// BindRetryDelay apart, before the proxy is rejected.
+	BindRetries    int           `mapstructure:"bind-retries"`
+	BindRetryDelay time.Duration `mapstructure:"bind-retry-delay"`
+
+	// ConnRate caps the new user conns per second of every remote ip on a
+	// proxy, with ConnBurst at once, 0 means unlimited. Clients may ask for
+	// lower ones.
+	ConnRate  int `mapstructure:"conn-rate"`
+	ConnBurst int `mapstructure:"conn-burst"`
+
+	// NoBackendResponse sends a 502 page to the users of http proxys no
+	// client serves, the one of NoBackendPage or a built in "tunnel offline"
+	// one, instead of closing their conns.
+	NoBackendResponse bool   `mapstructure:"no-backend-response"`
+	NoBackendPage     string `mapstructure:"no-backend-page"`
+
+	// IdleTimeout closes user conns that transfer nothing for this long, 0 disables it.
+	IdleTimeout time.Duration `mapstructure:"idle-timeout"`
+
+	// CancelGracePeriod is how long the user conns of a closed proxy may
+	// run before they are closed, 0 lets them run until they end.
+	CancelGracePeriod time.Duration `mapstructure:"cancel-grace-period"`
+
+	// AffinityTimeout is how long source-ip load balance keeps sending an ip
+	// to the same client after its last conn, 0 only hashes the ip.
+	AffinityTimeout time.Duration `mapstructure:"affinity-timeout"`
+
+	// TraceEndpoint is the otlp http collector url spans are exported to, empty disables tracing.
+	TraceEndpoint string `mapstructure:"trace-endpoint"`
+
+	// TrafficCap caps the bytes moved by the whole server and ProxyTrafficCap
+	// the ones of every remote port, e.g. 100gb, empty means unlimited. Proxys
+	// over a cap are canceled and rejected.
+	TrafficCap      string `mapstructure:"traffic-cap"`
+	ProxyTrafficCap string `mapstructure:"proxy-traffic-cap"`
+
+	// ClientMaxProxys, ClientMaxConns and ClientTrafficCap bound every client
+	// across all its proxys, 0 and empty mean unlimited. ClientQuotas override
+	// them for single clients.
+	ClientMaxProxys  int           `mapstructure:"client-max-proxys"`
+	ClientMaxConns   int           `mapstructure:"client-max-conns"`
+	ClientTrafficCap string        `mapstructure:"client-traffic-cap"`
+	ClientQuotas     []ClientQuota `mapstructure:"client-quotas"`
+
+	// ProxyTTL cancels the proxys that asked for no ttl after this long, 0
+	// keeps them. Clients asking for more than MaxProxyTTL are rejected.
+	ProxyTTL    time.Duration `mapstructure:"proxy-ttl"`
+	MaxProxyTTL time.Duration `mapstructure:"max-proxy-ttl"`
+
+	// AccessLog is the file that gets a json line for every closed user conn,
+	// with its proxy, remote addr, bytes and duration, empty disables it.
+	AccessLog string `mapstructure:"access-log"`
+
+	// MetricsFile keeps the traffic totals across restarts, empty disables it.
+	MetricsFile          string        `mapstructure:"metrics-file"`
+	MetricsFlushInterval time.Duration `mapstructure:"metrics-flush-interval"`
+
+	// Proxys reserves remote ports, when set clients can only proxy these ports.
+	Proxys []ReservedProxy `mapstructure:"proxys"`
+
+	// Subdomains reserves subdomains for clients, SubdomainPolicy is what a
+	// client asking for another one gets, allow (default), random or reject.
+	Subdomains      []ReservedSubdomain `mapstructure:"subdomains"`
+	SubdomainPolicy string              `mapstructure:"subdomain-policy"`
+
+	// Listeners accept control conns on more ports, e.g. one per tenant.
+	Listeners []ListenerConfig `mapstructure:"listeners"`
+}
+
+// AdminAuth protects the admin server with basic auth or a bearer token,
+// it is open when neither is set.
+type AdminAuth struct {
+	User     string `mapstructure:"admin-user"`
+	Password string `mapstructure:"admin-password"`
+	Token    string `mapstructure:"admin-token"`
+}
+
+func (a AdminAuth) Enabled() bool {
+	return a.User != "" || a.Password != "" || a.Token != ""
+}
+
+type ReservedProxy struct {
+	ProxyName  string `mapstructure:"proxy-name"`
+	RemotePort int    `mapstructure:"remote-port"`
+	Token      string `mapstructure:"token"`       // optional, overrides the server token
+	TrafficCap string `mapstructure:"traffic-cap"` // optional, overrides proxy-traffic-cap
+}
+
+// ListenerConfig is a control port of its own, conns accepted on it login
+// with its token and request remote ports in its range.
+type ListenerConfig struct {
+	Port    int    `mapstructure:"port"`
+	Token   string `mapstructure:"token"`    // optional, overrides the server token
+	MinPort int    `mapstructure:"min-port"` // optional, overrides min-port
+	MaxPort int    `mapstructure:"max-port"` // optional, overrides max-port
+}
+
+type TLSConfig struct {
+	CertFile     string `mapstructure:"tls-cert-file"`
+	KeyFile      string `mapstructure:"tls-key-file"`
+	ClientCAFile string `mapstructure:"tls-client-ca-file"` // clients must present a certificate signed by it, empty asks for none
+}
+
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+// setDefaults sets the keys whose default is not their zero value.
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("port", 8910)
+	v.SetDefault("admin-port", 0)
+	v.SetDefault("domain-tunnel", false)
+	v.SetDefault("multiplex", false)
+	v.SetDefault("caddy-srv-name", "srv0")
+	v.SetDefault("heartbeat-interval", "5s")
+	v.SetDefault("heartbeat-timeout", "30s")
+	v.SetDefault("keepalive", "30s")
+	v.SetDefault("listen-backlog", 0)
+	v.SetDefault("accept-workers", 1)
+	v.SetDefault("idle-timeout", "0s")
+	v.SetDefault("cancel-grace-period", "0s")
+	v.SetDefault("affinity-timeout", "10m")
+	v.SetDefault("proxy-ttl", "0s")
+	v.SetDefault("max-proxy-ttl", "0s")
+	v.SetDefault("exchange-timeout", "30s")
+	v.SetDefault("handshake-timeout", "10s")
+	v.SetDefault("copy-buffer-size", proxy.DefaultBufSize)
+	v.SetDefault("max-packet-size", proto.MaxPacketSize)
+	v.SetDefault("bind-retries", 3)
+	v.SetDefault("bind-retry-delay", "500ms")
+	v.SetDefault("token-grace-period", "5m")
+	v.SetDefault("ws-path", "/ws")
+	v.SetDefault("min-port", 1)
+	v.SetDefault("max-port", 65535)
+	v.SetDefault("max-port-range", 100)
+	v.SetDefault("auto-ports", "")
+	v.SetDefault("banner", "")
+	v.SetDefault("auth-fail-limit", 0)
+	v.SetDefault("auth-fail-window", "1m")
+	v.SetDefault("acme-cache-dir", "acme")
+	v.SetDefault("auth-ban-duration", "10m")
+	v.SetDefault("subdomain-policy", "allow")
+	v.SetDefault("metrics-flush-interval", "1m")
+}
+
+// defaultConfig is the config of the defaults only, without the flags, env
+// and config file LoadConfig reads.
+func defaultConfig() (Config, error) {
+	v := viper.New()
+	setDefaults(v)
+	var config Config
+	err := v.Unmarshal(&config)
+	return config, err
 }
 
 func LoadConfig(cfgFile string, args []string) (config Config, err error) {
-	viper.SetDefault("port", 8910)
-	viper.SetDefault("admin-port", 0)
-	viper.SetDefault("domain-tunnel", false)
-	viper.SetDefault("multiplex", false)
-	viper.SetDefault("caddy-srv-name", "srv0")
+	setDefaults(viper.GetViper())
 
+	// flags > env > config file > defaults, empty env vars are ignored
 	viper.AutomaticEnv()
 	viper.SetEnvPrefix("GNAR")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.BindEnv("port")
 	viper.BindEnv("admin-port")
+	viper.BindEnv("admin-user")
+	viper.BindEnv("admin-password")
+	viper.BindEnv("admin-token")
+	viper.BindEnv("admin-socket")
+	viper.BindEnv("enable-profiling")
+	viper.BindEnv("no-backend-response")
+	viper.BindEnv("no-backend-page")
 	viper.BindEnv("domain-tunnel")
 	viper.BindEnv("domain")
 	viper.BindEnv("token")
+	viper.BindEnv("token-grace-period")
 	viper.BindEnv("multiplex")
 	viper.BindEnv("caddy-srv-name")
+	viper.BindEnv("speed-limit")
+	viper.BindEnv("conn-rate")
+	viper.BindEnv("conn-burst")
+	viper.BindEnv("bind-host")
+	viper.BindEnv("max-proxys")
+	viper.BindEnv("max-port-range")
+	viper.BindEnv("auto-ports")
+	viper.BindEnv("banner")
+	viper.BindEnv("auth-fail-limit")
+	viper.BindEnv("auth-fail-window")
+	viper.BindEnv("auth-ban-duration")
+	viper.BindEnv("acme")
+	viper.BindEnv("acme-email")
+	viper.BindEnv("acme-cache-dir")
+	viper.BindEnv("acme-directory")
+	viper.BindEnv("acme-hosts")
+	viper.BindEnv("admin-tls")
+	viper.BindEnv("subdomain-policy")
+	viper.BindEnv("load-balance")
+	viper.BindEnv("affinity-timeout")
+	viper.BindEnv("http-port")
+	viper.BindEnv("https-port")
+	viper.BindEnv("ws-port")
+	viper.BindEnv("quic-port")
+	viper.BindEnv("ws-path")
+	viper.BindEnv("min-port")
+	viper.BindEnv("max-port")
+	viper.BindEnv("heartbeat-interval")
+	viper.BindEnv("heartbeat-timeout")
+	viper.BindEnv("keepalive")
+	viper.BindEnv("reuse-port")
+	viper.BindEnv("listen-backlog")
+	viper.BindEnv("accept-workers")
+	viper.BindEnv("idle-timeout")
+	viper.BindEnv("cancel-grace-period")
+	viper.BindEnv("exchange-timeout")
+	viper.BindEnv("handshake-timeout")
+	viper.BindEnv("copy-buffer-size")
+	viper.BindEnv("max-packet-size")
+	viper.BindEnv("bind-retries")
+	viper.BindEnv("bind-retry-delay")
+	viper.BindEnv("traffic-cap")
+	viper.BindEnv("proxy-traffic-cap")
+	viper.BindEnv("client-max-proxys")
+	viper.BindEnv("client-max-conns")
+	viper.BindEnv("client-traffic-cap")
+	viper.BindEnv("proxy-ttl")
+	viper.BindEnv("max-proxy-ttl")
+	viper.BindEnv("metrics-file")
+	viper.BindEnv("access-log")
+	viper.BindEnv("trace-endpoint")
+	viper.BindEnv("metrics-flush-interval")
+	viper.BindEnv("tls-cert-file")
+	viper.BindEnv("tls-key-file")
+	viper.BindEnv("tls-client-ca-file")
 
 	if cfgFile != "" {
-		viper.SetConfigFile(cfgFile)
-		viper.SetConfigType("toml")
-		if err := viper.ReadInConfig(); err != nil {
+		if err := share.ReadConfigFile(cfgFile); err != nil {
 			return config, fmt.Errorf("error reading config file: %v", err)
 		}
 	}
@@ -54,5 +336,19 @@ func LoadConfig(cfgFile string, args []string) (config Config, err error) {
 		config.Port = port
 	}
 
+	if err := validBalance(config.LoadBalance); err != nil {
+		return config, err
+	}
+
+	if config.MinPort < 1 || config.MaxPort > 65535 || config.MinPort > config.MaxPort {
+		return config, fmt.Errorf("invalid port range: %d-%d", config.MinPort, config.MaxPort)
+	}
+
 	return config, nil
 }
+
+// allowedPort reports whether clients may request the remote port, 0 asks
+// the server to pick one.
+func (c Config) allowedPort(port int) bool {
+	return port == 0 || (port >= c.MinPort && port <= c.MaxPort)
+}
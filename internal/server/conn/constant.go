@@ -1,11 +1,17 @@
 package conn
 
-import "github.com/google/uuid"
-
-const (
-	UuidLen = 8
+import (
+	"crypto/rand"
+	"encoding/hex"
 )
 
-func NewUuid() string {
-	return uuid.New().String()[:UuidLen]
+// IdLen is the length of conn ids, 16 hex chars of 64 random bits. Of a
+// million conns at once two share an id about once in 37 million times, the
+// conn map picks another one on a clash anyway.
+const IdLen = 16
+
+func NewId() string {
+	b := make([]byte, IdLen/2)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
@@ -2,41 +2,101 @@ package conn
 
 import (
 	"io"
-	"net"
 	"sync"
 	"time"
+
+	"github.com/abcdlsj/gnar/internal/logger"
 )
 
 type TCPConn struct {
-	t    time.Time
-	conn io.ReadWriteCloser
+	expire time.Time
+	conn   io.ReadWriteCloser
+	port   int
+}
+
+// Expirer is a user conn that answers the user before it is closed
+// unclaimed, instead of a bare close.
+type Expirer interface {
+	Expire() error
 }
 
+// TCPConnMap holds the user conns waiting for the client to claim them with
+// an exchange, conns not claimed within the ttl are closed.
 type TCPConnMap struct {
 	conns map[string]TCPConn
+	ttl   time.Duration
 	mu    sync.RWMutex
 }
 
-func NewTCPConnMap() TCPConnMap {
+func NewTCPConnMap(ttl time.Duration) TCPConnMap {
 	return TCPConnMap{
 		conns: make(map[string]TCPConn),
+		ttl:   ttl,
+	}
+}
+
+// NewId returns an id that no waiting conn has, nor one that taken reports,
+// e.g. of the conns already claimed.
+func (c *TCPConnMap) NewId(taken func(id string) bool) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for {
+		id := NewId()
+		if _, ok := c.conns[id]; !ok && !taken(id) {
+			return id
+		}
 	}
 }
 
-func (c *TCPConnMap) Add(id string, conn net.Conn) {
+// Add stores a user conn accepted on the proxy port until the client claims
+// it, false when a waiting conn already has the id.
+func (c *TCPConnMap) Add(id string, conn io.ReadWriteCloser, port int) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if _, ok := c.conns[id]; ok {
+		return false
+	}
 	c.conns[id] = TCPConn{
-		conn: conn,
-		t:    time.Now(),
+		conn:   conn,
+		expire: time.Now().Add(c.ttl),
+		port:   port,
 	}
+	return true
 }
 
-func (c *TCPConnMap) Get(id string) (io.ReadWriteCloser, bool) {
+// Get claims the user conn and returns it with the proxy port it was accepted
+// on, a claimed conn is removed and never expires.
+func (c *TCPConnMap) Get(id string) (io.ReadWriteCloser, int, bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	conn, ok := c.conns[id]
-	return conn.conn, ok
+	delete(c.conns, id)
+	return conn.conn, conn.port, ok
+}
+
+// Release closes the user conn of the proxy port as if it expired, for a
+// client that can't claim it. False when no conn of port waits with the id.
+func (c *TCPConnMap) Release(id string, port int) bool {
+	c.mu.Lock()
+	conn, ok := c.conns[id]
+	if ok && conn.port == port {
+		delete(c.conns, id)
+	}
+	c.mu.Unlock()
+	if !ok || conn.port != port {
+		return false
+	}
+	expire(conn.conn)
+	return true
+}
+
+// expire answers a conn that is an Expirer, others are closed.
+func expire(conn io.ReadWriteCloser) {
+	if e, ok := conn.(Expirer); ok {
+		e.Expire()
+	} else {
+		conn.Close()
+	}
 }
 
 func (c *TCPConnMap) Del(id string) {
@@ -45,19 +105,31 @@ func (c *TCPConnMap) Del(id string) {
 	delete(c.conns, id)
 }
 
-func (c *TCPConnMap) StartAutoExpire() {
-	expire := func() {
+func (c *TCPConnMap) StartAutoExpire(log *logger.Logger) {
+	sweep := func() {
+		expired := make(map[string]TCPConn)
 		c.mu.Lock()
-		defer c.mu.Unlock()
+		now := time.Now()
 		for id, conn := range c.conns {
-			if time.Since(conn.t) > time.Second*10 {
+			if now.After(conn.expire) {
+				expired[id] = conn
 				delete(c.conns, id)
 			}
 		}
+		c.mu.Unlock()
+
+		// answering a conn writes to it, not under the lock
+		for id, conn := range expired {
+			// never claimed by the client, release the fd
+			log.WithConnId(id).Debugf("User conn on port %d not claimed by client within %s, closed", conn.port, c.ttl)
+			expire(conn.conn)
+		}
 	}
 
-	ticker := time.NewTicker(time.Second * 10)
+	// conns live at most half a ttl longer than it
+	ticker := time.NewTicker(c.ttl / 2)
+	defer ticker.Stop()
 	for range ticker.C {
-		expire()
+		sweep()
 	}
 }
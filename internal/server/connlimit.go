@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/abcdlsj/gnar/internal/logger"
+)
+
+const (
+	overflowReject = "reject"
+	overflowQueue  = "queue"
+
+	// connQueueTimeout is how long a queued user conn waits for a free slot.
+	connQueueTimeout = 10 * time.Second
+)
+
+func validOverflow(overflow string) error {
+	switch overflow {
+	case "", overflowReject, overflowQueue:
+		return nil
+	default:
+		return fmt.Errorf("invalid overflow: %s, expected reject or queue", overflow)
+	}
+}
+
+// connLimit caps the concurrent user conns of a proxy, conns over the cap
+// are closed or wait for a slot by the overflow of the proxy. A nil limit
+// is unlimited.
+type connLimit struct {
+	slots chan struct{}
+	queue bool
+}
+
+func newConnLimit(max int, overflow string) *connLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &connLimit{
+		slots: make(chan struct{}, max),
+		queue: overflow == overflowQueue,
+	}
+}
+
+func (l *connLimit) acquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if !l.queue {
+		return false
+	}
+
+	t := time.NewTimer(connQueueTimeout)
+	defer t.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+func (l *connLimit) release() {
+	<-l.slots
+}
+
+// admit takes a slot for userConn, released when the returned conn is closed.
+// It closes userConn and reports false when the cap is hit.
+func (l *connLimit) admit(userConn net.Conn, uPort int, log *logger.Logger) (net.Conn, bool) {
+	if l == nil {
+		return userConn, true
+	}
+
+	if !l.acquire() {
+		log.Warnf("Max conns %d of port %d reached, drop user conn from %s", cap(l.slots), uPort, userConn.RemoteAddr())
+		userConn.Close()
+		return nil, false
+	}
+	return &limitedConn{Conn: userConn, release: l.release}, true
+}
+
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// EdgeCert is the certificate the server terminates the tls of the tls
+// proxys of Hostname with, "*.example.com" covers the names one label below.
+type EdgeCert struct {
+	Hostname string `mapstructure:"hostname"`
+	CertFile string `mapstructure:"cert-file"`
+	KeyFile  string `mapstructure:"key-file"`
+}
+
+func validEdgeCerts(cfg Config) error {
+	hosts := make(map[string]bool)
+	for i, c := range cfg.EdgeCerts {
+		if c.Hostname == "" || c.CertFile == "" || c.KeyFile == "" {
+			return fmt.Errorf("edge cert #%d needs a hostname, cert file and key file", i)
+		}
+		if err := validHostname(strings.TrimPrefix(c.Hostname, "*.")); err != nil {
+			return fmt.Errorf("invalid edge cert #%d: %v", i, err)
+		}
+		host := strings.ToLower(c.Hostname)
+		if hosts[host] {
+			return fmt.Errorf("duplicate edge cert: %s", c.Hostname)
+		}
+		hosts[host] = true
+	}
+	for _, host := range cfg.ACMEHosts {
+		if err := validHostname(strings.TrimPrefix(host, "*.")); err != nil {
+			return fmt.Errorf("invalid acme host: %v", err)
+		}
+	}
+	if len(cfg.ACMEHosts) > 0 && !cfg.ACME {
+		return errors.New("acme hosts need acme")
+	}
+	if cfg.AdminTLS && len(cfg.EdgeCerts) == 0 && !cfg.ACME {
+		return errors.New("admin tls needs edge certs or acme")
+	}
+	if (len(cfg.EdgeCerts) > 0 || cfg.ACME) && cfg.HTTPSPort == 0 && !cfg.AdminTLS {
+		return errors.New("edge certs and acme need the https port or admin tls")
+	}
+	if cfg.ACME && cfg.HTTPSPort == 0 && cfg.HTTPPort == 0 {
+		return errors.New("acme needs the https port or the http port to answer its challenges")
+	}
+	return nil
+}
+
+func equalEdgeCerts(a, b []EdgeCert) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// edgeCerts are the certificates of the tls proxys the server terminates,
+// of the http proxys served on the https port and of the admin server, the
+// static ones first, then the ones of the acme manager.
+type edgeCerts struct {
+	certs     map[string]*tls.Certificate // by lower case hostname or wildcard
+	acme      *autocert.Manager
+	acmeHosts map[string]bool // of acme-hosts, by lower case hostname or wildcard
+	challenge http.Handler    // answers the http-01 challenges on the http port, nil without one
+	tls       *tls.Config
+}
+
+// loadEdgeCerts loads the edge certs of cfg, nil when it has none and no
+// acme. The acme manager gets certificates for the acme hosts and the
+// hostnames allowed reports, the ones of registered proxys that terminate
+// tls.
+func loadEdgeCerts(cfg Config, allowed func(host string) bool) (*edgeCerts, error) {
+	if len(cfg.EdgeCerts) == 0 && !cfg.ACME {
+		return nil, nil
+	}
+	e := &edgeCerts{certs: make(map[string]*tls.Certificate), acmeHosts: make(map[string]bool)}
+	for _, c := range cfg.EdgeCerts {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading edge cert of %s: %v", c.Hostname, err)
+		}
+		e.certs[strings.ToLower(c.Hostname)] = &cert
+	}
+	for _, host := range cfg.ACMEHosts {
+		e.acmeHosts[strings.ToLower(host)] = true
+	}
+	if cfg.ACME {
+		e.acme = &autocert.Manager{
+			Prompt: autocert.AcceptTOS,
+			Cache:  autocert.DirCache(cfg.ACMECacheDir),
+			Email:  cfg.ACMEEmail,
+			HostPolicy: func(_ context.Context, host string) error {
+				if !e.listed(host) && !allowed(strings.ToLower(host)) {
+					return fmt.Errorf("no acme host or tls proxy terminating %s", host)
+				}
+				return nil
+			},
+		}
+		if cfg.ACMEDirectory != "" {
+			e.acme.Client = &acme.Client{DirectoryURL: cfg.ACMEDirectory}
+		}
+		if cfg.HTTPPort != 0 {
+			// also enables the http-01 challenges, not only tls-alpn-01
+			e.challenge = e.acme.HTTPHandler(http.NotFoundHandler())
+		}
+	}
+
+	// no alpn, the local service speaks whatever the users ask for over
+	// plain conns, only the acme challenges get theirs
+	e.tls = &tls.Config{
+		GetCertificate: e.getCertificate,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if e.acme == nil {
+				return nil, nil
+			}
+			for _, p := range hello.SupportedProtos {
+				if p == acme.ALPNProto {
+					return &tls.Config{GetCertificate: e.acme.GetCertificate, NextProtos: []string{acme.ALPNProto}}, nil
+				}
+			}
+			return nil, nil
+		},
+	}
+	return e, nil
+}
+
+// cert is the static certificate of host, an exact one before a wildcard.
+func (e *edgeCerts) cert(host string) *tls.Certificate {
+	host = strings.ToLower(host)
+	if cert, ok := e.certs[host]; ok {
+		return cert
+	}
+	if _, parent, ok := strings.Cut(host, "."); ok {
+		return e.certs["*."+parent]
+	}
+	return nil
+}
+
+// listed tells if host is one of the acme hosts, a wildcard covers the names
+// one label below.
+func (e *edgeCerts) listed(host string) bool {
+	host = strings.ToLower(host)
+	if e.acmeHosts[host] {
+		return true
+	}
+	_, parent, ok := strings.Cut(host, ".")
+	return ok && e.acmeHosts["*."+parent]
+}
+
+// serves tells if the server terminates the tls of host without a tls proxy,
+// for the http proxys on the https port and the admin server.
+func (e *edgeCerts) serves(host string) bool {
+	return e.cert(host) != nil || e.acme != nil && e.listed(host)
+}
+
+// covers tells if the server can present a certificate for host, with acme
+// it gets one on the first handshake.
+func (e *edgeCerts) covers(host string) bool {
+	return e.cert(host) != nil || e.acme != nil
+}
+
+func (e *edgeCerts) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := e.cert(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	if e.acme != nil {
+		return e.acme.GetCertificate(hello)
+	}
+	return nil, fmt.Errorf("no edge cert for %s", hello.ServerName)
+}
+
+// terminatesTLS tells if host is a registered tls proxy whose tls the server
+// terminates, for the acme host policy.
+func (s *Server) terminatesTLS(host string) bool {
+	proxy, ok := s.resources.vhost("tls", host)
+	return ok && proxy.TerminateTLS
+}
+
+// terminateTLS completes the tls handshake of a user conn of a tls proxy
+// with its edge cert and returns the plain conn. Conns of acme challenges
+// are done with the handshake, they return false like failed ones.
+func (s *Server) terminateTLS(conn net.Conn) (net.Conn, bool) {
+	tlsConn := tls.Server(conn, s.edge.tls)
+	ctx, cancel := context.WithTimeout(context.Background(), sniReadTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		s.log.Debugf("Error in tls handshake of user conn from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return nil, false
+	}
+	if tlsConn.ConnectionState().NegotiatedProtocol == acme.ALPNProto {
+		s.log.Debugf("Answered acme challenge for %s", tlsConn.ConnectionState().ServerName)
+		tlsConn.Close()
+		return nil, false
+	}
+	return tlsConn, true
+}
+
+// isACMEChallenge tells if req is a http-01 challenge of the acme manager, it
+// is answered by the server, not proxyed to a client.
+func (s *Server) isACMEChallenge(req *http.Request) bool {
+	return s.edge != nil && s.edge.challenge != nil && strings.HasPrefix(req.URL.Path, "/.well-known/acme-challenge/")
+}
+
+// serveACMEChallenge answers the http-01 challenge req read from conn and
+// closes it.
+func (s *Server) serveACMEChallenge(conn net.Conn, req *http.Request) {
+	defer conn.Close()
+	w := &challengeResponse{header: make(http.Header), code: http.StatusOK}
+	s.edge.challenge.ServeHTTP(w, req)
+	resp := &http.Response{
+		StatusCode:    w.code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          io.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Close:         true,
+	}
+	if err := resp.Write(conn); err != nil {
+		s.log.Debugf("Error answering acme challenge to %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// challengeResponse is the http.ResponseWriter of an acme challenge.
+type challengeResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *challengeResponse) Header() http.Header         { return w.header }
+func (w *challengeResponse) Write(p []byte) (int, error) { return w.body.Write(p) }
+func (w *challengeResponse) WriteHeader(code int)        { w.code = code }
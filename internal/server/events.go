@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/abcdlsj/gnar/internal/logger"
+)
+
+const (
+	eventProxyAdd     = "proxy_add"
+	eventProxyRemove  = "proxy_remove"
+	eventProxyReclaim = "proxy_reclaim"
+	eventTraffic      = "traffic"
+
+	reclaimDisconnect = "disconnect"
+	reclaimHeartbeat  = "heartbeat_timeout"
+	reclaimCancel     = "cancel"
+
+	// eventBufSize is how many events a subscriber may fall behind before it is dropped.
+	eventBufSize      = 64
+	eventKeepAlive    = 15 * time.Second
+	eventWriteTimeout = 5 * time.Second
+)
+
+type event struct {
+	Type string
+	Data any
+}
+
+// reclaimEvent tells that a client left the proxy on port without canceling
+// it, the proxy is removed too when it was the last client.
+type reclaimEvent struct {
+	Port    int    `json:"port"`
+	From    string `json:"from"`
+	Reason  string `json:"reason"`
+	Removed bool   `json:"removed"`
+}
+
+// eventBus fans out resource changes to admin subscribers, publish never
+// blocks, subscribers that can't keep up are dropped.
+type eventBus struct {
+	subs map[chan event]struct{}
+	log  *logger.Logger
+	mu   sync.Mutex
+}
+
+func newEventBus(log *logger.Logger) *eventBus {
+	return &eventBus{
+		subs: make(map[chan event]struct{}),
+		log:  log,
+	}
+}
+
+func (b *eventBus) subscribe() chan event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan event, eventBufSize)
+	b.subs[ch] = struct{}{}
+	return ch
+}
+
+func (b *eventBus) unsubscribe(ch chan event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+func (b *eventBus) publish(typ string, data any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- event{Type: typ, Data: data}:
+		default:
+			b.log.Warn("Admin event subscriber too slow, dropped")
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// serveEvents streams the events as server-sent events until the client
+// goes away, it is dropped by the bus or the server shuts down.
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+
+	ch := s.resources.events.subscribe()
+	defer s.resources.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		s.log.Errorf("Admin events streaming unsupported: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+
+	write := func(p []byte) error {
+		// a stalled reader must not hold the handler forever
+		rc.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	for {
+		var buf []byte
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.closing:
+			return
+		case <-ticker.C:
+			buf = []byte(": keepalive\n\n")
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e.Data)
+			if err != nil {
+				s.log.Errorf("Marshal admin event error: %v", err)
+				continue
+			}
+			buf = []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", e.Type, data))
+		}
+
+		if err := write(buf); err != nil {
+			s.log.Debugf("Admin event subscriber gone: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/abcdlsj/gnar/internal/logger"
+	"github.com/abcdlsj/gnar/pkg/proto"
+	"github.com/hashicorp/yamux"
+)
+
+// reclaimSession removes the client from the proxys registered over the
+// streams of session at once when the session is gone, instead of waiting for
+// each stream to notice.
+func (s *Server) reclaimSession(session *yamux.Session, conn net.Conn) {
+	ports := s.resources.removeCtrls(func(ctrl net.Conn) bool {
+		stream, ok := ctrl.(*yamux.Stream)
+		return ok && stream.Session() == session
+	}, reclaimDisconnect)
+	for _, port := range ports {
+		s.log.Infof("Client %s disconnected, proxy port %d reclaimed", conn.RemoteAddr(), port)
+	}
+}
+
+func tickHeart(cConn net.Conn, interval time.Duration, hlogger *logger.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := proto.Send(cConn, proto.NewMsgHeartbeat()); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				hlogger.Warnf("Error sending heartbeat message: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// watchHeartbeat reads heartbeats sent by the client on the control connection,
+// the client is removed from the proxy when the connection is closed or no
+// packet is read within the timeout. A timed out connection is half-open,
+// e.g. a NAT dropped it silently, and is closed. The exchange fails of the
+// client release their user conns, other packets only count as alive.
+func (s *Server) watchHeartbeat(cConn net.Conn, uPort int, hlogger *logger.Logger) {
+	for {
+		if s.cfg.HeartbeatTimeout > 0 {
+			cConn.SetReadDeadline(time.Now().Add(s.cfg.HeartbeatTimeout))
+		}
+		pt, buf, err := proto.Read(cConn)
+		if err == nil {
+			switch pt {
+			case proto.PacketExchangeFail:
+				s.releaseExchange(buf, uPort, hlogger)
+			case proto.PacketProxyCancel:
+				// the client shuts down, only its own proxy is released
+				if s.resources.removeCtrlProxy(uPort, cConn, reclaimCancel) {
+					hlogger.Infof("Proxy canceled, client of proxy port %d removed", uPort)
+				}
+				cConn.Close()
+				return
+			}
+			continue
+		}
+
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			if s.resources.removeCtrlProxy(uPort, cConn, reclaimHeartbeat) {
+				hlogger.Warnf("Heartbeat timeout after %s, client of proxy port %d removed", s.cfg.HeartbeatTimeout, uPort)
+			}
+			cConn.Close()
+			return
+		}
+
+		hlogger.Debugf("Stop reading control connection: %v", err)
+		if s.resources.removeCtrlProxy(uPort, cConn, reclaimDisconnect) {
+			hlogger.Infof("Control connection closed, client of proxy port %d removed", uPort)
+		}
+		return
+	}
+}
+
+// releaseExchange closes the user conn of an exchange the client of uPort
+// failed, instead of letting it wait for the exchange timeout.
+func (s *Server) releaseExchange(buf []byte, uPort int, hlogger *logger.Logger) {
+	msg, err := proto.Unmarshal(proto.PacketExchangeFail, buf)
+	if err != nil {
+		hlogger.Debugf("Invalid exchange fail msg: %v", err)
+		return
+	}
+	fail := msg.(*proto.MsgExchangeFail)
+	clogger := hlogger.WithConnId(fail.ConnId)
+	if !s.tcpConnMap.Release(fail.ConnId, uPort) {
+		clogger.Debugf("No user conn of port %d to release", uPort)
+		return
+	}
+	clogger.Warnf("Client failed to claim user conn on port %d: %q", uPort, fail.Reason)
+}
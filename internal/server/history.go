@@ -0,0 +1,90 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/abcdlsj/gnar/internal/metrics"
+)
+
+const (
+	historyInterval = 10 * time.Second
+	historySamples  = 90 // 15 minutes of historyInterval samples
+)
+
+// trafficSample is the traffic of the conns that ended within one interval
+// starting at Time, a long conn counts in the interval it ended in.
+type trafficSample struct {
+	Time          time.Time `json:"time"`
+	UpwardBytes   int64     `json:"upward_bytes"`
+	DownwardBytes int64     `json:"downward_bytes"`
+}
+
+type trafficSeries struct {
+	Port    int             `json:"port"`
+	Samples []trafficSample `json:"samples"` // oldest first, one per interval
+}
+
+type historySlot struct {
+	bucket        int64 // interval number since the epoch, a slot of another one is stale
+	upwardBytes   int64
+	downwardBytes int64
+}
+
+// historyRing keeps the last historySamples intervals of a port, interval n
+// is at slot n % historySamples.
+type historyRing struct {
+	slots [historySamples]historySlot
+	last  int64 // latest interval with traffic
+}
+
+func historyBucket(t time.Time) int64 {
+	return t.UnixNano() / int64(historyInterval)
+}
+
+func (r *historyRing) add(t metrics.Traffic) {
+	b := historyBucket(t.EndTime)
+	slot := &r.slots[b%historySamples]
+	if slot.bucket != b {
+		*slot = historySlot{bucket: b}
+	}
+	slot.upwardBytes += t.UpwardBytes
+	slot.downwardBytes += t.DownwardBytes
+	if b > r.last {
+		r.last = b
+	}
+}
+
+// samples returns the intervals up to now, no traffic reads as zeros.
+func (r *historyRing) samples(now int64) []trafficSample {
+	samples := make([]trafficSample, 0, historySamples)
+	for b := now - historySamples + 1; b <= now; b++ {
+		sample := trafficSample{Time: time.Unix(0, b*int64(historyInterval))}
+		if slot := r.slots[b%historySamples]; slot.bucket == b {
+			sample.UpwardBytes = slot.upwardBytes
+			sample.DownwardBytes = slot.downwardBytes
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// history returns the samples of the ports with traffic in the window,
+// ordered by port. The rings of the others are dropped.
+func (ts *trafficStats) history() []trafficSeries {
+	now := historyBucket(time.Now())
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	series := make([]trafficSeries, 0, len(ts.rings))
+	for port, ring := range ts.rings {
+		if ring.last <= now-historySamples {
+			delete(ts.rings, port)
+			continue
+		}
+		series = append(series, trafficSeries{Port: port, Samples: ring.samples(now)})
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Port < series[j].Port })
+	return series
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/abcdlsj/gnar/internal/auth"
+)
+
+// startListeners accepts control conns on the extra listeners, they are
+// served like the ones of the server port with the token and port range of
+// their listener.
+func (s *Server) startListeners() error {
+	for i := range s.cfg.Listeners {
+		lc := &s.cfg.Listeners[i]
+		listener, err := s.createListener(lc.Port)
+		if err != nil {
+			return err
+		}
+		s.serveAcceptor(listener, lc, fmt.Sprintf("port %d", lc.Port))
+	}
+	return nil
+}
+
+// apply returns cfg with the token and port range of the listener, nil is
+// the server port and keeps cfg.
+func (lc *ListenerConfig) apply(cfg Config) Config {
+	if lc == nil {
+		return cfg
+	}
+	if lc.Token != "" {
+		cfg.Token = lc.Token
+	}
+	if lc.MinPort != 0 {
+		cfg.MinPort = lc.MinPort
+	}
+	if lc.MaxPort != 0 {
+		cfg.MaxPort = lc.MaxPort
+	}
+	return cfg
+}
+
+// id tells the listener apart from the others, their ports are unique, 0
+// is the server port. Clients of one listener can't touch the proxys of
+// another.
+func (lc *ListenerConfig) id() int {
+	if lc == nil {
+		return 0
+	}
+	return lc.Port
+}
+
+// listenerAuth verifies the logins of the listener, ones with a token accept
+// only it.
+func (s *Server) listenerAuth(lc *ListenerConfig) auth.Authenticator {
+	if lc == nil || lc.Token == "" {
+		return s.auth()
+	}
+	return auth.NewTokenAuthenticator(lc.Token)
+}
+
+func validateListeners(cfg Config, ports map[int]string) error {
+	for _, lc := range cfg.Listeners {
+		if lc.Port < 1 || lc.Port > 65535 {
+			return fmt.Errorf("invalid port: %d", lc.Port)
+		}
+		if other, ok := ports[lc.Port]; ok {
+			return fmt.Errorf("port %d is already used by %s", lc.Port, other)
+		}
+		ports[lc.Port] = "listener"
+
+		c := lc.apply(cfg)
+		if c.MinPort < 1 || c.MaxPort > 65535 || c.MinPort > c.MaxPort {
+			return fmt.Errorf("invalid port range of port %d: %d-%d", lc.Port, c.MinPort, c.MaxPort)
+		}
+	}
+	return nil
+}
+
+func equalListeners(a, b []ListenerConfig) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"strings"
+	"unicode"
+)
+
+// maxNameLen is the longest proxy name kept, in runes.
+const maxNameLen = 64
+
+// sanitizeName drops the control and other non printable runes of a client
+// proxy name and caps its length, it is shown in logs, the admin page and apis.
+func sanitizeName(name string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range strings.TrimSpace(name) {
+		if !unicode.IsPrint(r) {
+			continue
+		}
+		if n == maxNameLen {
+			break
+		}
+		b.WriteRune(r)
+		n++
+	}
+	return b.String()
+}
+
+func displayName(name string) string {
+	if name == "" {
+		return "<unnamed>"
+	}
+	return name
+}
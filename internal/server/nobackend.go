@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+const noBackendWriteTimeout = 5 * time.Second
+
+// defaultNoBackendPage is the body of the 502 response without a
+// no-backend-page.
+const defaultNoBackendPage = `<!DOCTYPE html>
+<html>
+<head><title>502 Tunnel Offline</title></head>
+<body>
+<h1>Tunnel Offline</h1>
+<p>The service behind this address is not connected right now, please try again later.</p>
+</body>
+</html>
+`
+
+// noBackendResponse is the http response sent to the users of http proxys
+// no client serves, nil when no-backend-response is off.
+func noBackendResponse(cfg Config) ([]byte, error) {
+	if !cfg.NoBackendResponse {
+		return nil, nil
+	}
+	page := []byte(defaultNoBackendPage)
+	if cfg.NoBackendPage != "" {
+		var err error
+		if page, err = os.ReadFile(cfg.NoBackendPage); err != nil {
+			return nil, fmt.Errorf("error reading no-backend-page: %v", err)
+		}
+	}
+	header := fmt.Sprintf("HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n", len(page))
+	return append([]byte(header), page...), nil
+}
+
+// dropNoBackend closes a user conn no client takes, users of http proxys get
+// the no backend response first.
+func (s *Server) dropNoBackend(proxyType string, userConn io.WriteCloser) {
+	if s.noBackend != nil && proxyType == "http" {
+		if c, ok := userConn.(net.Conn); ok {
+			c.SetWriteDeadline(time.Now().Add(noBackendWriteTimeout))
+		}
+		userConn.Write(s.noBackend)
+	}
+	userConn.Close()
+}
+
+// noBackendConn is a user conn waiting for its client, it gets the no
+// backend response when the client does not claim it in time.
+type noBackendConn struct {
+	io.ReadWriteCloser
+	user io.WriteCloser // the accepted conn, the response skips the header rules
+	s    *Server
+}
+
+func (c *noBackendConn) Expire() error {
+	c.s.dropNoBackend("http", c.user)
+	return c.ReadWriteCloser.Close()
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/abcdlsj/gnar/internal/metrics"
+)
+
+// loadTraffics restores the traffic totals saved by the last run.
+func (s *Server) loadTraffics() error {
+	if s.cfg.MetricsFile == "" {
+		return nil
+	}
+
+	summaries, err := metrics.LoadSummaries(s.cfg.MetricsFile)
+	if err != nil {
+		return fmt.Errorf("error loading metrics file: %v", err)
+	}
+	s.resources.setSavedTraffics(summaries)
+	s.log.Infof("Loaded traffic of %d ports from %s", len(summaries), s.cfg.MetricsFile)
+	return nil
+}
+
+func (s *Server) startTrafficFlusher() {
+	if s.cfg.MetricsFile == "" || s.cfg.MetricsFlushInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.cfg.MetricsFlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.closing:
+				return
+			case <-ticker.C:
+				s.flushTraffics()
+			}
+		}
+	}()
+}
+
+func (s *Server) flushTraffics() {
+	if s.cfg.MetricsFile == "" {
+		return
+	}
+
+	s.resources.traffics.sync()
+	if err := metrics.SaveSummaries(s.cfg.MetricsFile, s.resources.listTraffics()); err != nil {
+		s.log.Errorf("Error saving metrics file: %v", err)
+		return
+	}
+	s.log.Debugf("Traffic saved to %s", s.cfg.MetricsFile)
+}
+
+func (rm *resourceManager) setSavedTraffics(summaries []metrics.TrafficSummary) {
+	rm.m.Lock()
+	defer rm.m.Unlock()
+	rm.savedTraffics = summaries
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/abcdlsj/gnar/pkg/proto"
+)
+
+// validPortRange checks the remote ports of a range registration, from the
+// remote port to the remote port end.
+func validPortRange(cfg Config, msg *proto.MsgProxyReq) error {
+	start, end := msg.RemotePort, msg.RemotePortEnd
+	if msg.ProxyType != "tcp" {
+		return fmt.Errorf("port range is not supported by %s proxy", msg.ProxyType)
+	}
+	if start <= 0 || end <= start || end > 65535 {
+		return fmt.Errorf("invalid port range: %d-%d", start, end)
+	}
+	if cfg.MaxPortRange == 0 {
+		return errors.New("port ranges are disabled on server")
+	}
+	if end-start+1 > cfg.MaxPortRange {
+		return fmt.Errorf("port range %d-%d is over the max of %d ports", start, end, cfg.MaxPortRange)
+	}
+	if !cfg.allowedPort(end) {
+		return fmt.Errorf("port %d not allowed, server allows ports %d-%d", end, cfg.MinPort, cfg.MaxPort)
+	}
+	if len(cfg.Proxys) > 0 {
+		return errors.New("port range is not supported with reserved proxys")
+	}
+	return nil
+}
+
+// rangeProxyHandler serves the ports of a range as one proxy, every port has
+// its listener and the user conns of all of them go to the same clients.
+type rangeProxyHandler struct {
+	ports []*tcpProxyHandler
+}
+
+func (s *Server) createRangeHandler(family, host string, start, end int, acl *ipACL) *rangeProxyHandler {
+	h := &rangeProxyHandler{}
+	for port := start; port <= end; port++ {
+		h.ports = append(h.ports, &tcpProxyHandler{host, port, acl, s.cfg.KeepAlive, family, s.cfg.ReusePort, s.cfg.ListenBacklog})
+	}
+	return h
+}
+
+// listen binds all ports or none of them.
+func (h *rangeProxyHandler) listen() (interface{}, error) {
+	listeners := rangeListener{}
+	for _, p := range h.ports {
+		l, err := p.listen()
+		if err != nil {
+			listeners.Close()
+			return nil, fmt.Errorf("port %d: %w", p.uPort, err)
+		}
+		listeners = append(listeners, l.(net.Listener))
+	}
+	return listeners, nil
+}
+
+func (h *rangeProxyHandler) handleConn(s *Server, listener interface{}, backends *backendGroup) error {
+	listeners := listener.(rangeListener)
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		go func(p *tcpProxyHandler, l net.Listener) {
+			errs <- p.handleConn(s, l, backends)
+		}(h.ports[i], l)
+	}
+
+	var err error
+	for range listeners {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// rangeListener closes the listeners of a port range together.
+type rangeListener []net.Listener
+
+func (l rangeListener) Close() error {
+	for _, listener := range l {
+		listener.Close()
+	}
+	return nil
+}
+
+// ports returns the remote ports of the proxy, more than one for a range.
+func (p Proxy) ports() []int {
+	if p.PortEnd == 0 {
+		return []int{p.Port}
+	}
+	ports := make([]int, 0, p.PortEnd-p.Port+1)
+	for port := p.Port; port <= p.PortEnd; port++ {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// portLabel is the port of the proxy for display, start-end for a range.
+func (p Proxy) portLabel() string {
+	if p.PortEnd == 0 {
+		return strconv.Itoa(p.Port)
+	}
+	return fmt.Sprintf("%d-%d", p.Port, p.PortEnd)
+}
+
+func (p Proxy) hasPort(port int) bool {
+	return port == p.Port || (p.PortEnd != 0 && port > p.Port && port <= p.PortEnd)
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/abcdlsj/gnar/pkg/share"
+	"github.com/quic-go/quic-go"
+)
+
+// quicMaxStreams bounds the open streams of a quic connection, every
+// control conn and user conn of the client is one.
+const quicMaxStreams = 10000
+
+// startQUICServer accepts clients over quic on the udp quic port. Every
+// stream of a quic connection is handled like a control conn of the server
+// port, so the user conns don't block each other on a lossy link.
+func (s *Server) startQUICServer() error {
+	if s.cfg.QUICPort == 0 {
+		return nil
+	}
+	if s.tlsCfg == nil {
+		return errors.New("quic-port needs tls, set tls-cert-file and tls-key-file")
+	}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: s.cfg.QUICPort})
+	if err != nil {
+		return fmt.Errorf("error listening quic port: %v", err)
+	}
+	tr := &quic.Transport{Conn: udpConn}
+	tlsCfg := s.tlsCfg.Clone()
+	tlsCfg.NextProtos = []string{share.QUICProto}
+	listener, err := tr.Listen(tlsCfg, &quic.Config{
+		KeepAlivePeriod:    s.cfg.KeepAlive,
+		MaxIncomingStreams: quicMaxStreams,
+	})
+	if err != nil {
+		tr.Close()
+		return fmt.Errorf("error listening quic port: %v", err)
+	}
+
+	s.mu.Lock()
+	s.quicTransport = tr
+	s.quicListener = listener
+	s.mu.Unlock()
+
+	s.log.Infof("Quic server listening on udp port %d", s.cfg.QUICPort)
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				if !s.isClosing() {
+					s.log.Errorf("Error accepting quic conn: %v", err)
+				}
+				return
+			}
+			go s.handleQUICConn(conn)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) handleQUICConn(conn quic.Connection) {
+	s.log.Debugf("New quic connection, client addr: %s", conn.RemoteAddr())
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			s.log.Debugf("Quic connection of %s closed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		// the streams log in one by one, like the conns of the server port
+		qconn := share.NewQUICConn(stream, conn)
+		if s.closeBanned(qconn) {
+			conn.CloseWithError(0, "banned")
+			return
+		}
+		go s.handle(qconn, nil, clientID(qconn), nil)
+	}
+}
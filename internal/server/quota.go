@@ -0,0 +1,183 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// ClientQuota bounds one client across all its proxys, 0 and empty mean
+// unlimited. The client is the id the Authorizer gets, the common name of
+// its verified certificate or its ip.
+type ClientQuota struct {
+	Client     string `mapstructure:"client"`
+	MaxProxys  int    `mapstructure:"max-proxys"`  // proxys served, joined load balanced ones included
+	MaxConns   int    `mapstructure:"max-conns"`   // concurrent tcp user conns
+	TrafficCap string `mapstructure:"traffic-cap"` // bytes of the tcp user conns since the server started
+}
+
+// clientQuota is the quota of client, the fields of its [[client-quotas]]
+// entry override the client-* defaults.
+func (cfg Config) clientQuota(client string) ClientQuota {
+	q := ClientQuota{
+		Client:     client,
+		MaxProxys:  cfg.ClientMaxProxys,
+		MaxConns:   cfg.ClientMaxConns,
+		TrafficCap: cfg.ClientTrafficCap,
+	}
+	for _, cq := range cfg.ClientQuotas {
+		if cq.Client != client {
+			continue
+		}
+		if cq.MaxProxys != 0 {
+			q.MaxProxys = cq.MaxProxys
+		}
+		if cq.MaxConns != 0 {
+			q.MaxConns = cq.MaxConns
+		}
+		if cq.TrafficCap != "" {
+			q.TrafficCap = cq.TrafficCap
+		}
+	}
+	return q
+}
+
+func hasClientQuotas(cfg Config) bool {
+	return cfg.ClientMaxProxys > 0 || cfg.ClientMaxConns > 0 || cfg.ClientTrafficCap != "" || len(cfg.ClientQuotas) > 0
+}
+
+func validClientQuotas(cfg Config) error {
+	quotas := append([]ClientQuota{{
+		Client:     "default",
+		MaxProxys:  cfg.ClientMaxProxys,
+		MaxConns:   cfg.ClientMaxConns,
+		TrafficCap: cfg.ClientTrafficCap,
+	}}, cfg.ClientQuotas...)
+
+	clients := make(map[string]bool)
+	for i, q := range quotas {
+		if i > 0 {
+			if q.Client == "" {
+				return fmt.Errorf("client quota #%d has no client", i)
+			}
+			if clients[q.Client] {
+				return fmt.Errorf("duplicate client quota: %s", q.Client)
+			}
+			clients[q.Client] = true
+		}
+		if q.MaxProxys < 0 || q.MaxConns < 0 {
+			return fmt.Errorf("invalid quota of client %s: max proxys %d, max conns %d", q.Client, q.MaxProxys, q.MaxConns)
+		}
+		if _, err := parseBytes(q.TrafficCap); err != nil {
+			return fmt.Errorf("invalid traffic cap of client %s: %v", q.Client, err)
+		}
+	}
+	return nil
+}
+
+// clientUsage is what one client uses of its quota right now.
+type clientUsage struct {
+	conns atomic.Int64
+	bytes atomic.Int64
+}
+
+// clientUsages holds the usage of every client that had a tcp user conn,
+// the bytes are kept until the server stops.
+type clientUsages struct {
+	usages map[string]*clientUsage
+	mu     sync.Mutex
+}
+
+func newClientUsages() *clientUsages {
+	return &clientUsages{usages: make(map[string]*clientUsage)}
+}
+
+func (cu *clientUsages) get(client string) *clientUsage {
+	cu.mu.Lock()
+	defer cu.mu.Unlock()
+	u, ok := cu.usages[client]
+	if !ok {
+		u = &clientUsage{}
+		cu.usages[client] = u
+	}
+	return u
+}
+
+// track counts the bytes of conn to u, its conn is already counted and is
+// released when it is closed.
+func (u *clientUsage) track(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	return &quotaConn{deadlineConn: deadlineConn{conn}, usage: u}
+}
+
+type quotaConn struct {
+	deadlineConn
+	usage *clientUsage
+	once  sync.Once
+}
+
+func (c *quotaConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.usage.bytes.Add(int64(n))
+	return n, err
+}
+
+func (c *quotaConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.usage.bytes.Add(int64(n))
+	return n, err
+}
+
+func (c *quotaConn) Close() error {
+	c.once.Do(func() { c.usage.conns.Add(-1) })
+	return c.ReadWriteCloser.Close()
+}
+
+// clientProxys counts the proxys client serves.
+func (rm *resourceManager) clientProxys(client string) int {
+	n := 0
+	for _, p := range rm.listProxys() {
+		for _, b := range p.backends.list() {
+			if b.client == client {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// checkClientQuota rejects a new proxy of a client over its quota.
+func (s *Server) checkClientQuota(client string) error {
+	cfg := s.config()
+	if !hasClientQuotas(cfg) {
+		return nil
+	}
+	q := cfg.clientQuota(client)
+	if q.MaxProxys > 0 && s.resources.clientProxys(client) >= q.MaxProxys {
+		return fmt.Errorf("client %s reached its quota of %d proxys", client, q.MaxProxys)
+	}
+	if limit, _ := parseBytes(q.TrafficCap); limit > 0 && s.clients.get(client).bytes.Load() >= limit {
+		return fmt.Errorf("client %s reached its traffic quota %s", client, q.TrafficCap)
+	}
+	return nil
+}
+
+// admitClientConn counts a tcp user conn sent to the client of b to its
+// quota, the conn is refused when the client is over it.
+func (s *Server) admitClientConn(conn io.ReadWriteCloser, b *backend) (io.ReadWriteCloser, error) {
+	cfg := s.config()
+	if !hasClientQuotas(cfg) {
+		return conn, nil
+	}
+	q := cfg.clientQuota(b.client)
+	u := s.clients.get(b.client)
+	if limit, _ := parseBytes(q.TrafficCap); limit > 0 && u.bytes.Load() >= limit {
+		return nil, fmt.Errorf("client %s reached its traffic quota %s", b.client, q.TrafficCap)
+	}
+	// take the slot before comparing, conns admitted at once can't all fit
+	if n := u.conns.Add(1); q.MaxConns > 0 && n > int64(q.MaxConns) {
+		u.conns.Add(-1)
+		return nil, fmt.Errorf("client %s reached its quota of %d conns", b.client, q.MaxConns)
+	}
+	return u.track(conn), nil
+}
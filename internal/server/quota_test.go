@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/abcdlsj/gnar/pkg/proto"
+)
+
+func TestAdmitClientConnConcurrent(t *testing.T) {
+	cfg, err := defaultConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ClientMaxConns = 4
+	s := New(cfg)
+	if s.initErr != nil {
+		t.Fatal(s.initErr)
+	}
+	b := &backend{client: "203.0.113.7", req: &proto.MsgProxyReq{ProxyType: "tcp"}}
+
+	var admitted atomic.Int64
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, _ := net.Pipe()
+			<-start
+			if _, err := s.admitClientConn(conn, b); err == nil {
+				admitted.Add(1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if n := admitted.Load(); n != 4 {
+		t.Fatalf("admitted %d conns at once, quota is 4", n)
+	}
+	if n := s.clients.get(b.client).conns.Load(); n != 4 {
+		t.Fatalf("client has %d conns, want 4", n)
+	}
+}
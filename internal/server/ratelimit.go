@@ -0,0 +1,88 @@
+package server
+
+import (
+	"container/list"
+	"net"
+	"sync"
+
+	"github.com/abcdlsj/gnar/pkg/proto"
+	"golang.org/x/time/rate"
+)
+
+// maxRateIPs bounds the ips a rate limit tracks, the least recently seen one
+// is evicted first, so a flood of spoofed ips can't grow it.
+const maxRateIPs = 10000
+
+// ipRateLimit caps the new user conns per second of every remote ip with a
+// token bucket per ip. A nil limit is unlimited.
+type ipRateLimit struct {
+	rate  rate.Limit
+	burst int
+	ips   map[string]*list.Element
+	lru   *list.List // of *ipLimiter, the most recently seen first
+	mu    sync.Mutex
+}
+
+type ipLimiter struct {
+	ip      string
+	limiter *rate.Limiter
+}
+
+// newIPRateLimit allows perSec conns per second and burst at once, a burst
+// of 0 is perSec.
+func newIPRateLimit(perSec, burst int) *ipRateLimit {
+	if perSec <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = perSec
+	}
+	return &ipRateLimit{
+		rate:  rate.Limit(perSec),
+		burst: burst,
+		ips:   make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+}
+
+// allow takes a token of the ip of addr, it reports false when the ip is
+// over the rate.
+func (l *ipRateLimit) allow(addr net.Addr) bool {
+	if l == nil {
+		return true
+	}
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.ips[ip]; ok {
+		l.lru.MoveToFront(e)
+		return e.Value.(*ipLimiter).limiter.Allow()
+	}
+
+	if l.lru.Len() >= maxRateIPs {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.ips, oldest.Value.(*ipLimiter).ip)
+	}
+	il := &ipLimiter{ip: ip, limiter: rate.NewLimiter(l.rate, l.burst)}
+	l.ips[ip] = l.lru.PushFront(il)
+	return il.limiter.Allow()
+}
+
+// connRate is the rate and burst of the proxy, the lower of the server ones
+// and the ones the client asked for, 0 means unset.
+func connRate(cfg Config, msg *proto.MsgProxyReq) (int, int) {
+	return lowerLimit(cfg.ConnRate, msg.ConnRate), lowerLimit(cfg.ConnBurst, msg.ConnBurst)
+}
+
+func lowerLimit(a, b int) int {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
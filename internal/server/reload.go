@@ -0,0 +1,170 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/abcdlsj/gnar/internal/auth"
+)
+
+// config returns a copy of the config, read it instead of s.cfg for the
+// reloadable fields.
+func (s *Server) config() Config {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.cfg
+}
+
+func (s *Server) auth() auth.Authenticator {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.authenticator
+}
+
+// Reload applies the fields of cfg that are safe to change while proxys are
+// running, changes of the others are only logged and need a restart.
+func (s *Server) Reload(cfg Config) error {
+	// the whole config, the restart fields too, it binds nothing
+	if _, err := validateConfig(cfg); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+
+	for _, name := range restartFields(s.cfg, cfg) {
+		s.log.Warnf("Config %s changed, restart the server to apply it", name)
+	}
+
+	oldTokens := loginTokens(s.cfg)
+	s.cfg.Token = cfg.Token
+	s.cfg.Proxys = cfg.Proxys
+	s.cfg.Subdomains = cfg.Subdomains
+	s.cfg.SubdomainPolicy = cfg.SubdomainPolicy
+	s.cfg.TokenGracePeriod = cfg.TokenGracePeriod
+	s.cfg.SpeedLimit = cfg.SpeedLimit
+	s.cfg.ConnRate = cfg.ConnRate
+	s.cfg.ConnBurst = cfg.ConnBurst
+	s.cfg.IdleTimeout = cfg.IdleTimeout
+	s.cfg.CancelGracePeriod = cfg.CancelGracePeriod
+	s.cfg.MinPort = cfg.MinPort
+	s.cfg.MaxPort = cfg.MaxPort
+	s.cfg.MaxProxys = cfg.MaxProxys
+	s.cfg.MaxPortRange = cfg.MaxPortRange
+	s.cfg.AutoPorts = cfg.AutoPorts
+	s.cfg.Banner = cfg.Banner
+	s.cfg.AuthFailLimit = cfg.AuthFailLimit
+	s.cfg.AuthFailWindow = cfg.AuthFailWindow
+	s.cfg.AuthBanDuration = cfg.AuthBanDuration
+	s.cfg.BindRetries = cfg.BindRetries
+	s.cfg.TrafficCap = cfg.TrafficCap
+	s.cfg.ProxyTrafficCap = cfg.ProxyTrafficCap
+	s.cfg.ClientMaxProxys = cfg.ClientMaxProxys
+	s.cfg.ClientMaxConns = cfg.ClientMaxConns
+	s.cfg.ClientTrafficCap = cfg.ClientTrafficCap
+	s.cfg.ClientQuotas = cfg.ClientQuotas
+	s.cfg.ProxyTTL = cfg.ProxyTTL
+	s.cfg.MaxProxyTTL = cfg.MaxProxyTTL
+	s.cfg.BindRetryDelay = cfg.BindRetryDelay
+	s.resources.setMaxProxys(cfg.MaxProxys)
+
+	if newTokens := loginTokens(s.cfg); !s.customAuth && !equalStrings(oldTokens, newTokens) {
+		s.rotateTokens(oldTokens, newTokens)
+	}
+
+	// lets logrotate move the access log away
+	if err := s.accessLog.reopen(); err != nil {
+		s.log.Errorf("Error reopening access log: %v", err)
+	}
+
+	s.log.Info("Config reloaded")
+	return nil
+}
+
+// rotateTokens keeps accepting logins with the old tokens for the grace
+// period, so clients can be moved to the new ones. It must be called with
+// s.cfgMu held.
+func (s *Server) rotateTokens(oldTokens, newTokens []string) {
+	s.authGen++
+	gen, grace := s.authGen, s.cfg.TokenGracePeriod
+
+	switch {
+	case len(newTokens) == 0:
+		s.authenticator = &auth.Nop{}
+		s.log.Warn("Token removed, clients login without token")
+		return
+	case len(oldTokens) == 0 || grace <= 0:
+		s.authenticator = auth.NewTokenAuthenticator(newTokens...)
+		s.log.Info("Token changed")
+		return
+	}
+
+	s.authenticator = auth.NewTokenAuthenticator(append(append([]string{}, newTokens...), oldTokens...)...)
+	s.log.Infof("Token changed, old tokens are accepted for %s", grace)
+
+	time.AfterFunc(grace, func() {
+		s.cfgMu.Lock()
+		defer s.cfgMu.Unlock()
+		// a later change already replaced the authenticator
+		if s.authGen != gen {
+			return
+		}
+		s.authenticator = auth.NewTokenAuthenticator(newTokens...)
+		s.log.Info("Token grace period is over, old tokens are rejected")
+	})
+}
+
+// restartFields returns the changed config fields that can't be reloaded.
+func restartFields(old, cfg Config) []string {
+	fields := []struct {
+		name    string
+		changed bool
+	}{
+		{"port", old.Port != cfg.Port},
+		{"admin-port", old.AdminPort != cfg.AdminPort},
+		{"admin auth", old.AdminAuth != cfg.AdminAuth},
+		{"admin-socket", old.AdminSocket != cfg.AdminSocket},
+		{"enable-profiling", old.EnableProfiling != cfg.EnableProfiling},
+		{"no-backend-response", old.NoBackendResponse != cfg.NoBackendResponse},
+		{"no-backend-page", old.NoBackendPage != cfg.NoBackendPage},
+		{"domain-tunnel", old.DomainTunnel != cfg.DomainTunnel},
+		{"domain", old.Domain != cfg.Domain},
+		{"multiplex", old.Multiplex != cfg.Multiplex},
+		{"caddy-srv-name", old.CaddySrvName != cfg.CaddySrvName},
+		{"bind-host", old.BindHost != cfg.BindHost},
+		{"http-port", old.HTTPPort != cfg.HTTPPort},
+		{"https-port", old.HTTPSPort != cfg.HTTPSPort},
+		{"ws-port", old.WSPort != cfg.WSPort},
+		{"ws-path", old.WSPath != cfg.WSPath},
+		{"quic-port", old.QUICPort != cfg.QUICPort},
+		{"listeners", !equalListeners(old.Listeners, cfg.Listeners)},
+		{"load-balance", old.LoadBalance != cfg.LoadBalance},
+		{"affinity-timeout", old.AffinityTimeout != cfg.AffinityTimeout},
+		{"tls", old.TLS != cfg.TLS},
+		{"edge-certs", !equalEdgeCerts(old.EdgeCerts, cfg.EdgeCerts)},
+		{"acme", old.ACME != cfg.ACME || old.ACMEEmail != cfg.ACMEEmail || old.ACMECacheDir != cfg.ACMECacheDir || old.ACMEDirectory != cfg.ACMEDirectory ||
+			!equalStrings(old.ACMEHosts, cfg.ACMEHosts)},
+		{"admin-tls", old.AdminTLS != cfg.AdminTLS},
+		{"heartbeat-interval", old.HeartbeatInterval != cfg.HeartbeatInterval},
+		{"heartbeat-timeout", old.HeartbeatTimeout != cfg.HeartbeatTimeout},
+		{"keepalive", old.KeepAlive != cfg.KeepAlive},
+		{"reuse-port", old.ReusePort != cfg.ReusePort},
+		{"listen-backlog", old.ListenBacklog != cfg.ListenBacklog},
+		{"accept-workers", old.AcceptWorkers != cfg.AcceptWorkers},
+		{"exchange-timeout", old.ExchangeTimeout != cfg.ExchangeTimeout},
+		{"handshake-timeout", old.HandshakeTimeout != cfg.HandshakeTimeout},
+		{"copy-buffer-size", old.CopyBufferSize != cfg.CopyBufferSize},
+		{"max-packet-size", old.MaxPacketSize != cfg.MaxPacketSize},
+		{"metrics-file", old.MetricsFile != cfg.MetricsFile},
+		{"access-log", old.AccessLog != cfg.AccessLog},
+		{"metrics-flush-interval", old.MetricsFlushInterval != cfg.MetricsFlushInterval},
+	}
+
+	names := []string{}
+	for _, f := range fields {
+		if f.changed {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
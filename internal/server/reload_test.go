@@ -0,0 +1,32 @@
+package server
+
+import "testing"
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	cfg, err := defaultConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(cfg)
+	if s.initErr != nil {
+		t.Fatal(s.initErr)
+	}
+
+	for name, change := range map[string]func(*Config){
+		"speed limit":       func(c *Config) { c.SpeedLimit = "b" },
+		"port range":        func(c *Config) { c.MinPort, c.MaxPort = 2000, 1000 },
+		"reserved in range": func(c *Config) { c.MinPort = 2000; c.Proxys = []ReservedProxy{{RemotePort: 1500}} },
+	} {
+		bad := cfg
+		change(&bad)
+		if err := s.Reload(bad); err == nil {
+			t.Errorf("%s: reload accepted an invalid config", name)
+		}
+	}
+	if got := s.config(); got.SpeedLimit != cfg.SpeedLimit || got.MinPort != cfg.MinPort || len(got.Proxys) != 0 {
+		t.Fatalf("running config changed: %+v", got)
+	}
+	if err := s.Reload(cfg); err != nil {
+		t.Fatalf("reload of a valid config: %v", err)
+	}
+}
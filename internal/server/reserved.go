@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/abcdlsj/gnar/internal/auth"
+	"github.com/abcdlsj/gnar/pkg/proto"
+)
+
+func validateReserved(proxys []ReservedProxy) error {
+	ports := make(map[int]bool)
+	for _, p := range proxys {
+		if p.RemotePort <= 0 || p.RemotePort > 65535 {
+			return fmt.Errorf("invalid remote port: %d", p.RemotePort)
+		}
+		if ports[p.RemotePort] {
+			return fmt.Errorf("duplicate remote port: %d", p.RemotePort)
+		}
+		ports[p.RemotePort] = true
+		if _, err := parseBytes(p.TrafficCap); err != nil {
+			return fmt.Errorf("invalid traffic-cap of remote port %d: %v", p.RemotePort, err)
+		}
+	}
+	return nil
+}
+
+// loginTokens returns all tokens a client may login with.
+func loginTokens(cfg Config) []string {
+	tokens := []string{}
+	if cfg.Token != "" {
+		tokens = append(tokens, cfg.Token)
+	}
+	for _, p := range cfg.Proxys {
+		if p.Token != "" {
+			tokens = append(tokens, p.Token)
+		}
+	}
+	for _, r := range cfg.Subdomains {
+		if r.Token != "" {
+			tokens = append(tokens, r.Token)
+		}
+	}
+	return tokens
+}
+
+func reservedProxy(cfg Config, port int) (ReservedProxy, bool) {
+	for _, p := range cfg.Proxys {
+		if p.RemotePort == port {
+			return p, true
+		}
+	}
+	return ReservedProxy{}, false
+}
+
+// checkReserved rejects the request when the server reserves ports and the
+// request does not match one of them, or the login token is not the one of
+// the reserved proxy.
+func checkReserved(cfg Config, login *proto.MsgLogin, msg *proto.MsgProxyReq) (proto.RejectCode, error) {
+	if len(cfg.Proxys) == 0 {
+		return "", nil
+	}
+
+	p, ok := reservedProxy(cfg, msg.RemotePort)
+	if !ok {
+		return proto.RejectInvalidPort, fmt.Errorf("port %d is not reserved", msg.RemotePort)
+	}
+
+	if p.ProxyName != "" && p.ProxyName != msg.ProxyName {
+		return proto.RejectInvalidPort, fmt.Errorf("port %d is reserved for proxy %s", msg.RemotePort, p.ProxyName)
+	}
+
+	token := p.Token
+	if token == "" {
+		token = cfg.Token
+	}
+	if token != "" && !auth.NewTokenAuthenticator(token).VerifyLogin(login) {
+		return proto.RejectAuth, fmt.Errorf("invalid token for reserved port %d", msg.RemotePort)
+	}
+
+	return "", nil
+}
@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package server
+
+import "net"
+
+const reusePortSupported = false
+
+// listenConfig ignores reusePort, the platform has no SO_REUSEPORT.
+func listenConfig(reusePort bool) net.ListenConfig {
+	return net.ListenConfig{}
+}
@@ -1,70 +1,240 @@
 package server
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/abcdlsj/gnar/internal/auth"
 	"github.com/abcdlsj/gnar/internal/logger"
+	"github.com/abcdlsj/gnar/internal/metrics"
+	"github.com/abcdlsj/gnar/internal/pio"
 	"github.com/abcdlsj/gnar/internal/proxy"
 	"github.com/abcdlsj/gnar/internal/server/conn"
+	"github.com/abcdlsj/gnar/internal/tracing"
 	"github.com/abcdlsj/gnar/pkg/proto"
 	"github.com/abcdlsj/gnar/pkg/share"
 	"github.com/google/uuid"
 	"github.com/hashicorp/yamux"
+	"github.com/quic-go/quic-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Server struct {
 	cfg           Config
 	tcpConnMap    conn.TCPConnMap
 	udpConnMap    conn.UDPConnMap
+	sessions      *sessionMap
+	clients       *clientUsages
+	autoPorts     *autoPortPool
+	bans          *authBans
 	authenticator auth.Authenticator
 	resources     *resourceManager
+	prom          *metrics.Prometheus
+	tracer        *tracing.Tracer
+	log           *logger.Logger
+	noBackend     []byte      // response of http user conns no client takes, nil sends none
+	tlsCfg        *tls.Config // of the control listeners, nil disables tls
+	edge          *edgeCerts  // of the tls proxys terminated at the server, nil without edge certs and acme
+	customAuth    bool        // the authenticator is supplied by WithAuthenticator, tokens don't replace it
+	authorize     Authorizer
+	initErr       error      // returned by Run
+	accessLog     *accessLog // nil without access-log
+
+	listener      net.Listener
+	ownListener   net.Listener // of WithListener, instead of the server port
+	ownAcceptors  []Acceptor   // of WithAcceptor
+	acceptors     []Acceptor   // served next to the server port, of cfg.Listeners and WithAcceptor
+	listening     atomic.Bool  // the control listener is up
+	httpListener  net.Listener
+	sniListener   net.Listener
+	wsListener    net.Listener
+	quicListener  *quic.Listener
+	quicTransport *quic.Transport
+	adminServers  []*http.Server // of the admin port and socket
+	closing       chan struct{}
+	streamCtx     context.Context // canceled to abort the proxied connections
+	abortStreams  context.CancelFunc
+	active        sync.WaitGroup
+	mu            sync.Mutex
+
+	// cfgMu guards the reloadable fields of cfg and the authenticator
+	cfgMu   sync.RWMutex
+	authGen int // bumped on every token change, ends older grace periods
 }
 
 type resourceManager struct {
 	proxys        []Proxy
+	traffics      *trafficStats
+	savedTraffics []metrics.TrafficSummary // loaded from the metrics file
 	portManager   map[int]bool
 	domainManager map[string]bool
 	caddySrvName  string
+	maxProxys     int
+	nproxys       atomic.Int64 // len(proxys) for lock free reads
+	prom          *metrics.Prometheus
+	events        *eventBus
+	onClose       func(Proxy) // called under the lock when a proxy is closed
+	log           *logger.Logger
 	m             sync.RWMutex
 }
 
-func newResourceManager(cfg Config) *resourceManager {
+func newResourceManager(cfg Config, prom *metrics.Prometheus, log *logger.Logger) *resourceManager {
+	events := newEventBus(log)
 	return &resourceManager{
 		proxys:        []Proxy{},
+		traffics:      newTrafficStats(prom, events),
 		portManager:   make(map[int]bool),
 		domainManager: make(map[string]bool),
 		caddySrvName:  cfg.CaddySrvName,
+		maxProxys:     cfg.MaxProxys,
+		prom:          prom,
+		events:        events,
+		log:           log,
 	}
 }
 
-func newServer(cfg Config) *Server {
+// Option configures a Server at creation.
+type Option func(*Server)
+
+// WithLogger makes the server write its logs, and the logs of the proxys it
+// serves, to l instead of the default logger.
+func WithLogger(l *logger.Logger) Option {
+	return func(s *Server) {
+		s.log = l
+	}
+}
+
+// WithTLSConfig serves the control listeners with tlsCfg instead of the tls
+// files of the config, e.g. for certificates managed by the application.
+func WithTLSConfig(tlsCfg *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsCfg = tlsCfg
+	}
+}
+
+// WithAuthenticator verifies the client logins with a instead of the tokens
+// of the config, auth.Func turns a callback into one. Listeners and reserved
+// proxys with their own token still check it.
+func WithAuthenticator(a auth.Authenticator) Option {
+	return func(s *Server) {
+		s.authenticator = a
+		s.customAuth = true
+	}
+}
+
+// WithListener accepts the control conns of the server port from l instead
+// of listening on cfg.Port, e.g. an in memory listener in tests. The server
+// closes l on shutdown.
+func WithListener(l net.Listener) Option {
+	return func(s *Server) {
+		s.ownListener = l
+	}
+}
+
+// New creates a server of cfg, start with the one of LoadConfig("", nil) for
+// the defaults. An invalid config is returned by Run.
+func New(cfg Config, opts ...Option) *Server {
+	prom := metrics.NewPrometheus()
 	s := &Server{
 		cfg:           cfg,
-		tcpConnMap:    conn.NewTCPConnMap(),
+		tcpConnMap:    conn.NewTCPConnMap(cfg.ExchangeTimeout),
 		udpConnMap:    conn.NewUDPConnMap(),
+		sessions:      newSessionMap(),
+		clients:       newClientUsages(),
+		autoPorts:     newAutoPortPool(),
+		bans:          newAuthBans(),
 		authenticator: &auth.Nop{},
-		resources:     newResourceManager(cfg),
+		authorize:     AllowAll,
+		prom:          prom,
+		log:           logger.New(),
+		closing:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.resources = newResourceManager(cfg, prom, s.log)
+	s.resources.onClose = s.drainSessions
+	s.streamCtx, s.abortStreams = context.WithCancel(context.Background())
+
+	tracer, err := tracing.New(cfg.TraceEndpoint, "gnar-server")
+	if err != nil {
+		tracer, _ = tracing.New("", "")
+		s.initErr = fmt.Errorf("invalid config: %v", err)
+	}
+	s.tracer = tracer
+	if s.initErr != nil {
+		return s
 	}
 
-	if s.cfg.Token != "" {
-		s.authenticator = auth.NewTokenAuthenticator(s.cfg.Token)
+	if _, err := validateConfig(cfg); err != nil {
+		s.initErr = fmt.Errorf("invalid config: %v", err)
+		return s
+	}
+	if s.tlsCfg == nil {
+		if s.tlsCfg, err = loadTLSConfig(cfg.TLS); err != nil {
+			s.initErr = err
+			return s
+		}
+	}
+	if s.edge, err = loadEdgeCerts(cfg, s.terminatesTLS); err != nil {
+		s.initErr = err
+		return s
+	}
+	if cfg.ReusePort && !reusePortSupported {
+		s.log.Warnf("reuse-port is not supported on %s, ports are bound without it", runtime.GOOS)
+	}
+	if cfg.ListenBacklog > 0 && !backlogSupported {
+		s.log.Warnf("listen-backlog is not supported on %s, ports keep the system default", runtime.GOOS)
+	}
+	if s.accessLog, err = openAccessLog(cfg.AccessLog); err != nil {
+		s.initErr = err
+		return s
+	}
+	s.noBackend, _ = noBackendResponse(cfg) // validated with the config
+	proxy.SetBufSize(cfg.CopyBufferSize)
+	proto.SetMaxPacketSize(cfg.MaxPacketSize)
+
+	if tokens := loginTokens(cfg); len(tokens) > 0 && !s.customAuth {
+		s.authenticator = auth.NewTokenAuthenticator(tokens...)
 	}
 
 	return s
 }
 
+// Run serves until Shutdown, it returns the error of a server that couldn't
+// start, e.g. of an invalid config or a port in use.
 func (s *Server) Run() error {
+	if s.initErr != nil {
+		return s.initErr
+	}
 	s.printMetaInfo()
-	s.startAdminServer()
-	s.startProxyServer()
-	return nil
+	if err := s.loadTraffics(); err != nil {
+		return err
+	}
+	s.startTrafficFlusher()
+	s.startCapWatcher()
+	s.startTTLWatcher()
+	for _, start := range []func() error{s.startAdminServer, s.startVhostServer, s.startSNIServer, s.startWSServer, s.startQUICServer, s.startListeners, s.startAcceptors} {
+		if err := start(); err != nil {
+			return err
+		}
+	}
+	return s.startProxyServer()
 }
 
 func (s *Server) printMetaInfo() {
@@ -73,377 +243,1068 @@ func (s *Server) printMetaInfo() {
 	fmt.Printf("Version: %s\n", share.GetVersion())
 	fmt.Printf("Port: %d\n", s.cfg.Port)
 	fmt.Printf("Admin Port: %d\n", s.cfg.AdminPort)
+	fmt.Printf("Admin Socket: %s\n", s.cfg.AdminSocket)
+	fmt.Printf("Profiling: %v\n", s.cfg.EnableProfiling)
+	fmt.Printf("No Backend Response: %v\n", s.cfg.NoBackendResponse)
 	fmt.Printf("Domain Tunnel: %v\n", s.cfg.DomainTunnel)
 	fmt.Printf("Domain: %s\n", s.cfg.Domain)
 	fmt.Printf("Token: %s\n", s.cfg.Token)
-	fmt.Printf("Token Authentication: %v\n", s.cfg.Token != "")
+	fmt.Printf("Token Authentication: %v\n", s.cfg.Token != "" || s.customAuth)
 	fmt.Printf("Multiplex: %v\n", s.cfg.Multiplex)
 	fmt.Printf("Caddy Server Name: %s\n", s.cfg.CaddySrvName)
+	fmt.Printf("Speed Limit: %s\n", s.cfg.SpeedLimit)
+	fmt.Printf("Conn Rate: %d/s, burst: %d\n", s.cfg.ConnRate, s.cfg.ConnBurst)
+	fmt.Printf("Bind Host: %s\n", s.cfg.BindHost)
+	fmt.Printf("Reuse Port: %v\n", s.cfg.ReusePort && reusePortSupported)
+	fmt.Printf("Max Proxys: %d\n", s.cfg.MaxProxys)
+	fmt.Printf("Max Port Range: %d\n", s.cfg.MaxPortRange)
+	fmt.Printf("Http Port: %d\n", s.cfg.HTTPPort)
+	fmt.Printf("Https Port: %d\n", s.cfg.HTTPSPort)
+	fmt.Printf("Websocket Port: %d\n", s.cfg.WSPort)
+	fmt.Printf("Quic Port: %d\n", s.cfg.QUICPort)
+	fmt.Printf("Listeners: %d\n", len(s.cfg.Listeners))
+	fmt.Printf("TLS: %v\n", s.tlsCfg != nil)
+	fmt.Printf("TLS Client Auth: %v\n", s.cfg.TLS.ClientCAFile != "")
+	fmt.Printf("Tracing: %v\n", s.tracer.Enabled())
+	fmt.Printf("Access Log: %s\n", s.cfg.AccessLog)
 	fmt.Println("---")
 }
 
-func (s *Server) startAdminServer() {
-	if s.cfg.AdminPort != 0 {
-		go s.startAdmin()
+// startAdminServer starts the admin server on the admin port and socket,
+// without either there is none.
+func (s *Server) startAdminServer() error {
+	if s.cfg.AdminPort == 0 && s.cfg.AdminSocket == "" {
+		return nil
 	}
+	return s.startAdmin()
 }
 
-func (s *Server) startProxyServer() {
-	go s.tcpConnMap.StartAutoExpire()
+func (s *Server) startProxyServer() error {
+	go s.tcpConnMap.StartAutoExpire(s.log)
 
-	listener := s.createListener()
+	listener := s.ownListener
+	if listener == nil {
+		var err error
+		if listener, err = s.createListener(s.cfg.Port); err != nil {
+			return err
+		}
+	} else {
+		if s.tlsCfg != nil {
+			listener = tls.NewListener(listener, s.tlsCfg)
+		}
+		s.log.Infof("Server listening on %s", listener.Addr())
+	}
 	defer listener.Close()
 
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+	s.listening.Store(true)
+	defer s.listening.Store(false)
+
 	s.acceptConnections(listener)
+	return nil
 }
 
-func (s *Server) createListener() net.Listener {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.cfg.Port))
+func (s *Server) createListener(port int) (net.Listener, error) {
+	listener, err := s.listenTCP(fmt.Sprintf(":%d", port))
 	if err != nil {
-		logger.Fatalf("Error listening: %v", err)
+		return nil, fmt.Errorf("error listening: %v", err)
+	}
+
+	if s.tlsCfg != nil {
+		listener = tls.NewListener(listener, s.tlsCfg)
+		s.log.Infof("Server listening on port %d with tls", port)
+		return listener, nil
+	}
+
+	s.log.Infof("Server listening on port %d", port)
+	return listener, nil
+}
+
+// listenTCP listens on addr with the keepalive, reuse-port and
+// listen-backlog of the config.
+func (s *Server) listenTCP(addr string) (net.Listener, error) {
+	return listenNetwork("tcp", addr, s.cfg.KeepAlive, s.cfg.ReusePort, s.cfg.ListenBacklog)
+}
+
+// listenNetwork listens on network, tcp, tcp4 or tcp6. keepAlive is the tcp
+// keepalive period of accepted conns, 0 disables it. With reusePort other
+// processes may bind the port too, see listenConfig. A backlog of 0 keeps
+// the system default.
+func listenNetwork(network, addr string, keepAlive time.Duration, reusePort bool, backlog int) (net.Listener, error) {
+	if keepAlive == 0 {
+		keepAlive = -1
 	}
-	logger.Infof("Server listening on port %d", s.cfg.Port)
-	return listener
+	lc := listenConfig(reusePort)
+	lc.KeepAlive = keepAlive
+	listener, err := lc.Listen(context.Background(), network, addr)
+	if err != nil || backlog == 0 {
+		return listener, err
+	}
+	if err := setBacklog(listener, backlog); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("error setting listen backlog: %v", err)
+	}
+	return listener, nil
 }
 
 func (s *Server) acceptConnections(listener net.Listener) {
+	if err := s.acceptLoop(listener, func(conn net.Conn) { s.handleConnection(conn, nil) }); err != nil && !s.isClosing() {
+		s.log.Errorf("Error accepting: %v", err)
+	}
+}
+
+const maxAcceptDelay = time.Second
+
+// acceptLoop accepts conns until the acceptor is closed, which returns nil.
+// With accept-workers above 1 that many goroutines accept at once, so handle
+// must be safe to call concurrently. The first error of a worker closes a,
+// which ends the others.
+func (s *Server) acceptLoop(a Acceptor, handle func(net.Conn)) error {
+	workers := s.cfg.AcceptWorkers
+	if workers <= 1 {
+		return s.accept(a, handle)
+	}
+
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			errs <- s.accept(a, handle)
+		}()
+	}
+	var err error
+	for i := 0; i < workers; i++ {
+		if werr := <-errs; werr != nil && err == nil {
+			err = werr
+			a.Close()
+		}
+	}
+	return err
+}
+
+// accept is one worker of acceptLoop. Temporary errors like too many open
+// files are retried with a backoff, the same way net/http does.
+func (s *Server) accept(a Acceptor, handle func(net.Conn)) error {
+	var delay time.Duration
 	for {
-		conn, err := listener.Accept()
+		conn, err := a.Accept()
 		if err != nil {
-			logger.Infof("Error accepting: %v", err)
-			return
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				s.log.Warnf("Error accepting: %v, retrying in %s", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
 		}
 
-		s.handleConnection(conn)
+		delay = 0
+		handle(conn)
 	}
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
-	if s.cfg.Multiplex {
-		s.handleMultiplexConnection(conn)
-	} else {
-		go s.handle(conn, false)
+// handleConnection serves a control conn accepted on the listener lc, nil is
+// the server port.
+func (s *Server) handleConnection(conn net.Conn, lc *ListenerConfig) {
+	if s.closeBanned(conn) {
+		return
 	}
-}
-
-func (s *Server) handleMultiplexConnection(conn net.Conn) {
 	go func() {
-		session, err := s.newMuxSession(conn)
-		if session == nil {
+		if err := s.handshake(conn); err != nil {
+			s.log.Warnf("Error in tls handshake, client addr: %s: %v", conn.RemoteAddr(), err)
 			conn.Close()
 			return
 		}
-		if err != nil {
-			logger.Errorf("Error creating yamux session: %v", err)
-			return
+		client := clientID(conn)
+		if s.cfg.Multiplex {
+			s.handleMultiplexConnection(conn, client, lc)
+		} else {
+			s.handle(conn, nil, client, lc)
 		}
-		s.handleMuxSession(session, conn)
 	}()
 }
 
-func (s *Server) handleMuxSession(session *yamux.Session, conn net.Conn) {
+func (s *Server) handleMultiplexConnection(conn net.Conn, client string, lc *ListenerConfig) {
+	session, login, err := s.newMuxSession(conn, lc)
+	if session == nil {
+		conn.Close()
+		return
+	}
+	if err != nil {
+		s.log.Errorf("Error creating yamux session: %v", err)
+		return
+	}
+	s.handleMuxSession(session, login, client, lc, conn)
+}
+
+func (s *Server) handleMuxSession(session *yamux.Session, login *proto.MsgLogin, client string, lc *ListenerConfig, conn net.Conn) {
 	for {
 		stream, err := session.AcceptStream()
 		if err != nil {
-			logger.Errorf("Error accepting stream: %v", err)
+			s.prom.ControlConnErrors.Inc()
+			s.log.Errorf("Error accepting stream: %v", err)
+			s.reclaimSession(session, conn)
 			return
 		}
-		logger.Debugf("New yamux connection, client addr: %s", conn.RemoteAddr().String())
+		s.log.Debugf("New yamux connection, client addr: %s", conn.RemoteAddr().String())
 
-		go s.handle(stream, true)
+		go s.handle(stream, login, client, lc)
 	}
 }
 
-func (s *Server) newMuxSession(conn net.Conn) (*yamux.Session, error) {
-	if err := s.authCheckConn(conn); err != nil {
-		return nil, err
+func (s *Server) newMuxSession(conn net.Conn, lc *ListenerConfig) (*yamux.Session, *proto.MsgLogin, error) {
+	s.setHandshakeDeadline(conn)
+	login, err := s.authCheckConn(conn, lc)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		s.warnHandshakeTimeout(conn, err)
+		if errors.Is(err, proto.ErrInvalidToken) {
+			s.rejectMuxLogin(conn, proto.RejectAuth, err.Error())
+		}
+		return nil, nil, err
 	}
 
 	session, err := yamux.Server(conn, nil)
 	if err != nil {
-		logger.Errorf("Error creating yamux session: %v", err)
+		s.log.Errorf("Error creating yamux session: %v", err)
 		conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
-	return session, nil
+	return session, login, nil
 }
 
-func (s *Server) handle(conn net.Conn, mux bool) {
-	if !mux {
-		if err := s.authCheckConn(conn); err != nil {
-			logger.Errorf("Authentication failed: %v", err)
+// handle serves one control connection, login is nil when the connection is
+// not authenticated yet, yamux streams share the login and client id of
+// their session.
+func (s *Server) handle(conn net.Conn, login *proto.MsgLogin, client string, lc *ListenerConfig) {
+	ctx, span := s.tracer.Start(context.Background(), "control_conn",
+		trace.WithAttributes(attribute.String("remote_addr", conn.RemoteAddr().String()), attribute.String("client_id", client)))
+	defer span.End()
+
+	// the packets before the first one is handled must arrive in time, the
+	// later reads are bounded by the heartbeat or the exchange
+	s.setHandshakeDeadline(conn)
+	if login == nil {
+		var err error
+		if login, err = s.authCheckConn(conn, lc); err != nil {
+			s.warnHandshakeTimeout(conn, err)
+			if errors.Is(err, proto.ErrInvalidToken) {
+				s.rejectLogin(conn, proto.RejectAuth, err.Error())
+			}
+			s.log.Errorf("Authentication failed: %v", err)
+			tracing.Fail(span, err)
 			conn.Close()
 			return
 		}
 	}
 
+	if err := s.checkProto(conn, login); err != nil {
+		s.log.Errorf("Error checking protocol version: %v", err)
+		tracing.Fail(span, err)
+		conn.Close()
+		return
+	}
+
 	pt, buf, err := proto.Read(conn)
 	if err != nil {
-		logger.Errorf("Error reading packet: %v", err)
+		s.prom.ControlConnErrors.Inc()
+		s.prom.Fail(metrics.FailRead)
+		s.warnHandshakeTimeout(conn, err)
+		s.log.Errorf("Error reading packet: %v", err)
+		tracing.Fail(span, err)
+		conn.Close()
 		return
 	}
+	conn.SetReadDeadline(time.Time{})
+	span.SetAttributes(attribute.String("packet", pt.String()))
 
-	if err := s.handlePacket(conn, pt, buf); err != nil {
-		logger.Errorf("Error handling packet: %v", err)
+	if err := s.handlePacket(ctx, conn, login, client, lc, pt, buf); err != nil {
+		s.log.Errorf("Error handling packet: %v", err)
+		tracing.Fail(span, err)
+		conn.Close()
 		return
 	}
 }
 
-func (s *Server) handlePacket(conn net.Conn, pt proto.PacketType, buf []byte) error {
-	switch pt {
-	case proto.PacketProxyReq:
-		return s.handleProxyReq(conn, buf)
-	case proto.PacketExchange:
-		return s.handleExchange(conn, buf)
-	case proto.PacketProxyCancel:
-		return s.handleProxyCancel(conn, buf)
-	default:
-		return fmt.Errorf("unknown packet type: %v", pt)
+// setHandshakeDeadline bounds the reads of a new control conn by the
+// handshake timeout, so a client that stalls holds no goroutine for long.
+func (s *Server) setHandshakeDeadline(conn net.Conn) {
+	if s.cfg.HandshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.cfg.HandshakeTimeout))
 	}
 }
 
-func (s *Server) handleProxyReq(conn net.Conn, buf []byte) error {
-	msg := &proto.MsgProxyReq{}
-	if err := json.Unmarshal(buf, msg); err != nil {
-		return fmt.Errorf("error unmarshalling proxy request: %v", err)
+func (s *Server) warnHandshakeTimeout(conn net.Conn, err error) {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		s.log.Warnf("Control conn from %s sent no complete packet within %s, closing", conn.RemoteAddr(), s.cfg.HandshakeTimeout)
 	}
+}
 
-	failCh := make(chan struct{})
-	go s.sendFailureResponse(conn, failCh)
-
-	err := s.handleProxy(conn, msg, failCh)
+func (s *Server) handlePacket(ctx context.Context, conn net.Conn, login *proto.MsgLogin, client string, lc *ListenerConfig, pt proto.PacketType, buf []byte) error {
+	msg, err := proto.Unmarshal(pt, buf)
 	if err != nil {
-		logger.Errorf("Error handling proxy: %v", err)
-		close(failCh)
+		return err
 	}
-	return err
-}
-
-func (s *Server) sendFailureResponse(conn net.Conn, failCh <-chan struct{}) {
-	select {
-	case <-failCh:
-		if err := proto.Send(conn, proto.NewMsgProxyResp("", "failed")); err != nil {
-			logger.Errorf("Error sending proxy failed resp message: %v", err)
-		}
-	case <-time.After(10 * time.Second):
-		// TODO: when timeout, do what?
+	switch msg := msg.(type) {
+	case *proto.MsgProxyReq:
+		return s.handleProxyReq(ctx, conn, login, client, lc, msg)
+	case *proto.MsgExchange:
+		return s.handleExchangeMsg(ctx, conn, msg)
+	case *proto.MsgProxyCancel:
+		return s.handleProxyCancel(conn, lc, msg)
+	default:
+		return fmt.Errorf("unexpected packet type: %v", pt)
 	}
 }
 
-func (s *Server) handleExchange(conn net.Conn, buf []byte) error {
-	msg := &proto.MsgExchange{}
-	if err := json.Unmarshal(buf, msg); err != nil {
-		return fmt.Errorf("error unmarshalling exchange message: %v", err)
-	}
+func (s *Server) handleProxyReq(ctx context.Context, conn net.Conn, login *proto.MsgLogin, client string, lc *ListenerConfig, msg *proto.MsgProxyReq) error {
+	msg.ProxyName = sanitizeName(msg.ProxyName)
+
+	// the span lasts as long as the proxy is served
+	_, span := s.tracer.Start(ctx, "handle_proxy", trace.WithAttributes(
+		attribute.String("proxy_name", msg.ProxyName),
+		attribute.String("proxy_type", msg.ProxyType),
+		attribute.Int("remote_port", msg.RemotePort),
+	))
+	defer span.End()
 
-	return s.handleExchangeMsg(conn, msg)
+	err := s.handleProxy(conn, login, client, lc, msg)
+	if err != nil {
+		s.log.Errorf("Error handling proxy: %v", err)
+		tracing.Fail(span, err)
+	}
+	return err
 }
 
-func (s *Server) handleProxyCancel(conn net.Conn, buf []byte) error {
-	msg := &proto.NewProxyCancel{}
-	if err := json.Unmarshal(buf, msg); err != nil {
-		return fmt.Errorf("error unmarshalling proxy cancel message: %v", err)
+// rejectProxy tells the client why its proxy request is refused and returns the reason.
+func (s *Server) rejectProxy(conn net.Conn, code proto.RejectCode, reason error) error {
+	if err := proto.Send(conn, proto.NewMsgProxyReject(code, reason.Error())); err != nil {
+		s.log.Errorf("Error sending proxy %s reject message: %v", code, err)
 	}
+	return reason
+}
 
+// handleProxyCancel removes the proxy canceled on a new conn, by older
+// clients, only a client of the listener of the proxy may cancel it.
+func (s *Server) handleProxyCancel(conn net.Conn, lc *ListenerConfig, msg *proto.MsgProxyCancel) error {
 	defer conn.Close()
-	s.resources.removeProxy(msg.RemotePort)
-	logger.Infof("Proxy port %d canceled", msg.RemotePort)
+	if !s.resources.removeProxy(msg.RemotePort, lc.id()) {
+		s.log.Warnf("Cancel of proxy port %d from %s ignored, no proxy of its listener", msg.RemotePort, conn.RemoteAddr())
+		return nil
+	}
+	s.log.Infof("Proxy port %d canceled", msg.RemotePort)
 	return nil
 }
 
-func (s *Server) authCheckConn(conn net.Conn) error {
+func (s *Server) authCheckConn(conn net.Conn, lc *ListenerConfig) (*proto.MsgLogin, error) {
 	loginMsg := proto.MsgLogin{}
 	if err := proto.Recv(conn, &loginMsg); err != nil {
-		logger.Errorf("Error reading from connection: %v", err)
-		return err
+		s.prom.Fail(metrics.FailRead)
+		s.log.Errorf("Error reading from connection: %v", err)
+		return nil, err
 	}
 
-	if ok := s.authenticator.VerifyLogin(&loginMsg); !ok {
-		logger.Errorf("Invalid token, client addr: %s", conn.RemoteAddr().String())
-		return fmt.Errorf("invalid token")
+	if ok := s.listenerAuth(lc).VerifyLogin(&loginMsg); !ok {
+		s.prom.Fail(metrics.FailAuth)
+		s.log.Warnf("Invalid token, client addr: %s", conn.RemoteAddr().String())
+		s.authFailed(conn.RemoteAddr())
+		return nil, proto.ErrInvalidToken
 	}
 
 	if share.GetVersion() != loginMsg.Version {
-		logger.Warnf("Client version not match, client addr: %s", conn.RemoteAddr().String())
+		s.log.Warnf("Client version not match, client version: %s, platform: %s, client addr: %s",
+			sanitizeClientInfo(loginMsg.Version), sanitizeClientInfo(loginMsg.Platform), conn.RemoteAddr().String())
 	}
 
-	logger.Debugf("Auth success, client addr: %s", conn.RemoteAddr().String())
-	return nil
+	s.log.Debugf("Auth success, client addr: %s", conn.RemoteAddr().String())
+	return &loginMsg, nil
+}
+
+// rejectLogin tells the client why its login is refused, it reads the
+// reject in place of the resp to its first packet.
+func (s *Server) rejectLogin(conn net.Conn, code proto.RejectCode, reason string) {
+	if err := proto.Send(conn, proto.NewMsgLoginReject(code, reason)); err != nil {
+		s.log.Errorf("Error sending login reject message: %v", err)
+	}
+}
+
+// rejectMuxLogin sends the login reject on the first stream of a multiplexed
+// client, which expects yamux frames and no packet on the conn.
+func (s *Server) rejectMuxLogin(conn net.Conn, code proto.RejectCode, reason string) {
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	session, err := yamux.Server(conn, nil)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	stream, err := session.AcceptStream()
+	if err != nil {
+		return
+	}
+	if _, _, err := proto.Read(stream); err != nil {
+		return
+	}
+	s.rejectLogin(stream, code, reason)
+}
+
+// checkProto rejects clients whose wire protocol the server doesn't speak.
+func (s *Server) checkProto(conn net.Conn, login *proto.MsgLogin) error {
+	v := login.Proto()
+	if v >= proto.MinProtoVersion && v <= proto.ProtoVersion {
+		return nil
+	}
+
+	s.prom.Fail(metrics.FailVersion)
+	reason := fmt.Sprintf("protocol version %d not supported, server supports %d-%d, client version: %s, server version: %s",
+		v, proto.MinProtoVersion, proto.ProtoVersion, login.Version, share.GetVersion())
+	s.rejectLogin(conn, proto.RejectVersion, reason)
+	return fmt.Errorf("%s, client addr: %s", reason, conn.RemoteAddr().String())
 }
 
-func (s *Server) handleProxy(cConn net.Conn, msg *proto.MsgProxyReq, failCh chan struct{}) error {
+func (s *Server) handleProxy(cConn net.Conn, login *proto.MsgLogin, client string, lc *ListenerConfig, msg *proto.MsgProxyReq) error {
 	uPort := msg.RemotePort
-	if !s.resources.isAvailablePort(uPort) {
-		failCh <- struct{}{}
-		return fmt.Errorf("invalid proxy to port: %d", uPort)
+	if routedType(msg.ProxyType) {
+		// http and tls proxys are reached through the shared port, their own port only listens locally
+		uPort = 0
+	}
+	cfg := lc.apply(s.config())
+	if !cfg.allowedPort(uPort) {
+		s.prom.Fail(metrics.FailInvalidPort)
+		return s.rejectProxy(cConn, proto.RejectInvalidPort, fmt.Errorf("port %d not allowed, server allows ports %d-%d",
+			uPort, cfg.MinPort, cfg.MaxPort))
+	}
+	if msg.RemotePortEnd != 0 {
+		if err := validPortRange(cfg, msg); err != nil {
+			s.prom.Fail(metrics.FailInvalidPort)
+			return s.rejectProxy(cConn, proto.RejectInvalidPort, err)
+		}
+	}
+	if code, err := checkReserved(cfg, login, msg); err != nil {
+		return s.rejectProxy(cConn, code, err)
+	}
+	if code, err := checkSubdomain(cfg, login, client, msg); err != nil {
+		return s.rejectProxy(cConn, code, err)
+	}
+	if err := s.checkTrafficCap(uPort); err != nil {
+		return s.rejectProxy(cConn, proto.RejectLimit, err)
+	}
+	if err := s.checkClientQuota(client); err != nil {
+		return s.rejectProxy(cConn, proto.RejectLimit, err)
+	}
+	if code, err := s.checkAuthorized(client, msg); err != nil {
+		return s.rejectProxy(cConn, code, err)
+	}
+
+	if msg.Network == "tcp" {
+		// both families, like no network
+		msg.Network = ""
+	}
+	info := newClientInfo(cConn, client, login)
+	if msg.RemotePortEnd == 0 {
+		if joined, err := s.joinProxy(cConn, info, lc.id(), msg); joined {
+			return err
+		}
+	}
+
+	for port := uPort; port <= msg.RemotePortEnd || port == uPort; port++ {
+		if !s.resources.isAvailablePort(port) {
+			s.prom.Fail(metrics.FailBind)
+			return s.rejectProxy(cConn, proto.RejectInUse, fmt.Errorf("port %d %w", port, errInUse))
+		}
+	}
+
+	if s.resources.full() {
+		return s.rejectProxy(cConn, proto.RejectLimit, errTooManyProxys)
+	}
+
+	host := msg.BindHost
+	if host == "" {
+		host = s.cfg.BindHost
+	}
+	if msg.ProxyType == "http" {
+		if s.cfg.HTTPPort == 0 {
+			return s.rejectProxy(cConn, proto.RejectUnsupported, errors.New("http proxy is not enabled on server"))
+		}
+		host = "127.0.0.1"
+	}
+	if msg.ProxyType == "tls" {
+		if s.cfg.HTTPSPort == 0 {
+			return s.rejectProxy(cConn, proto.RejectUnsupported, errors.New("tls proxy is not enabled on server"))
+		}
+		if msg.Hostname == "" && s.cfg.Domain == "" {
+			return s.rejectProxy(cConn, proto.RejectInvalidRequest, errors.New("tls proxy needs a hostname, server has no domain"))
+		}
+		if err := validHostname(msg.Hostname); err != nil {
+			return s.rejectProxy(cConn, proto.RejectInvalidRequest, err)
+		}
+		if msg.TerminateTLS && s.edge == nil {
+			return s.rejectProxy(cConn, proto.RejectUnsupported, errors.New("tls termination is not enabled on server"))
+		}
+		host = "127.0.0.1"
+	} else if msg.TerminateTLS {
+		return s.rejectProxy(cConn, proto.RejectInvalidRequest, errors.New("terminate tls is only supported by tls proxy"))
+	}
+	if err := validBindHost(host); err != nil {
+		return s.rejectProxy(cConn, proto.RejectInvalidRequest, err)
+	}
+	if err := validNetwork(msg.Network, msg.ProxyType, host); err != nil {
+		return s.rejectProxy(cConn, proto.RejectInvalidRequest, err)
 	}
 
-	domain, err := s.resources.distrDomain(msg.Subdomain, s.cfg, uPort)
+	acl, err := newIPACL(msg.AllowIPs, msg.DenyIPs)
 	if err != nil {
-		failCh <- struct{}{}
-		return err
+		return s.rejectProxy(cConn, proto.RejectInvalidRequest, err)
+	}
+	if acl != nil && msg.ProxyType == "udp" {
+		return s.rejectProxy(cConn, proto.RejectInvalidRequest, errors.New("ip rules are not supported by udp proxy"))
 	}
 
-	proxyHandler, err := s.createProxyHandler(msg.ProxyType, uPort)
+	if err := validOverflow(msg.Overflow); err != nil {
+		return s.rejectProxy(cConn, proto.RejectInvalidRequest, err)
+	}
+	if msg.MaxConns > 0 && msg.ProxyType == "udp" {
+		return s.rejectProxy(cConn, proto.RejectInvalidRequest, errors.New("max conns is not supported by udp proxy"))
+	}
+	if msg.ConnRate < 0 || msg.ConnBurst < 0 {
+		return s.rejectProxy(cConn, proto.RejectInvalidRequest, fmt.Errorf("invalid conn rate: %d, burst: %d", msg.ConnRate, msg.ConnBurst))
+	}
+	if msg.ConnRate > 0 && msg.ProxyType == "udp" {
+		return s.rejectProxy(cConn, proto.RejectInvalidRequest, errors.New("conn rate is not supported by udp proxy"))
+	}
+	if err := validProxyProtocol(msg.ProxyProtocol, msg.ProxyType); err != nil {
+		return s.rejectProxy(cConn, proto.RejectInvalidRequest, err)
+	}
+	if err := validHeaderRules(msg); err != nil {
+		return s.rejectProxy(cConn, proto.RejectInvalidRequest, err)
+	}
+	ttl, err := proxyTTL(cfg, msg)
 	if err != nil {
-		failCh <- struct{}{}
-		return err
+		return s.rejectProxy(cConn, proto.RejectInvalidRequest, err)
 	}
 
-	err = s.setupAndRunProxy(proxyHandler, uPort, domain, cConn, msg)
+	if uPort == 0 && !routedType(msg.ProxyType) && cfg.AutoPorts != "" {
+		if uPort, err = s.claimAutoPort(cfg); err != nil {
+			return s.rejectProxy(cConn, proto.RejectLimit, err)
+		}
+		defer s.autoPorts.release(uPort)
+	}
+	// the os picks free ports out of the allowed range, pick one in it instead
+	if uPort == 0 && !routedType(msg.ProxyType) && (cfg.MinPort > 1 || cfg.MaxPort < 65535) {
+		if uPort = s.resources.freePort(cfg.MinPort, cfg.MaxPort); uPort == 0 {
+			return s.rejectProxy(cConn, proto.RejectLimit, fmt.Errorf("no free port in %d-%d", cfg.MinPort, cfg.MaxPort))
+		}
+	}
+
+	proxyHandler, err := s.createProxyHandler(msg.ProxyType, listenFamily(msg.Network), host, uPort, acl)
 	if err != nil {
-		failCh <- struct{}{}
-		return err
+		return s.rejectProxy(cConn, proto.RejectUnsupported, err)
+	}
+	if msg.RemotePortEnd != 0 {
+		proxyHandler = s.createRangeHandler(listenFamily(msg.Network), host, uPort, msg.RemotePortEnd, acl)
 	}
 
-	return nil
+	listener, err := s.listenRetry(proxyHandler, uPort, cfg)
+	if err != nil {
+		s.prom.Fail(metrics.FailBind)
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return s.rejectProxy(cConn, proto.RejectInUse, fmt.Errorf("port already in use: %v", err))
+		}
+		return s.rejectProxy(cConn, proto.RejectInternal, fmt.Errorf("error listening: %v", err))
+	}
+
+	// port 0 asks for any free port, use the one actually bound
+	if uPort == 0 {
+		uPort = listenerPort(listener)
+		s.log.Infof("Assigned port %d for proxy request", uPort)
+	}
+
+	domain, err := s.resources.distrDomain(msg, cfg, uPort)
+	if err != nil {
+		listener.(io.Closer).Close()
+		return s.rejectProxy(cConn, addRejectCode(err), err)
+	}
+	if msg.TerminateTLS && !s.edge.covers(domain) {
+		listener.(io.Closer).Close()
+		return s.rejectProxy(cConn, proto.RejectUnsupported, fmt.Errorf("no certificate for %s on server", domain))
+	}
+
+	return s.setupAndRunProxy(proxyHandler, listener, host, uPort, domain, ttl, cConn, info, lc.id(), msg)
 }
 
-func (rm *resourceManager) distrDomain(sub string, cfg Config, uPort int) (string, error) {
+// listenRetry binds a remote port that is still in use again for a moment,
+// e.g. while the proxy of a just restarted client is released. The tcp
+// listeners set SO_REUSEADDR, conns in TIME_WAIT don't block the bind.
+func (s *Server) listenRetry(h proxyHandler, uPort int, cfg Config) (interface{}, error) {
+	listener, err := h.listen()
+	for i := 0; i < cfg.BindRetries && uPort != 0 && errors.Is(err, syscall.EADDRINUSE); i++ {
+		s.log.Debugf("Port %d in use, retry binding in %s, attempt %d", uPort, cfg.BindRetryDelay, i+1)
+		time.Sleep(cfg.BindRetryDelay)
+		listener, err = h.listen()
+	}
+	return listener, err
+}
+
+func listenerPort(listener interface{}) int {
+	switch l := listener.(type) {
+	case net.Listener:
+		return l.Addr().(*net.TCPAddr).Port
+	case *net.UDPConn:
+		return l.LocalAddr().(*net.UDPAddr).Port
+	default:
+		return 0
+	}
+}
+
+func (rm *resourceManager) distrDomain(msg *proto.MsgProxyReq, cfg Config, uPort int) (string, error) {
 	rm.m.Lock()
 	defer rm.m.Unlock()
 
-	if !cfg.DomainTunnel {
+	// socks5 is no http, caddy can't route it, nor a range of ports
+	if (!cfg.DomainTunnel && !routedType(msg.ProxyType)) || msg.ProxyType == "socks5" || msg.RemotePortEnd != 0 {
 		return "", nil
 	}
 
-	if sub == "" {
-		sub = uuid.NewString()[:8]
+	domain := routedDomain(msg, cfg.Domain)
+	if domain == "" {
+		domain = vhostDomain(uuid.NewString()[:8], cfg.Domain)
 	}
 
-	domain := fmt.Sprintf("%s.%s", sub, cfg.Domain)
+	if routedType(msg.ProxyType) {
+		if rm.domainManager[domain] {
+			return "", errDomainUsed
+		}
+		return domain, nil
+	}
 
 	if !rm.domainManager[domain] {
-		if err := addCaddyRouter(rm.caddySrvName, domain, uPort); err != nil {
+		if err := addCaddyRouter(rm.caddySrvName, domain, uPort, rm.log); err != nil {
 			return "", err
 		}
 		return domain, nil
 	}
 
-	return domain, errors.New("domain already used")
+	return domain, errDomainUsed
 }
 
 type proxyHandler interface {
 	listen() (interface{}, error)
-	handleConn(s *Server, listener interface{}, cConn net.Conn, msg *proto.MsgProxyReq) error
+	handleConn(s *Server, listener interface{}, backends *backendGroup) error
+}
+
+// validBindHost accepts an empty host (all interfaces) or an ip address.
+func validBindHost(host string) error {
+	if host != "" && net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid bind host: %s", host)
+	}
+	return nil
+}
+
+// validNetwork accepts the address family the remote port listens on, tcp
+// (both, the default), tcp4 or tcp6, which must fit the bind host. The
+// routed proxys have no port of their own to pick it for.
+func validNetwork(network, proxyType, host string) error {
+	switch network {
+	case "", "tcp":
+		return nil
+	case "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("invalid network: %s, expected tcp, tcp4 or tcp6", network)
+	}
+	if routedType(proxyType) {
+		return fmt.Errorf("network is not supported by %s proxy", proxyType)
+	}
+	if ip := net.ParseIP(host); ip != nil && (ip.To4() != nil) != (network == "tcp4") {
+		return fmt.Errorf("bind host %s is no %s address", host, network)
+	}
+	return nil
+}
+
+// listenFamily is the family suffix of network, empty listens on both.
+func listenFamily(network string) string {
+	return strings.TrimPrefix(network, "tcp")
 }
 
 type tcpProxyHandler struct {
-	uPort int
+	host      string
+	uPort     int
+	acl       *ipACL
+	keepAlive time.Duration
+	family    string // "4" or "6", empty listens on both
+	reusePort bool
+	backlog   int
 }
 
 func (h *tcpProxyHandler) listen() (interface{}, error) {
-	return net.Listen("tcp", fmt.Sprintf(":%d", h.uPort))
+	return listenNetwork("tcp"+h.family, net.JoinHostPort(h.host, strconv.Itoa(h.uPort)), h.keepAlive, h.reusePort, h.backlog)
 }
 
-func (h *tcpProxyHandler) handleConn(s *Server, listener interface{}, cConn net.Conn, msg *proto.MsgProxyReq) error {
+func (h *tcpProxyHandler) handleConn(s *Server, listener interface{}, backends *backendGroup) error {
 	tcpListener := listener.(net.Listener)
-	for {
-		userConn, err := tcpListener.Accept()
-		if err != nil {
-			return fmt.Errorf("error accepting: %v", err)
+	uPort := listenerPort(tcpListener)
+	err := s.acceptLoop(tcpListener, func(userConn net.Conn) {
+		if !h.acl.allowed(userConn.RemoteAddr()) {
+			s.log.Debugf("User conn from %s denied by ip rules, port: %d", userConn.RemoteAddr(), uPort)
+			userConn.Close()
+			return
+		}
+		if !backends.rate.allow(userConn.RemoteAddr()) {
+			s.log.Debugf("User conn from %s over conn rate, port: %d", userConn.RemoteAddr(), uPort)
+			userConn.Close()
+			return
 		}
-		go s.handleTCPUserConn(userConn, cConn, msg)
+		go func() {
+			userConn, ok := backends.limit.admit(userConn, uPort, s.log)
+			if !ok {
+				return
+			}
+			b := backends.pick(userConn.RemoteAddr())
+			if b == nil {
+				s.log.Debugf("No client serving port %d, drop user conn from %s", uPort, userConn.RemoteAddr())
+				s.dropNoBackend(backends.proxyType, userConn)
+				return
+			}
+			s.handleTCPUserConn(userConn, uPort, b)
+		}()
+	})
+	if err != nil {
+		return fmt.Errorf("error accepting: %v", err)
 	}
+	return nil
 }
 
 type udpProxyHandler struct {
-	uPort int
+	host      string
+	uPort     int
+	family    string
+	reusePort bool
 }
 
 func (h *udpProxyHandler) listen() (interface{}, error) {
-	return net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: h.uPort})
+	ip := net.ParseIP(h.host)
+	if ip == nil && h.family != "6" {
+		ip = net.ParseIP("0.0.0.0")
+	}
+	addr := &net.UDPAddr{IP: ip, Port: h.uPort}
+	if !h.reusePort {
+		return net.ListenUDP("udp"+h.family, addr)
+	}
+	lc := listenConfig(true)
+	return lc.ListenPacket(context.Background(), "udp"+h.family, addr.String())
 }
 
-func (h *udpProxyHandler) handleConn(s *Server, conn interface{}, cConn net.Conn, msg *proto.MsgProxyReq) error {
+// udp proxys are never shared, the datagrams of the port go to one client.
+func (h *udpProxyHandler) handleConn(s *Server, conn interface{}, backends *backendGroup) error {
 	udpConn := conn.(*net.UDPConn)
 	uid := uuid.New().String()
 	s.udpConnMap.Add(uid, udpConn)
-	if err := proto.Send(cConn, proto.NewMsgExchange(uid, msg.ProxyType)); err != nil {
+	s.log.WithConnId(uid).Debugf("Send udp conn to client, port: %d", h.uPort)
+	b := backends.first()
+	if err := proto.Send(b.ctrl, proto.NewMsgExchange(uid, b.req.ProxyType)); err != nil {
+		b.ctrl.Close()
 		return fmt.Errorf("error sending exchange message: %v", err)
 	}
 	return nil
 }
 
-func (s *Server) createProxyHandler(proxyType string, uPort int) (proxyHandler, error) {
+func (s *Server) createProxyHandler(proxyType, family, host string, uPort int, acl *ipACL) (proxyHandler, error) {
 	switch proxyType {
-	case "tcp":
-		return &tcpProxyHandler{uPort}, nil
+	case "tcp", "http", "tls", "socks5":
+		return &tcpProxyHandler{host, uPort, acl, s.cfg.KeepAlive, family, s.cfg.ReusePort, s.cfg.ListenBacklog}, nil
 	case "udp":
-		return &udpProxyHandler{uPort}, nil
+		return &udpProxyHandler{host, uPort, family, s.cfg.ReusePort}, nil
 	default:
 		return nil, fmt.Errorf("invalid proxy type: %s", proxyType)
 	}
 }
 
-func (s *Server) setupAndRunProxy(handler proxyHandler, uPort int, domain string, cConn net.Conn, msg *proto.MsgProxyReq) error {
-	listener, err := handler.listen()
-	if err != nil {
-		return fmt.Errorf("error listening: %v", err)
-	}
-
+func (s *Server) setupAndRunProxy(handler proxyHandler, listener interface{}, host string, uPort int, domain string, ttl time.Duration, cConn net.Conn, info ClientInfo, zone int, msg *proto.MsgProxyReq) error {
 	from := cConn.RemoteAddr().String()
-	s.resources.addProxy(Proxy{
-		Port:   uPort,
-		From:   from,
-		Domain: domain,
-		Closer: listener.(io.Closer),
+	var expires *time.Time
+	if ttl > 0 {
+		t := time.Now().Add(ttl)
+		expires = &t
+	}
+	// only tcp tunnels are plain streams, udp datagrams are sent as packets
+	compress := msg.Compress && msg.ProxyType != "udp"
+	backends := newBackendGroup(s.cfg.LoadBalance, &backend{ctrl: cConn, client: info.ID, zone: zone, info: info, req: msg}, newIPRateLimit(connRate(s.config(), msg)), s.cfg.AffinityTimeout)
+	err := s.resources.addProxy(Proxy{
+		Name:     msg.ProxyName,
+		Compress: compress,
+		Host:     host,
+		Port:     uPort,
+		PortEnd:  msg.RemotePortEnd,
+		From:     from,
+		Domain:   domain,
+		Type:     msg.ProxyType,
+		Network:  msg.Network,
+		Expires:  expires,
+		Closer:   listener.(io.Closer),
+
+		TerminateTLS: msg.TerminateTLS,
+		backends:     backends,
 	})
+	if err != nil {
+		listener.(io.Closer).Close()
+		if domain != "" && !routedType(msg.ProxyType) {
+			delCaddyRouter(fmt.Sprintf("%s.%d", domain, uPort), s.log)
+		}
+		return s.rejectProxy(cConn, addRejectCode(err), err)
+	}
 
-	logger.Infof("Listening on proxying port %d, type: %s", uPort, msg.ProxyType)
-	logger.Infof("Receive proxy from %s to port %d", from, uPort)
-	logger.Infof("Send proxy accept msg to client: %s", from)
+	s.log.Infof("Listening on proxying port %s, type: %s", net.JoinHostPort(host, strconv.Itoa(uPort)), msg.ProxyType)
+	s.log.Infof("Receive proxy %s from %s to port %d", displayName(msg.ProxyName), from, uPort)
+	s.log.Infof("Send proxy accept msg to client: %s", from)
 
-	if err = proto.Send(cConn, proto.NewMsgProxyResp(domain, "success")); err != nil {
+	resp := proto.NewMsgProxyResp(domain, "success", uPort, compress)
+	resp.ProxyProtocol = msg.ProxyProtocol
+	resp.Headers = hasHeaderRules(msg)
+	resp.TTL = int(ttl / time.Second)
+	resp.TerminateTLS = msg.TerminateTLS
+	if err := proto.Send(cConn, resp); err != nil {
 		return fmt.Errorf("error sending proxy accept message: %v", err)
 	}
+	if err := s.sendBanner(cConn); err != nil {
+		return err
+	}
+
+	hlogger := s.log.CloneAdd(fmt.Sprintf("[:%d]", uPort)).With("port", uPort, "name", msg.ProxyName, "remote_addr", from)
+	go tickHeart(cConn, s.cfg.HeartbeatInterval, hlogger)
+	go s.watchHeartbeat(cConn, uPort, hlogger)
+
+	return handler.handleConn(s, listener, backends)
+}
+
+// maxBannerLen bounds the banner, it is a short message to the clients.
+const maxBannerLen = 1024
 
-	go tickHeart(cConn, logger.New(fmt.Sprintf("[:%d]", uPort)))
+// sendBanner sends the banner of the config after the proxy resp, an empty
+// one sends nothing.
+func (s *Server) sendBanner(cConn net.Conn) error {
+	banner := s.config().Banner
+	if banner == "" {
+		return nil
+	}
+	if err := proto.Send(cConn, proto.NewMsgBanner(banner)); err != nil {
+		return fmt.Errorf("error sending banner message: %v", err)
+	}
+	return nil
+}
 
-	return handler.handleConn(s, listener, cConn, msg)
+// rateLimit returns the bytes per second limit of a proxy, the lower one of
+// the client requested and the server global limit wins, 0 means unlimited.
+func (s *Server) rateLimit(msg *proto.MsgProxyReq) int {
+	limit := msg.RateLimit
+	if speedLimit := s.config().SpeedLimit; speedLimit != "" {
+		global := pio.LimitTransfer(speedLimit)
+		if limit <= 0 || global < limit {
+			limit = global
+		}
+	}
+	return limit
 }
 
-func (s *Server) handleTCPUserConn(userConn net.Conn, cConn net.Conn, msg *proto.MsgProxyReq) {
-	uid := conn.NewUuid()
-	s.tcpConnMap.Add(uid, userConn)
-	if err := proto.Send(cConn, proto.NewMsgExchange(uid, msg.ProxyType)); err != nil {
-		logger.Errorf("Error sending exchange message: %v", err)
+// typeLabel is the proxy type for display, with the family of the port
+// when it listens on one.
+func (p Proxy) typeLabel() string {
+	if family := listenFamily(p.Network); family != "" {
+		return p.Type + "/ipv" + family
 	}
-	logger.Debugf("Send new user conn id: %s", uid)
+	return p.Type
 }
 
-func tickHeart(cConn net.Conn, hlogger *logger.Logger) {
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
+func (s *Server) handleTCPUserConn(userConn net.Conn, uPort int, b *backend) {
+	uid := s.tcpConnMap.NewId(s.sessions.has)
+	clogger := s.log.WithConnId(uid)
+	clogger.Debugf("Accept new user conn from %s on port %d, client: %s", userConn.RemoteAddr(), uPort, b.ctrl.RemoteAddr())
 
-	for range ticker.C {
-		if err := proto.Send(cConn, proto.NewMsgHeartbeat()); err != nil {
-			hlogger.Warnf("Error sending heartbeat message: %v", err)
-			return
+	exchange := proto.NewMsgExchange(uid, b.req.ProxyType)
+	if b.req.RemotePortEnd != 0 {
+		// the conns of a range count to its proxy, the client dials by the port
+		exchange.Port, uPort = uPort, b.req.RemotePort
+	}
+
+	var uConn io.ReadWriteCloser = userConn
+	if hasHeaderRules(b.req) {
+		// validated at registration
+		reqRules, _ := proxy.ParseHeaderRules(b.req.RequestHeaders)
+		respRules, _ := proxy.ParseHeaderRules(b.req.ResponseHeaders)
+		uConn = proxy.NewHeaderConn(userConn, reqRules, respRules, hostname(userConn.RemoteAddr().String()))
+	}
+	if version := b.req.ProxyProtocol; version != "" {
+		// validated at registration
+		header, _ := proxy.ProxyHeader(version, userConn.RemoteAddr(), userConn.LocalAddr())
+		uConn = &prefixConn{deadlineConn: deadlineConn{uConn}, r: io.MultiReader(bytes.NewReader(header), uConn)}
+	}
+	if limit := s.rateLimit(b.req); limit > 0 {
+		uConn = pio.NewLimitReadWriter(uConn, limit)
+	}
+	admitted, err := s.admitClientConn(uConn, b)
+	if err != nil {
+		clogger.Debugf("Drop user conn from %s: %v", userConn.RemoteAddr(), err)
+		s.dropNoBackend(b.req.ProxyType, userConn)
+		uConn.Close()
+		return
+	}
+	uConn = b.track(admitted)
+	uConn = s.sessions.track(uid, uPort, userConn.RemoteAddr(), uConn)
+	if s.noBackend != nil && b.req.ProxyType == "http" {
+		uConn = &noBackendConn{ReadWriteCloser: uConn, user: userConn, s: s}
+	}
+	if !s.tcpConnMap.Add(uid, uConn, uPort) {
+		// picked at once by another conn since NewId
+		clogger.Errorf("Conn id %s already in use, drop user conn from %s", uid, userConn.RemoteAddr())
+		uConn.Close()
+		return
+	}
+	if err := proto.Send(b.ctrl, exchange); err != nil {
+		clogger.Errorf("Error sending exchange message: %v", err)
+		// a cut packet breaks the framing of the conn, the client serves it
+		// again on a new one
+		b.ctrl.Close()
+		s.tcpConnMap.Del(uid)
+		if nb, ok := uConn.(*noBackendConn); ok {
+			nb.Expire()
+		} else {
+			uConn.Close()
 		}
+		return
+	}
+	clogger.Debug("Send new user conn to client")
+}
+
+// deadlineConn is embedded by the wrappers of a user conn, it passes the
+// deadline of the idle timeout to the conn they wrap.
+type deadlineConn struct {
+	io.ReadWriteCloser
+}
+
+func (c deadlineConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// prefixConn reads a prefix before the data of the conn.
+type prefixConn struct {
+	deadlineConn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// validHeaderRules accepts header rules on http proxys only, the server
+// reads no http of the others.
+func validHeaderRules(msg *proto.MsgProxyReq) error {
+	if !hasHeaderRules(msg) {
+		return nil
+	}
+	if msg.ProxyType != "http" {
+		return fmt.Errorf("header rules are not supported by %s proxy", msg.ProxyType)
+	}
+	if _, err := proxy.ParseHeaderRules(msg.RequestHeaders); err != nil {
+		return fmt.Errorf("invalid request header rules: %v", err)
+	}
+	if _, err := proxy.ParseHeaderRules(msg.ResponseHeaders); err != nil {
+		return fmt.Errorf("invalid response header rules: %v", err)
+	}
+	return nil
+}
+
+func hasHeaderRules(msg *proto.MsgProxyReq) bool {
+	return len(msg.RequestHeaders) > 0 || len(msg.ResponseHeaders) > 0
+}
+
+// validProxyProtocol accepts the PROXY protocol versions on the stream proxys
+// whose target reads the user conn data as is.
+func validProxyProtocol(version, proxyType string) error {
+	if version == "" {
+		return nil
+	}
+	if version != proxy.ProxyProtocolV1 && version != proxy.ProxyProtocolV2 {
+		return fmt.Errorf("invalid proxy protocol version: %s, expected v1 or v2", version)
+	}
+	if proxyType != "tcp" && proxyType != "http" && proxyType != "tls" {
+		return fmt.Errorf("proxy protocol is not supported by %s proxy", proxyType)
 	}
+	return nil
 }
 
-func (s *Server) handleExchangeMsg(conn net.Conn, msg *proto.MsgExchange) error {
+func (s *Server) handleExchangeMsg(ctx context.Context, conn net.Conn, msg *proto.MsgExchange) error {
+	// Shutdown closes closing under s.mu before it waits on active, an
+	// exchange either sees it closed or is waited for
+	s.mu.Lock()
+	if s.isClosing() {
+		s.mu.Unlock()
+		conn.Close()
+		return fmt.Errorf("server is shutting down, drop exchange: %s", msg.ConnId)
+	}
+	s.active.Add(1)
+	s.mu.Unlock()
+	defer s.active.Done()
+	s.prom.ActiveConns.Inc()
+	defer s.prom.ActiveConns.Dec()
+
+	clogger := s.log.WithConnId(msg.ConnId)
 	switch msg.ProxyType {
 	case "udp":
-		logger.Debugf("Receive udp conn exchange msg from client: %s", msg.ConnId)
+		clogger.Debug("Receive udp conn exchange msg from client")
 		uConn, ok := s.udpConnMap.Get(msg.ConnId)
 		if !ok {
 			return fmt.Errorf("udp connection not found: %s", msg.ConnId)
 		}
 		defer s.udpConnMap.Del(msg.ConnId)
-		proxy.UDPDatagram(conn, uConn)
-	case "tcp":
-		logger.Debugf("Receive tcp conn exchange msg from client: %s", msg.ConnId)
-		uConn, ok := s.tcpConnMap.Get(msg.ConnId)
+		proxy.UDPDatagram(conn, uConn, clogger)
+	case "tcp", "http", "tls", "socks5":
+		clogger.Debug("Receive tcp conn exchange msg from client")
+		// claimed, the auto expire must not close it anymore
+		uConn, uPort, ok := s.tcpConnMap.Get(msg.ConnId)
 		if !ok {
 			return fmt.Errorf("tcp connection not found: %s", msg.ConnId)
 		}
 
-		defer s.tcpConnMap.Del(msg.ConnId)
-		proxy.Stream(conn, uConn)
+		_, span := s.tracer.Start(ctx, "proxy_stream", trace.WithAttributes(
+			tracing.ConnId(msg.ConnId),
+			attribute.String("proxy_type", msg.ProxyType),
+			attribute.Int("port", uPort),
+		))
+		defer span.End()
+
+		var tConn io.ReadWriteCloser = conn
+		if s.resources.compressed(uPort) {
+			tConn = pio.NewCompressReadWriter(conn)
+		}
+		remote := s.sessions.remoteAddr(msg.ConnId) // the session ends with the stream
+		traffic, err := proxy.StreamContext(s.streamCtx, tConn, uConn, s.config().IdleTimeout, clogger)
+		if err != nil {
+			clogger.Warnf("Error proxying user conn on port %d: %v", uPort, err)
+			tracing.Fail(span, err)
+			traffic.Failed = true
+		}
+		span.SetAttributes(
+			attribute.Int64("upward_bytes", traffic.UpwardBytes),
+			attribute.Int64("downward_bytes", traffic.DownwardBytes),
+		)
+		s.resources.addTraffic(uPort, traffic)
+		port := uPort
+		if msg.Port != 0 {
+			port = msg.Port // of a port range
+		}
+		s.logAccess(msg.ConnId, msg.ProxyType, port, remote, traffic)
+		clogger.Debug("User conn closed")
 	default:
 		return fmt.Errorf("invalid proxy type: %s", msg.ProxyType)
 	}
@@ -454,38 +1315,301 @@ func (s *Server) handleExchangeMsg(conn net.Conn, msg *proto.MsgExchange) error
 func (rm *resourceManager) isAvailablePort(port int) bool {
 	rm.m.RLock()
 	defer rm.m.RUnlock()
+	if port == 0 {
+		return true
+	}
 	return port > 0 && port < 65535 && !rm.portManager[port]
 }
 
-func (rm *resourceManager) addProxy(f Proxy) {
+// portProxy is the proxy listening on port, including the ports of ranges.
+func (rm *resourceManager) portProxy(port int) (Proxy, bool) {
+	rm.m.RLock()
+	defer rm.m.RUnlock()
+	for _, proxy := range rm.proxys {
+		if proxy.hasPort(port) {
+			return proxy, true
+		}
+	}
+	return Proxy{}, false
+}
+
+func (rm *resourceManager) compressed(port int) bool {
+	rm.m.RLock()
+	defer rm.m.RUnlock()
+	for _, proxy := range rm.proxys {
+		if proxy.Port == port {
+			return proxy.Compress
+		}
+	}
+	return false
+}
+
+// freePort picks a random port in min-max that no proxy uses, 0 if it finds none.
+// The port may still be bound by other processes.
+func (rm *resourceManager) freePort(min, max int) int {
+	rm.m.RLock()
+	defer rm.m.RUnlock()
+
+	for i := 0; i < 100; i++ {
+		port := min + rand.Intn(max-min+1)
+		if !rm.portManager[port] {
+			return port
+		}
+	}
+	return 0
+}
+
+var (
+	errTooManyProxys = errors.New("too many proxys on server")
+	errDomainUsed    = errors.New("domain already used")
+	errInUse         = errors.New("already in use")
+)
+
+// addRejectCode is the reject code of an error of distrDomain or addProxy.
+func addRejectCode(err error) proto.RejectCode {
+	switch {
+	case errors.Is(err, errTooManyProxys):
+		return proto.RejectLimit
+	case errors.Is(err, errDomainUsed), errors.Is(err, errInUse):
+		return proto.RejectInUse
+	}
+	return proto.RejectInternal
+}
+
+// setMaxProxys changes the limit of full when the config is reloaded.
+func (rm *resourceManager) setMaxProxys(max int) {
+	rm.m.Lock()
+	defer rm.m.Unlock()
+	rm.maxProxys = max
+}
+
+// full reports whether the server reached max proxys, 0 means unlimited.
+func (rm *resourceManager) full() bool {
+	rm.m.RLock()
+	defer rm.m.RUnlock()
+	return rm.maxProxys > 0 && len(rm.proxys) >= rm.maxProxys
+}
+
+// addProxy checks the limit again under the lock, concurrent requests may all pass full.
+func (rm *resourceManager) addProxy(f Proxy) error {
 	rm.m.Lock()
 	defer rm.m.Unlock()
 
+	if rm.maxProxys > 0 && len(rm.proxys) >= rm.maxProxys {
+		return errTooManyProxys
+	}
+	// concurrent requests may all pass isAvailablePort and distrDomain,
+	// e.g. the same port bound on different hosts
+	for _, port := range f.ports() {
+		if rm.portManager[port] {
+			return fmt.Errorf("port %d %w", port, errInUse)
+		}
+	}
+	if f.Domain != "" && rm.domainManager[f.Domain] {
+		return errDomainUsed
+	}
+
 	rm.proxys = append(rm.proxys, f)
-	rm.portManager[f.Port] = true
+	rm.nproxys.Add(1)
+	rm.prom.ProxyRegistered.Inc()
+	for _, port := range f.ports() {
+		rm.portManager[port] = true
+	}
 	rm.domainManager[f.Domain] = true
+	rm.events.publish(eventProxyAdd, f)
+	return nil
 }
 
-func (rm *resourceManager) removeProxy(port int) {
+// removeProxy removes the proxy on port if its client logged in on the
+// listener zone, and reports whether it did.
+func (rm *resourceManager) removeProxy(port int, zone int) bool {
 	rm.m.Lock()
 	defer rm.m.Unlock()
 	for i, proxy := range rm.proxys {
-		if proxy.Port == port {
-			proxy.Closer.Close()
-			if rm.domainManager[proxy.Domain] {
-				delCaddyRouter(fmt.Sprintf("%s.%d", proxy.Domain, proxy.Port))
+		if proxy.hasPort(port) {
+			// the cancel doesn't tell which client it is from, each of them
+			// leaves the shared proxy when its control connection closes
+			if proxy.backends.len() > 1 || proxy.backends.first().zone != zone {
+				return false
 			}
+			rm.closeProxy(proxy)
 			rm.proxys = append(rm.proxys[:i], rm.proxys[i+1:]...)
-			delete(rm.portManager, proxy.Port)
-			delete(rm.domainManager, proxy.Domain)
-			return
+			rm.prom.ProxyCanceled.Inc()
+			return true
+		}
+	}
+	return false
+}
+
+// removeCtrlProxy removes the client of ctrl from the proxy only if it still
+// serves it, the port may already be reused by another client. The proxy is
+// removed with its last client.
+func (rm *resourceManager) removeCtrlProxy(port int, ctrl net.Conn, reason string) bool {
+	rm.m.Lock()
+	defer rm.m.Unlock()
+	for i, proxy := range rm.proxys {
+		if proxy.Port == port && proxy.backends.has(ctrl) {
+			rm.reclaim(i, ctrl, reason)
+			return true
+		}
+	}
+	return false
+}
+
+// removeCtrls removes the clients matched by ctrl from every proxy they serve
+// and returns the reclaimed ports.
+func (rm *resourceManager) removeCtrls(match func(ctrl net.Conn) bool, reason string) []int {
+	rm.m.Lock()
+	defer rm.m.Unlock()
+
+	ports := []int{}
+	for i := 0; i < len(rm.proxys); i++ {
+		proxy := rm.proxys[i]
+		for _, b := range proxy.backends.list() {
+			if !match(b.ctrl) {
+				continue
+			}
+			ports = append(ports, proxy.Port)
+			if rm.reclaim(i, b.ctrl, reason) {
+				// the proxy is gone, the next one moved to i
+				i--
+				break
+			}
+		}
+	}
+	return ports
+}
+
+// reclaim removes the client of ctrl from the proxy at i, and the proxy when
+// it was the last client, which is reported. It must be called with rm.m held.
+func (rm *resourceManager) reclaim(i int, ctrl net.Conn, reason string) bool {
+	proxy := rm.proxys[i]
+	removed := proxy.backends.len() == 1
+	if removed {
+		rm.closeProxy(proxy)
+		rm.proxys = append(rm.proxys[:i], rm.proxys[i+1:]...)
+		rm.prom.ProxyCanceled.Inc()
+	} else {
+		proxy.backends.remove(ctrl)
+		ctrl.Close()
+	}
+
+	rm.events.publish(eventProxyReclaim, reclaimEvent{
+		Port:    proxy.Port,
+		From:    ctrl.RemoteAddr().String(),
+		Reason:  reason,
+		Removed: removed,
+	})
+	return removed
+}
+
+// cancelProxy closes the proxy on port and tells its clients to stop serving
+// it instead of reconnecting like on a broken control connection, reason is
+// logged by them, e.g. "ttl expired".
+func (rm *resourceManager) cancelProxy(port int, reason string) bool {
+	proxy, ok := rm.unlinkProxy(port)
+	if !ok {
+		return false
+	}
+
+	// a client that stops reading must not hold the lock, the cancels are
+	// sent without it and each one gets a deadline
+	msg := proto.NewMsgCancel("", "", proxy.Port)
+	msg.Reason = reason
+	for _, b := range proxy.backends.list() {
+		b.ctrl.SetWriteDeadline(time.Now().Add(cancelWriteTimeout))
+		if err := proto.Send(b.ctrl, msg); err != nil {
+			rm.log.Warnf("Error sending proxy cancel msg to client: %v", err)
+		}
+	}
+
+	rm.m.Lock()
+	rm.closeProxy(proxy)
+	rm.m.Unlock()
+	rm.prom.ProxyCanceled.Inc()
+	return true
+}
+
+// cancelWriteTimeout bounds sending the cancel to one client of a proxy.
+const cancelWriteTimeout = 5 * time.Second
+
+// unlinkProxy takes the proxy on port out of the proxys, it is not closed.
+func (rm *resourceManager) unlinkProxy(port int) (Proxy, bool) {
+	rm.m.Lock()
+	defer rm.m.Unlock()
+	for i, proxy := range rm.proxys {
+		if proxy.hasPort(port) {
+			rm.proxys = append(rm.proxys[:i], rm.proxys[i+1:]...)
+			return proxy, true
 		}
 	}
+	return Proxy{}, false
+}
+
+func (rm *resourceManager) removeAll() {
+	rm.m.Lock()
+	defer rm.m.Unlock()
+	for _, proxy := range rm.proxys {
+		rm.closeProxy(proxy)
+	}
+	rm.proxys = []Proxy{}
+}
+
+// closeProxy must be called with rm.m held.
+func (rm *resourceManager) closeProxy(proxy Proxy) {
+	rm.nproxys.Add(-1)
+	proxy.Closer.Close()
+	for _, b := range proxy.backends.list() {
+		b.ctrl.Close()
+	}
+	if proxy.Domain != "" && !routedType(proxy.Type) && rm.domainManager[proxy.Domain] {
+		delCaddyRouter(fmt.Sprintf("%s.%d", proxy.Domain, proxy.Port), rm.log)
+	}
+	for _, port := range proxy.ports() {
+		delete(rm.portManager, port)
+	}
+	delete(rm.domainManager, proxy.Domain)
+	rm.events.publish(eventProxyRemove, proxy)
+	if rm.onClose != nil {
+		rm.onClose(proxy)
+	}
+}
+
+func (rm *resourceManager) addTraffic(port int, t metrics.Traffic) {
+	t.Port = port
+	rm.traffics.add(t)
+}
+
+func (rm *resourceManager) listProxys() []Proxy {
+	rm.m.RLock()
+	defer rm.m.RUnlock()
+
+	return append([]Proxy{}, rm.proxys...)
+}
+
+// listTraffics returns the traffic summed by proxy port.
+func (rm *resourceManager) listTraffics() []metrics.TrafficSummary {
+	rm.m.RLock()
+	defer rm.m.RUnlock()
+
+	return metrics.Merge(rm.savedTraffics, rm.traffics.snapshot())
 }
 
 type Proxy struct {
-	Port   int
-	From   string
-	Domain string
-	Closer io.Closer
+	Name     string    `json:"name"` // proxy name of the client, not unique
+	Host     string    `json:"host"` // bound ip, empty means all interfaces
+	Port     int       `json:"port"`
+	PortEnd  int       `json:"port_end,omitempty"` // last port of a port range
+	Network  string    `json:"network,omitempty"`  // tcp4 or tcp6 when the port listens on one family
+	From     string    `json:"from"`
+	Domain   string    `json:"domain"`
+	Type     string    `json:"type"`
+	Compress bool      `json:"compress"`
+	Closer   io.Closer `json:"-"`
+
+	TerminateTLS bool `json:"terminate_tls,omitempty"` // the server terminates the tls of the users with its edge certs
+
+	Expires *time.Time `json:"expires_at,omitempty"` // when the ttl cancels the proxy, nil without one
+
+	backends *backendGroup // clients serving the proxy
 }
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abcdlsj/gnar/pkg/proto"
+)
+
+func TestHandleTCPUserConnOverQuota(t *testing.T) {
+	for _, proxyType := range []string{"tcp", "http"} {
+		t.Run(proxyType, func(t *testing.T) {
+			cfg, err := defaultConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.ClientMaxConns = 1
+			cfg.NoBackendResponse = true
+			s := New(cfg)
+			if s.initErr != nil {
+				t.Fatal(s.initErr)
+			}
+
+			ctrl, clientCtrl := net.Pipe()
+			defer ctrl.Close()
+			defer clientCtrl.Close()
+			b := &backend{ctrl: ctrl, client: "203.0.113.7", req: &proto.MsgProxyReq{ProxyType: proxyType}}
+			// the client already has its one conn
+			s.clients.get(b.client).conns.Add(1)
+
+			user, userConn := net.Pipe()
+			defer user.Close()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				s.handleTCPUserConn(userConn, 9000, b)
+			}()
+
+			user.SetReadDeadline(time.Now().Add(5 * time.Second))
+			got, err := io.ReadAll(user)
+			if err != nil {
+				t.Fatalf("user conn is not closed: %v", err)
+			}
+			if proxyType == "http" && !strings.HasPrefix(string(got), "HTTP/1.1 502") {
+				t.Fatalf("http user got %q, want the 502 page", got)
+			}
+			if proxyType == "tcp" && len(got) != 0 {
+				t.Fatalf("tcp user got %q, want nothing", got)
+			}
+			<-done
+
+			// no exchange reaches the client
+			clientCtrl.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if _, err := clientCtrl.Read(make([]byte, 1)); err == nil {
+				t.Fatal("client got an exchange of a conn over its quota")
+			}
+			if n := s.clients.get(b.client).conns.Load(); n != 1 {
+				t.Fatalf("client has %d conns, want 1", n)
+			}
+		})
+	}
+}
+
+func TestProxyOfOtherListener(t *testing.T) {
+	cfg, err := defaultConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(cfg)
+	if s.initErr != nil {
+		t.Fatal(s.initErr)
+	}
+
+	ctrl, clientCtrl := net.Pipe()
+	defer clientCtrl.Close()
+	user, _ := net.Pipe()
+	req := &proto.MsgProxyReq{ProxyName: "web", ProxyType: "tcp", RemotePort: 9000}
+	b := &backend{ctrl: ctrl, zone: 8911, req: req}
+	if err := s.resources.addProxy(Proxy{Name: "web", Port: 9000, Type: "tcp", Closer: user, backends: newBackendGroup(balanceRoundRobin, b, nil, 0)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, _ := s.resources.join("web", 9000, "", &backend{zone: 0, req: req}); ok {
+		t.Fatal("client of the server port joined a proxy of listener 8911")
+	}
+	if s.resources.removeProxy(9000, 0) {
+		t.Fatal("client of the server port canceled a proxy of listener 8911")
+	}
+	if !s.resources.removeProxy(9000, 8911) {
+		t.Fatal("client of listener 8911 could not cancel its proxy")
+	}
+}
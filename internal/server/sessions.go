@@ -0,0 +1,217 @@
+package server
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// session is a live user conn of a proxy, its bytes are counted as they flow.
+type session struct {
+	connId     string
+	port       int
+	remoteAddr string
+	start      time.Time
+	conn       io.Closer
+	upward     atomic.Int64 // read from the user
+	downward   atomic.Int64 // written to the user
+}
+
+type sessionStat struct {
+	ConnId          string    `json:"conn_id"`
+	RemoteAddr      string    `json:"remote_addr"`
+	StartTime       time.Time `json:"start_time"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	UpwardBytes     int64     `json:"upward_bytes"`
+	DownwardBytes   int64     `json:"downward_bytes"`
+}
+
+// sessionMap holds the live user conns of the tcp proxys by conn id.
+type sessionMap struct {
+	sessions map[string]*session
+	mu       sync.RWMutex
+}
+
+func newSessionMap() *sessionMap {
+	return &sessionMap{
+		sessions: make(map[string]*session),
+	}
+}
+
+// track adds conn as a session of the proxy on port until it is closed.
+func (m *sessionMap) track(id string, port int, remote net.Addr, conn io.ReadWriteCloser) io.ReadWriteCloser {
+	sess := &session{
+		connId:     id,
+		port:       port,
+		remoteAddr: remote.String(),
+		start:      time.Now(),
+	}
+
+	sc := &sessionConn{deadlineConn: deadlineConn{conn}, sess: sess, done: func() { m.remove(id) }}
+	sess.conn = sc
+
+	m.mu.Lock()
+	m.sessions[id] = sess
+	m.mu.Unlock()
+	return sc
+}
+
+func (m *sessionMap) remove(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+}
+
+func (m *sessionMap) has(id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.sessions[id]
+	return ok
+}
+
+// remoteAddr is the user addr of the live session id, empty when it is gone.
+func (m *sessionMap) remoteAddr(id string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if sess, ok := m.sessions[id]; ok {
+		return sess.remoteAddr
+	}
+	return ""
+}
+
+// list returns the sessions of the proxy on port, the oldest first.
+func (m *sessionMap) list(port int) []sessionStat {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	stats := []sessionStat{}
+	for _, sess := range m.sessions {
+		if sess.port != port {
+			continue
+		}
+		stats = append(stats, sessionStat{
+			ConnId:          sess.connId,
+			RemoteAddr:      sess.remoteAddr,
+			StartTime:       sess.start,
+			DurationSeconds: now.Sub(sess.start).Seconds(),
+			UpwardBytes:     sess.upward.Load(),
+			DownwardBytes:   sess.downward.Load(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].StartTime.Before(stats[j].StartTime) })
+	return stats
+}
+
+// bytes returns the bytes moved so far by the sessions, summed by port.
+func (m *sessionMap) bytes() map[int]int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	bytes := make(map[int]int64)
+	for _, sess := range m.sessions {
+		bytes[sess.port] += sess.upward.Load() + sess.downward.Load()
+	}
+	return bytes
+}
+
+// closePort closes the sessions of the proxy on port.
+func (m *sessionMap) closePort(port int) {
+	m.mu.RLock()
+	conns := []io.Closer{}
+	for _, sess := range m.sessions {
+		if sess.port == port {
+			conns = append(conns, sess.conn)
+		}
+	}
+	m.mu.RUnlock()
+
+	// closing removes the sessions, not under the lock
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// ofPort returns the live sessions of the proxy on port.
+func (m *sessionMap) ofPort(port int) []*session {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sessions := []*session{}
+	for _, sess := range m.sessions {
+		if sess.port == port {
+			sessions = append(sessions, sess)
+		}
+	}
+	return sessions
+}
+
+// closeLive closes the sessions that are still live and returns how many.
+func (m *sessionMap) closeLive(sessions []*session) int {
+	m.mu.RLock()
+	conns := []io.Closer{}
+	for _, sess := range sessions {
+		if m.sessions[sess.connId] == sess {
+			conns = append(conns, sess.conn)
+		}
+	}
+	m.mu.RUnlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+// drainSessions closes the sessions of a closed proxy once the cancel grace
+// period is over, 0 lets them run until they end. The sessions are taken
+// now, a proxy that takes the port meanwhile keeps its own.
+func (s *Server) drainSessions(proxy Proxy) {
+	if s.isClosing() {
+		return // shutdown drains the conns itself
+	}
+	sessions := s.sessions.ofPort(proxy.Port)
+	if len(sessions) == 0 {
+		return
+	}
+
+	// not under the config lock, reload may wait for the resource lock
+	go func() {
+		grace := s.config().CancelGracePeriod
+		if grace <= 0 {
+			return
+		}
+		s.log.Infof("Proxy on port %d closed, %d user conns may finish within %s", proxy.Port, len(sessions), grace)
+		time.Sleep(grace)
+		if n := s.sessions.closeLive(sessions); n > 0 {
+			s.log.Infof("Closed %d user conns of port %d left after the grace period", n, proxy.Port)
+		}
+	}()
+}
+
+type sessionConn struct {
+	deadlineConn
+	sess *session
+	once sync.Once
+	done func()
+}
+
+func (c *sessionConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.sess.upward.Add(int64(n))
+	return n, err
+}
+
+func (c *sessionConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.sess.downward.Add(int64(n))
+	return n, err
+}
+
+func (c *sessionConn) Close() error {
+	c.once.Do(c.done)
+	return c.ReadWriteCloser.Close()
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// flushSpans exports the spans of the closed connections, bounded so an
+// unreachable collector does not hold the exit.
+func (s *Server) flushSpans() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.tracer.Shutdown(ctx); err != nil {
+		s.log.Warnf("Error exporting spans: %v", err)
+	}
+}
+
+func (s *Server) isClosing() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops accepting control connections, closes all proxy listeners and
+// waits for active proxied connections to finish or ctx to be done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.isClosing() {
+		close(s.closing)
+	}
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.httpListener != nil {
+		s.httpListener.Close()
+	}
+	if s.sniListener != nil {
+		s.sniListener.Close()
+	}
+	if s.wsListener != nil {
+		s.wsListener.Close()
+	}
+	if s.quicListener != nil {
+		s.quicListener.Close()
+	}
+	if s.quicTransport != nil {
+		// it ends the quic connections, after the drain
+		defer s.quicTransport.Close()
+	}
+	for _, a := range s.acceptors {
+		a.Close()
+	}
+	adminServers := s.adminServers
+	s.mu.Unlock()
+
+	// the admin requests in flight finish, event streams end on closing
+	for _, srv := range adminServers {
+		if err := srv.Shutdown(ctx); err != nil {
+			s.log.Warnf("Error shutting down admin server: %v", err)
+		}
+	}
+
+	s.resources.removeAll()
+	defer s.accessLog.close()
+	defer s.resources.traffics.stop()
+	defer s.flushTraffics()
+	defer s.flushSpans()
+
+	drained := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		s.log.Info("Server shutdown, all connections drained")
+		return nil
+	case <-ctx.Done():
+		s.log.Warnf("Server shutdown before connections drained: %v", ctx.Err())
+		// abort the rest, give them a moment to record their traffic before the flush
+		s.abortStreams()
+		select {
+		case <-drained:
+		case <-time.After(time.Second):
+		}
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const sniReadTimeout = 10 * time.Second
+
+var (
+	hostnameRe = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+	errClientHelloRead = errors.New("client hello read")
+
+	// a fatal unrecognized_name alert, for conns whose sni no proxy claims
+	tlsAlertUnrecognizedName = []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x70}
+)
+
+// startSNIServer serves all tls proxys on one port, conns are routed to the
+// proxy whose hostname matches the sni of the ClientHello. The tls session
+// is passed through as is, certificates stay with the local services.
+func (s *Server) startSNIServer() error {
+	if s.cfg.HTTPSPort == 0 {
+		return nil
+	}
+
+	listener, err := s.listenTCP(net.JoinHostPort(s.cfg.BindHost, fmt.Sprint(s.cfg.HTTPSPort)))
+	if err != nil {
+		return fmt.Errorf("error listening https port: %v", err)
+	}
+
+	s.mu.Lock()
+	s.sniListener = listener
+	s.mu.Unlock()
+
+	s.log.Infof("Https server listening on port %d", s.cfg.HTTPSPort)
+	go func() {
+		err := s.acceptLoop(listener, func(conn net.Conn) {
+			go s.handleSNIConn(conn)
+		})
+		if err != nil && !s.isClosing() {
+			s.log.Errorf("Error accepting https conn: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) handleSNIConn(conn net.Conn) {
+	// record the ClientHello, it is replayed to the client
+	var consumed bytes.Buffer
+	conn.SetReadDeadline(time.Now().Add(sniReadTimeout))
+	sni, err := readSNI(io.TeeReader(conn, &consumed))
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		s.log.Debugf("Error reading tls client hello from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	proxy, ok := s.resources.vhost("tls", strings.ToLower(sni))
+	if !ok && s.edge != nil && s.edge.serves(sni) {
+		// http proxys and the acme hosts, terminated like a tls proxy
+		if conn, ok := s.terminateTLS(&replayConn{Conn: conn, r: io.MultiReader(&consumed, conn)}); ok {
+			s.handleVhostConn(conn)
+		}
+		return
+	}
+	if !ok {
+		s.log.Debugf("No tls proxy for sni: %s", sni)
+		conn.Write(tlsAlertUnrecognizedName)
+		conn.Close()
+		return
+	}
+
+	if !proxy.backends.rate.allow(conn.RemoteAddr()) {
+		s.log.Debugf("User conn from %s over conn rate, sni: %s", conn.RemoteAddr(), sni)
+		conn.Close()
+		return
+	}
+
+	conn = &replayConn{Conn: conn, r: io.MultiReader(&consumed, conn)}
+	if proxy.TerminateTLS {
+		if conn, ok = s.terminateTLS(conn); !ok {
+			return
+		}
+	}
+
+	conn, ok = proxy.backends.limit.admit(conn, proxy.Port, s.log)
+	if !ok {
+		return
+	}
+
+	b := proxy.backends.pick(conn.RemoteAddr())
+	if b == nil {
+		s.log.Debugf("No client serving sni %s, drop user conn from %s", sni, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	acl, _ := newIPACL(b.req.AllowIPs, b.req.DenyIPs) // validated at registration
+	if !acl.allowed(conn.RemoteAddr()) {
+		s.log.Debugf("User conn from %s denied by ip rules, sni: %s", conn.RemoteAddr(), sni)
+		conn.Close()
+		return
+	}
+
+	s.handleTCPUserConn(conn, proxy.Port, b)
+}
+
+// readSNI reads a ClientHello from r and returns its server name, the
+// handshake is aborted right after the hello is parsed.
+func readSNI(r io.Reader) (string, error) {
+	var sni string
+	err := tls.Server(helloConn{r: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if sni != "" {
+		return sni, nil
+	}
+	if errors.Is(err, errClientHelloRead) {
+		return "", errors.New("no sni in client hello")
+	}
+	return "", err
+}
+
+// helloConn only reads, the alert of the aborted handshake is not sent.
+type helloConn struct {
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c helloConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c helloConn) Close() error                       { return nil }
+func (c helloConn) LocalAddr() net.Addr                { return nil }
+func (c helloConn) RemoteAddr() net.Addr               { return nil }
+func (c helloConn) SetDeadline(t time.Time) error      { return nil }
+func (c helloConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c helloConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// validHostname accepts an empty hostname (the subdomain) or a dns name.
+func validHostname(host string) error {
+	if host != "" && (len(host) > 253 || !hostnameRe.MatchString(host)) {
+		return fmt.Errorf("invalid hostname: %s", host)
+	}
+	return nil
+}
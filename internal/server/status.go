@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/abcdlsj/gnar/internal/metrics"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// StatusCommand prints the proxys of a running server, read from its admin api.
+func StatusCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show proxys of a running gnar server",
+		Long: `Show proxys of a running gnar server from its admin server
+
+Exits non-zero when the admin server is unreachable, so it can be used as a health check.
+Every option can also be set by GNAR_ prefixed environment variable, e.g. GNAR_ADMIN_TOKEN.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			viper.BindPFlags(cmd.Flags())
+			viper.AutomaticEnv()
+			viper.SetEnvPrefix("GNAR")
+			viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+
+			stats, err := fetchProxyStats(viper.GetString("admin-addr"), AdminAuth{
+				User:     viper.GetString("admin-user"),
+				Password: viper.GetString("admin-password"),
+				Token:    viper.GetString("admin-token"),
+			}, viper.GetDuration("timeout"))
+			if err != nil {
+				return err
+			}
+
+			printProxyStats(os.Stdout, stats)
+			return nil
+		},
+	}
+
+	cmd.Flags().String("admin-addr", "localhost:8911", "admin server address, host:port, url or unix:/path of the admin socket")
+	cmd.Flags().String("admin-user", "", "basic auth user of admin server")
+	cmd.Flags().String("admin-password", "", "basic auth password of admin server")
+	cmd.Flags().String("admin-token", "", "bearer token of admin server")
+	cmd.Flags().Duration("timeout", 5*time.Second, "timeout of the admin request")
+
+	return cmd
+}
+
+func fetchProxyStats(addr string, auth AdminAuth, timeout time.Duration) ([]proxyStat, error) {
+	client := &http.Client{Timeout: timeout}
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// the host of the url is not dialed, any name does
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		addr = "http://admin"
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/api/forwards", nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid admin address: %v", err)
+	}
+	if auth.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+auth.Token)
+	} else if auth.User != "" || auth.Password != "" {
+		req.SetBasicAuth(auth.User, auth.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to admin server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("admin server responded %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	stats := []proxyStat{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, fmt.Errorf("error decoding admin response: %v", err)
+	}
+	return stats, nil
+}
+
+func printProxyStats(w io.Writer, stats []proxyStat) {
+	if len(stats) == 0 {
+		fmt.Fprintln(w, "No active proxys")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PORT\tNAME\tTYPE\tHOST\tDOMAIN\tFROM\tCLIENTS\tCONNS\tUP\tDOWN\tEXPIRES")
+	for _, p := range stats {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n",
+			p.portLabel(), orDash(p.Name), p.typeLabel(), orDash(p.Host), orDash(p.Domain), p.From, p.Clients, p.Conns,
+			metrics.HumanBytes(float64(p.UpwardBytes)), metrics.HumanBytes(float64(p.DownwardBytes)), p.ttlLabel())
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d proxys\n", len(stats))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/abcdlsj/gnar/internal/auth"
+	"github.com/abcdlsj/gnar/pkg/proto"
+)
+
+// ReservedSubdomain keeps a subdomain for the clients logging in with its
+// token or its client id, so they get the same hostname on every connect.
+type ReservedSubdomain struct {
+	Subdomain string `mapstructure:"subdomain"`
+	Token     string `mapstructure:"token"`  // optional, also a login token
+	Client    string `mapstructure:"client"` // optional, the id the Authorizer gets, e.g. the common name of a certificate
+}
+
+// The subdomain-policy values, what a client asking for a subdomain nobody
+// reserved gets.
+const (
+	subdomainAllow  = "allow"  // the subdomain it asked for, the default
+	subdomainRandom = "random" // a random one
+	subdomainReject = "reject" // rejected, only reserved subdomains are served
+)
+
+func validSubdomains(cfg Config) error {
+	switch cfg.SubdomainPolicy {
+	case "", subdomainAllow, subdomainRandom, subdomainReject:
+	default:
+		return fmt.Errorf("invalid subdomain policy: %s, expected allow, random or reject", cfg.SubdomainPolicy)
+	}
+	if len(cfg.Subdomains) > 0 && cfg.Domain == "" {
+		return errors.New("reserved subdomains need domain")
+	}
+
+	subs := make(map[string]bool)
+	for _, r := range cfg.Subdomains {
+		sub := strings.ToLower(r.Subdomain)
+		if sub == "" || validHostname(sub) != nil {
+			return fmt.Errorf("invalid reserved subdomain: %q", r.Subdomain)
+		}
+		if subs[sub] {
+			return fmt.Errorf("duplicate reserved subdomain: %s", sub)
+		}
+		subs[sub] = true
+		if r.Token == "" && r.Client == "" {
+			return fmt.Errorf("reserved subdomain %s needs a token or a client", sub)
+		}
+	}
+	return nil
+}
+
+// owns reports whether the client logged in with login is the one r is
+// reserved for.
+func (r ReservedSubdomain) owns(login *proto.MsgLogin, client string) bool {
+	if r.Client != "" && r.Client == client {
+		return true
+	}
+	return r.Token != "" && auth.NewTokenAuthenticator(r.Token).VerifyLogin(login)
+}
+
+// checkSubdomain gives a proxy the subdomain reserved for its client when it
+// asks for none, and rejects it when it asks for one reserved for another
+// client. A subdomain nobody reserved is handled by the subdomain policy.
+func checkSubdomain(cfg Config, login *proto.MsgLogin, client string, msg *proto.MsgProxyReq) (proto.RejectCode, error) {
+	if len(cfg.Subdomains) == 0 && cfg.SubdomainPolicy != subdomainReject {
+		return "", nil
+	}
+	// only these get a subdomain, see distrDomain
+	if (!cfg.DomainTunnel && !routedType(msg.ProxyType)) || msg.ProxyType == "socks5" || msg.RemotePortEnd != 0 {
+		return "", nil
+	}
+	if msg.ProxyType == "tls" && msg.Hostname != "" {
+		return "", nil
+	}
+
+	sub := strings.ToLower(msg.Subdomain)
+	if sub == "" {
+		for _, r := range cfg.Subdomains {
+			if r.owns(login, client) {
+				msg.Subdomain = strings.ToLower(r.Subdomain)
+				return "", nil
+			}
+		}
+		if cfg.SubdomainPolicy == subdomainReject {
+			return proto.RejectDenied, errors.New("no subdomain reserved for the client")
+		}
+		return "", nil
+	}
+
+	for _, r := range cfg.Subdomains {
+		if strings.ToLower(r.Subdomain) != sub {
+			continue
+		}
+		if !r.owns(login, client) {
+			return proto.RejectAuth, fmt.Errorf("subdomain %s is reserved for another client", sub)
+		}
+		return "", nil
+	}
+
+	switch cfg.SubdomainPolicy {
+	case subdomainRandom:
+		msg.Subdomain = ""
+	case subdomainReject:
+		return proto.RejectDenied, fmt.Errorf("subdomain %s is not reserved", sub)
+	}
+	return "", nil
+}
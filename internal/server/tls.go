@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/abcdlsj/gnar/pkg/share"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// loadTLSConfig is the tls config of the control listeners, nil when tls is
+// disabled. With a client ca file clients must present a certificate it signed.
+func loadTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading tls certificate: %v", err)
+	}
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if cfg.ClientCAFile != "" {
+		pool, err := share.LoadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading tls client ca: %v", err)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, nil
+}
+
+// handshake completes the tls handshake of a control conn before any message
+// is read, so clients without a valid certificate are rejected before the
+// login. Conns without tls pass.
+func (s *Server) handshake(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		s.log.Infof("Client certificate verified, subject: %s, client addr: %s", certs[0].Subject, conn.RemoteAddr())
+	}
+	return nil
+}
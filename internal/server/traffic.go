@@ -0,0 +1,125 @@
+package server
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/abcdlsj/gnar/internal/metrics"
+)
+
+// trafficBufSize is how many finished conns may wait for the aggregator
+// before their goroutines block.
+const trafficBufSize = 1024
+
+// trafficStats sums the traffic of finished user conns by port. The conns
+// hand their traffic to one goroutine over a buffered channel, so they take
+// no lock shared with the proxys, and only the totals and the recent
+// history are kept.
+type trafficStats struct {
+	ch     chan metrics.Traffic
+	syncCh chan chan struct{}
+	done   chan struct{}
+	once   sync.Once
+
+	totals map[int]*metrics.TrafficSummary
+	rings  map[int]*historyRing
+	mu     sync.RWMutex
+
+	prom   *metrics.Prometheus
+	events *eventBus
+}
+
+func newTrafficStats(prom *metrics.Prometheus, events *eventBus) *trafficStats {
+	ts := &trafficStats{
+		ch:     make(chan metrics.Traffic, trafficBufSize),
+		syncCh: make(chan chan struct{}),
+		done:   make(chan struct{}),
+		totals: make(map[int]*metrics.TrafficSummary),
+		rings:  make(map[int]*historyRing),
+		prom:   prom,
+		events: events,
+	}
+	go ts.run()
+	return ts
+}
+
+// add queues t, it is dropped once the stats are stopped.
+func (ts *trafficStats) add(t metrics.Traffic) {
+	select {
+	case ts.ch <- t:
+	case <-ts.done:
+	}
+}
+
+func (ts *trafficStats) run() {
+	for {
+		select {
+		case t := <-ts.ch:
+			ts.aggregate(t)
+		case synced := <-ts.syncCh:
+			// what was queued before the sync is in the buffer already
+			for n := len(ts.ch); n > 0; n-- {
+				ts.aggregate(<-ts.ch)
+			}
+			close(synced)
+		case <-ts.done:
+			return
+		}
+	}
+}
+
+func (ts *trafficStats) aggregate(t metrics.Traffic) {
+	ts.mu.Lock()
+	sum, ok := ts.totals[t.Port]
+	if !ok {
+		sum = &metrics.TrafficSummary{Port: t.Port}
+		ts.totals[t.Port] = sum
+	}
+	sum.UpwardBytes += t.UpwardBytes
+	sum.DownwardBytes += t.DownwardBytes
+	sum.Conns++
+	sum.Seconds += t.Duration().Seconds()
+	if t.Failed {
+		sum.Errors++
+	}
+
+	ring, ok := ts.rings[t.Port]
+	if !ok {
+		ring = &historyRing{}
+		ts.rings[t.Port] = ring
+	}
+	ring.add(t)
+	ts.mu.Unlock()
+
+	ts.prom.AddTraffic(t)
+	ts.events.publish(eventTraffic, t)
+}
+
+// sync waits until the traffic added so far is in the totals, e.g. before
+// they are saved.
+func (ts *trafficStats) sync() {
+	synced := make(chan struct{})
+	select {
+	case ts.syncCh <- synced:
+		<-synced
+	case <-ts.done:
+	}
+}
+
+// snapshot returns the totals by port, ordered by port.
+func (ts *trafficStats) snapshot() []metrics.TrafficSummary {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	summaries := make([]metrics.TrafficSummary, 0, len(ts.totals))
+	for _, sum := range ts.totals {
+		summaries = append(summaries, *sum)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Port < summaries[j].Port })
+	return summaries
+}
+
+// stop ends the aggregator, the totals stay readable.
+func (ts *trafficStats) stop() {
+	ts.once.Do(func() { close(ts.done) })
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const capCheckInterval = time.Second
+
+var byteSizeRe = regexp.MustCompile(`^([0-9]+)([kmgt]?)b$`)
+
+// parseBytes parses a size like 500mb or 10gb, empty means 0.
+func parseBytes(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	m := byteSizeRe.FindStringSubmatch(size)
+	if m == nil {
+		return 0, fmt.Errorf("invalid size: %s, expected e.g. 500mb or 10gb", size)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %s: %v", size, err)
+	}
+	shift := map[string]uint{"": 0, "k": 10, "m": 20, "g": 30, "t": 40}[m[2]]
+	if n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid size: %s, too large", size)
+	}
+	return n << shift, nil
+}
+
+// proxyCap is the traffic cap of the proxy on port, the one of its reserved
+// proxy or proxy-traffic-cap, 0 means unlimited.
+func proxyCap(cfg Config, port int) (int64, string) {
+	size := cfg.ProxyTrafficCap
+	if p, ok := reservedProxy(cfg, port); ok && p.TrafficCap != "" {
+		size = p.TrafficCap
+	}
+	n, _ := parseBytes(size) // validated with the config
+	return n, size
+}
+
+func hasTrafficCaps(cfg Config) bool {
+	if cfg.TrafficCap != "" || cfg.ProxyTrafficCap != "" {
+		return true
+	}
+	for _, p := range cfg.Proxys {
+		if p.TrafficCap != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// trafficUsage returns the bytes moved by port, of the closed user conns,
+// saved across restarts, and the live ones.
+func (s *Server) trafficUsage() map[int]int64 {
+	usage := s.sessions.bytes()
+	for _, t := range s.resources.listTraffics() {
+		usage[t.Port] += t.UpwardBytes + t.DownwardBytes
+	}
+	return usage
+}
+
+// capExceeded returns why the proxy on port is over a traffic cap, empty
+// when it is not.
+func capExceeded(cfg Config, usage map[int]int64, port int) string {
+	if limit, _ := parseBytes(cfg.TrafficCap); limit > 0 {
+		var total int64
+		for _, n := range usage {
+			total += n
+		}
+		if total >= limit {
+			return fmt.Sprintf("server traffic cap %s reached", cfg.TrafficCap)
+		}
+	}
+	if limit, size := proxyCap(cfg, port); port != 0 && limit > 0 && usage[port] >= limit {
+		return fmt.Sprintf("traffic cap %s of port %d reached", size, port)
+	}
+	return ""
+}
+
+// checkTrafficCap rejects a new proxy on port when the server or the port
+// has used up its traffic cap.
+func (s *Server) checkTrafficCap(port int) error {
+	cfg := s.config()
+	if !hasTrafficCaps(cfg) {
+		return nil
+	}
+	if reason := capExceeded(cfg, s.trafficUsage(), port); reason != "" {
+		return errors.New(reason)
+	}
+	return nil
+}
+
+// startCapWatcher cancels the proxys that used up their traffic cap, or all
+// of them when the server did, and closes their user conns.
+func (s *Server) startCapWatcher() {
+	go func() {
+		ticker := time.NewTicker(capCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.closing:
+				return
+			case <-ticker.C:
+				s.enforceTrafficCaps()
+			}
+		}
+	}()
+}
+
+func (s *Server) enforceTrafficCaps() {
+	cfg := s.config()
+	if !hasTrafficCaps(cfg) {
+		return
+	}
+
+	usage := s.trafficUsage()
+	for _, p := range s.resources.listProxys() {
+		if reason := capExceeded(cfg, usage, p.Port); reason != "" {
+			s.capProxy(p.Port, reason)
+		}
+	}
+}
+
+func (s *Server) capProxy(port int, reason string) {
+	if s.resources.cancelProxy(port, reason) {
+		s.log.Warnf("Proxy port %d canceled: %s", port, reason)
+	}
+	s.sessions.closePort(port)
+}
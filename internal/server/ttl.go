@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/abcdlsj/gnar/pkg/proto"
+)
+
+const ttlCheckInterval = time.Second
+
+func validTTLs(cfg Config) error {
+	if cfg.ProxyTTL < 0 || cfg.MaxProxyTTL < 0 {
+		return fmt.Errorf("invalid proxy ttl: %s, max: %s", cfg.ProxyTTL, cfg.MaxProxyTTL)
+	}
+	if cfg.MaxProxyTTL > 0 && cfg.ProxyTTL > cfg.MaxProxyTTL {
+		return fmt.Errorf("proxy-ttl %s is over max-proxy-ttl %s", cfg.ProxyTTL, cfg.MaxProxyTTL)
+	}
+	return nil
+}
+
+// proxyTTL is how long the proxy of msg lives, the ttl the client asked for
+// or the server default, 0 lives until it is canceled. Without a default
+// every proxy gets max-proxy-ttl when there is one.
+func proxyTTL(cfg Config, msg *proto.MsgProxyReq) (time.Duration, error) {
+	if msg.TTL < 0 {
+		return 0, fmt.Errorf("invalid ttl: %ds", msg.TTL)
+	}
+	ttl := time.Duration(msg.TTL) * time.Second
+	if ttl == 0 {
+		ttl = cfg.ProxyTTL
+	}
+	if cfg.MaxProxyTTL > 0 {
+		if ttl > cfg.MaxProxyTTL {
+			return 0, fmt.Errorf("ttl %s is over the server max %s", ttl, cfg.MaxProxyTTL)
+		}
+		if ttl == 0 {
+			ttl = cfg.MaxProxyTTL
+		}
+	}
+	return ttl, nil
+}
+
+// ttlLabel is the time left until the ttl cancels the proxy, for display.
+func (p Proxy) ttlLabel() string {
+	if p.Expires == nil {
+		return "-"
+	}
+	left := time.Until(*p.Expires).Round(time.Second)
+	if left < 0 {
+		left = 0
+	}
+	return left.String()
+}
+
+// startTTLWatcher cancels the proxys whose ttl ran out, their user conns are
+// left to cancel-grace-period like the ones of a canceled proxy.
+func (s *Server) startTTLWatcher() {
+	go func() {
+		ticker := time.NewTicker(ttlCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.closing:
+				return
+			case now := <-ticker.C:
+				s.expireProxys(now)
+			}
+		}
+	}()
+}
+
+func (s *Server) expireProxys(now time.Time) {
+	for _, p := range s.resources.listProxys() {
+		if p.Expires == nil || now.Before(*p.Expires) {
+			continue
+		}
+		if s.resources.cancelProxy(p.Port, "ttl expired") {
+			s.log.Infof("Proxy port %d canceled: ttl expired", p.Port)
+		}
+	}
+}
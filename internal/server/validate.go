@@ -0,0 +1,207 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/abcdlsj/gnar/pkg/proto"
+	"github.com/abcdlsj/gnar/pkg/share"
+)
+
+var speedLimitRe = regexp.MustCompile(`^[0-9]+[kmg]?b$`)
+
+// validateConfig checks the config without binding anything, it returns a
+// line for every part checked before the first error.
+func validateConfig(cfg Config) ([]string, error) {
+	checked := []string{}
+
+	ports := make(map[int]string)
+	names := []string{}
+	for _, p := range []struct {
+		name string
+		port int
+	}{
+		{"port", cfg.Port},
+		{"admin-port", cfg.AdminPort},
+		{"http-port", cfg.HTTPPort},
+		{"https-port", cfg.HTTPSPort},
+		{"ws-port", cfg.WSPort},
+	} {
+		if p.port == 0 && p.name != "port" {
+			continue
+		}
+		if p.port < 1 || p.port > 65535 {
+			return checked, fmt.Errorf("invalid %s: %d", p.name, p.port)
+		}
+		if other, ok := ports[p.port]; ok {
+			return checked, fmt.Errorf("%s %d is already used by %s", p.name, p.port, other)
+		}
+		ports[p.port] = p.name
+		names = append(names, fmt.Sprintf("%s %d", p.name, p.port))
+	}
+	checked = append(checked, "server ports: "+strings.Join(names, ", "))
+
+	if err := validateListeners(cfg, ports); err != nil {
+		return checked, fmt.Errorf("invalid listeners: %v", err)
+	}
+	if len(cfg.Listeners) > 0 {
+		checked = append(checked, fmt.Sprintf("listeners: %d", len(cfg.Listeners)))
+	}
+
+	if cfg.MinPort < 1 || cfg.MaxPort > 65535 || cfg.MinPort > cfg.MaxPort {
+		return checked, fmt.Errorf("invalid port range: %d-%d", cfg.MinPort, cfg.MaxPort)
+	}
+	checked = append(checked, fmt.Sprintf("remote port range: %d-%d", cfg.MinPort, cfg.MaxPort))
+	if err := validAutoPorts(cfg); err != nil {
+		return checked, err
+	}
+	if cfg.AutoPorts != "" {
+		checked = append(checked, "auto ports: "+cfg.AutoPorts)
+	}
+
+	if err := validateReserved(cfg.Proxys); err != nil {
+		return checked, fmt.Errorf("invalid reserved proxys: %v", err)
+	}
+	for _, p := range cfg.Proxys {
+		if !cfg.allowedPort(p.RemotePort) {
+			return checked, fmt.Errorf("reserved port %d is out of port range %d-%d", p.RemotePort, cfg.MinPort, cfg.MaxPort)
+		}
+		if name, ok := ports[p.RemotePort]; ok {
+			return checked, fmt.Errorf("reserved port %d is already used by %s", p.RemotePort, name)
+		}
+	}
+	checked = append(checked, fmt.Sprintf("reserved proxys: %d", len(cfg.Proxys)))
+
+	if err := validBindHost(cfg.BindHost); err != nil {
+		return checked, err
+	}
+	if cfg.HTTPPort != 0 && cfg.Domain == "" {
+		return checked, errors.New("http-port needs domain")
+	}
+	// udp, it may share its number with a tcp port
+	if cfg.QUICPort < 0 || cfg.QUICPort > 65535 {
+		return checked, fmt.Errorf("invalid quic-port: %d", cfg.QUICPort)
+	}
+	if cfg.WSPort != 0 && !strings.HasPrefix(cfg.WSPath, "/") {
+		return checked, fmt.Errorf("invalid ws-path: %q, expected a path like /ws", cfg.WSPath)
+	}
+	if cfg.DomainTunnel && cfg.Domain == "" {
+		return checked, errors.New("domain-tunnel needs domain")
+	}
+	if err := validBalance(cfg.LoadBalance); err != nil {
+		return checked, err
+	}
+	if cfg.AffinityTimeout < 0 {
+		return checked, fmt.Errorf("invalid affinity-timeout: %s", cfg.AffinityTimeout)
+	}
+	if cfg.SpeedLimit != "" && !speedLimitRe.MatchString(cfg.SpeedLimit) {
+		return checked, fmt.Errorf("invalid speed-limit: %s, expected e.g. 512kb or 1mb", cfg.SpeedLimit)
+	}
+	if err := validTTLs(cfg); err != nil {
+		return checked, err
+	}
+	if _, err := parseBytes(cfg.TrafficCap); err != nil {
+		return checked, fmt.Errorf("invalid traffic-cap: %v", err)
+	}
+	if _, err := parseBytes(cfg.ProxyTrafficCap); err != nil {
+		return checked, fmt.Errorf("invalid proxy-traffic-cap: %v", err)
+	}
+	if err := validSubdomains(cfg); err != nil {
+		return checked, err
+	}
+	if len(cfg.Subdomains) > 0 {
+		checked = append(checked, fmt.Sprintf("reserved subdomains: %d", len(cfg.Subdomains)))
+	}
+	if err := validClientQuotas(cfg); err != nil {
+		return checked, err
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		return checked, fmt.Errorf("invalid heartbeat-interval: %s", cfg.HeartbeatInterval)
+	}
+	if cfg.ExchangeTimeout <= 0 {
+		return checked, fmt.Errorf("invalid exchange-timeout: %s", cfg.ExchangeTimeout)
+	}
+	if err := validAuthBans(cfg); err != nil {
+		return checked, err
+	}
+	if len(cfg.Banner) > maxBannerLen {
+		return checked, fmt.Errorf("banner is over %d bytes", maxBannerLen)
+	}
+	if err := validEdgeCerts(cfg); err != nil {
+		return checked, err
+	}
+	if cfg.HandshakeTimeout < 0 {
+		return checked, fmt.Errorf("invalid handshake-timeout: %s", cfg.HandshakeTimeout)
+	}
+	if cfg.BindRetries < 0 || cfg.BindRetryDelay < 0 {
+		return checked, fmt.Errorf("invalid bind retries: %d, delay: %s", cfg.BindRetries, cfg.BindRetryDelay)
+	}
+	if cfg.ConnRate < 0 || cfg.ConnBurst < 0 {
+		return checked, fmt.Errorf("invalid conn rate: %d, burst: %d", cfg.ConnRate, cfg.ConnBurst)
+	}
+	if cfg.MaxPortRange < 0 {
+		return checked, fmt.Errorf("invalid max-port-range: %d", cfg.MaxPortRange)
+	}
+	if cfg.ListenBacklog < 0 {
+		return checked, fmt.Errorf("invalid listen-backlog: %d", cfg.ListenBacklog)
+	}
+	if cfg.AcceptWorkers < 0 {
+		return checked, fmt.Errorf("invalid accept-workers: %d", cfg.AcceptWorkers)
+	}
+	if cfg.CopyBufferSize <= 0 {
+		return checked, fmt.Errorf("invalid copy-buffer-size: %d", cfg.CopyBufferSize)
+	}
+	if cfg.MaxPacketSize <= 0 || cfg.MaxPacketSize > proto.MaxPacketSize {
+		return checked, fmt.Errorf("invalid max-packet-size: %d, expected 1-%d", cfg.MaxPacketSize, proto.MaxPacketSize)
+	}
+	checked = append(checked, "proxy options")
+
+	switch {
+	case cfg.TLS.Enabled():
+		if _, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile); err != nil {
+			return checked, fmt.Errorf("error loading tls certificate: %v", err)
+		}
+		checked = append(checked, fmt.Sprintf("tls certificate: %s, key: %s", cfg.TLS.CertFile, cfg.TLS.KeyFile))
+	case cfg.TLS.CertFile != "" || cfg.TLS.KeyFile != "":
+		return checked, errors.New("tls-cert-file and tls-key-file must be set together")
+	}
+	if cfg.TLS.ClientCAFile != "" {
+		if !cfg.TLS.Enabled() {
+			return checked, errors.New("tls-client-ca-file needs tls-cert-file and tls-key-file")
+		}
+		if _, err := share.LoadCertPool(cfg.TLS.ClientCAFile); err != nil {
+			return checked, fmt.Errorf("error loading tls-client-ca-file: %v", err)
+		}
+		checked = append(checked, "tls client ca: "+cfg.TLS.ClientCAFile)
+	}
+
+	if _, err := noBackendResponse(cfg); err != nil {
+		return checked, err
+	}
+	if cfg.NoBackendResponse && cfg.NoBackendPage != "" {
+		checked = append(checked, "no backend page: "+cfg.NoBackendPage)
+	}
+
+	if cfg.AdminSocket != "" {
+		dir := filepath.Dir(cfg.AdminSocket)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return checked, fmt.Errorf("admin-socket directory %s does not exist", dir)
+		}
+		checked = append(checked, "admin socket: "+cfg.AdminSocket)
+	}
+
+	if cfg.MetricsFile != "" {
+		dir := filepath.Dir(cfg.MetricsFile)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return checked, fmt.Errorf("metrics-file directory %s does not exist", dir)
+		}
+		checked = append(checked, "metrics file: "+cfg.MetricsFile)
+	}
+
+	return checked, nil
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/abcdlsj/gnar/pkg/proto"
+)
+
+const vhostReadTimeout = 10 * time.Second
+
+// startVhostServer serves all http proxys on one port, requests are routed to
+// the proxy whose domain matches the Host header.
+func (s *Server) startVhostServer() error {
+	if s.cfg.HTTPPort == 0 {
+		return nil
+	}
+
+	listener, err := s.listenTCP(net.JoinHostPort(s.cfg.BindHost, fmt.Sprint(s.cfg.HTTPPort)))
+	if err != nil {
+		return fmt.Errorf("error listening http port: %v", err)
+	}
+
+	s.mu.Lock()
+	s.httpListener = listener
+	s.mu.Unlock()
+
+	s.log.Infof("Http server listening on port %d", s.cfg.HTTPPort)
+	go func() {
+		err := s.acceptLoop(listener, func(conn net.Conn) {
+			go s.handleVhostConn(conn)
+		})
+		if err != nil && !s.isClosing() {
+			s.log.Errorf("Error accepting http conn: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) handleVhostConn(conn net.Conn) {
+	// record what the request parsing consumed, it is replayed to the client
+	var consumed bytes.Buffer
+	conn.SetReadDeadline(time.Now().Add(vhostReadTimeout))
+	req, err := http.ReadRequest(bufio.NewReader(io.TeeReader(conn, &consumed)))
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		s.log.Debugf("Error reading http request from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if s.isACMEChallenge(req) {
+		s.serveACMEChallenge(conn, req)
+		return
+	}
+
+	proxy, ok := s.resources.vhost("http", strings.ToLower(hostname(req.Host)))
+	if !ok {
+		s.log.Debugf("No http proxy for host: %s", req.Host)
+		io.WriteString(conn, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		conn.Close()
+		return
+	}
+
+	if !proxy.backends.rate.allow(conn.RemoteAddr()) {
+		s.log.Debugf("User conn from %s over conn rate, host: %s", conn.RemoteAddr(), req.Host)
+		io.WriteString(conn, "HTTP/1.1 429 Too Many Requests\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		conn.Close()
+		return
+	}
+
+	conn, ok = proxy.backends.limit.admit(conn, proxy.Port, s.log)
+	if !ok {
+		return
+	}
+
+	b := proxy.backends.pick(conn.RemoteAddr())
+	if b == nil {
+		if s.noBackend == nil {
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		}
+		s.dropNoBackend("http", conn)
+		return
+	}
+
+	acl, _ := newIPACL(b.req.AllowIPs, b.req.DenyIPs) // validated at registration
+	if !acl.allowed(conn.RemoteAddr()) {
+		s.log.Debugf("User conn from %s denied by ip rules, host: %s", conn.RemoteAddr(), req.Host)
+		io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		conn.Close()
+		return
+	}
+
+	s.handleTCPUserConn(&replayConn{Conn: conn, r: io.MultiReader(&consumed, conn)}, proxy.Port, b)
+}
+
+// vhostDomain is the domain of the http proxy of sub.
+func vhostDomain(sub, domain string) string {
+	return strings.ToLower(fmt.Sprintf("%s.%s", sub, domain))
+}
+
+// routedType tells the proxys reached through a shared port by hostname,
+// http by the Host header and tls by the sni.
+func routedType(proxyType string) bool {
+	return proxyType == "http" || proxyType == "tls"
+}
+
+// routedDomain is the hostname the proxy asks for, the claimed hostname of a
+// tls proxy or the subdomain of domain, empty when it asks for neither.
+func routedDomain(msg *proto.MsgProxyReq, domain string) string {
+	if msg.ProxyType == "tls" && msg.Hostname != "" {
+		return strings.ToLower(msg.Hostname)
+	}
+	if msg.Subdomain == "" {
+		return ""
+	}
+	return vhostDomain(msg.Subdomain, domain)
+}
+
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// replayConn reads the already consumed bytes before the rest of the conn.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (rm *resourceManager) vhost(proxyType, domain string) (Proxy, bool) {
+	rm.m.RLock()
+	defer rm.m.RUnlock()
+	for _, proxy := range rm.proxys {
+		if proxy.Type == proxyType && proxy.Domain == domain {
+			return proxy, true
+		}
+	}
+	return Proxy{}, false
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// startWSServer accepts control conns upgraded to websocket on the ws path,
+// for clients that can only reach the server through http proxies. The
+// upgraded conns are handled like the ones of the server port.
+func (s *Server) startWSServer() error {
+	if s.cfg.WSPort == 0 {
+		return nil
+	}
+
+	listener, err := s.listenTCP(fmt.Sprintf(":%d", s.cfg.WSPort))
+	if err != nil {
+		return fmt.Errorf("error listening websocket port: %v", err)
+	}
+	scheme := "ws"
+	if s.tlsCfg != nil {
+		listener = tls.NewListener(listener, s.tlsCfg)
+		scheme = "wss"
+	}
+
+	s.mu.Lock()
+	s.wsListener = listener
+	s.mu.Unlock()
+
+	mux := http.NewServeMux()
+	mux.Handle(s.cfg.WSPath, websocket.Server{
+		// clients are no browsers, there is no origin to check
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   s.handleWSConn,
+	})
+
+	s.log.Infof("Websocket server listening on port %d, path: %s, scheme: %s", s.cfg.WSPort, s.cfg.WSPath, scheme)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil && !s.isClosing() {
+			s.log.Errorf("Error serving websocket: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) handleWSConn(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	conn := newWSConn(ws)
+	s.handleConnection(conn, nil)
+	// the websocket is closed when the handler returns
+	<-conn.closed
+}
+
+// wsConn is a websocket control conn, with the tcp addr of the client as the
+// remote addr instead of the origin.
+type wsConn struct {
+	*websocket.Conn
+	remote net.Addr
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	var remote net.Addr = ws.RemoteAddr()
+	if addr, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr); err == nil {
+		remote = addr
+	}
+	return &wsConn{
+		Conn:   ws,
+		remote: remote,
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *wsConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,72 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/abcdlsj/gnar/pkg/share"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const instrumentationName = "github.com/abcdlsj/gnar"
+
+// Tracer creates the spans of a server, spans are exported over otlp http
+// when it has an endpoint. It has an own provider instead of the global one,
+// so that multiple servers do not collide in one process.
+type Tracer struct {
+	trace.Tracer
+	provider *sdktrace.TracerProvider // nil when tracing is disabled
+}
+
+// New returns a no-op tracer when endpoint is empty, recording spans then
+// costs next to nothing. endpoint is the url of the otlp http collector,
+// e.g. http://localhost:4318.
+func New(endpoint, service string) (*Tracer, error) {
+	if endpoint == "" {
+		return &Tracer{Tracer: noop.NewTracerProvider().Tracer(instrumentationName)}, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("error creating otlp exporter: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName(service),
+			semconv.ServiceVersion(share.GetVersion()),
+		)),
+	)
+	return &Tracer{Tracer: provider.Tracer(instrumentationName), provider: provider}, nil
+}
+
+func (t *Tracer) Enabled() bool {
+	return t.provider != nil
+}
+
+// Shutdown exports the buffered spans, it does nothing when tracing is disabled.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t.provider == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}
+
+// ConnId is the attribute of the conn id, the same id the logs are tagged with.
+func ConnId(id string) attribute.KeyValue {
+	return attribute.String("conn_id", id)
+}
+
+// Fail marks the span failed with err.
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,46 @@
+// Package proto is the wire protocol between the gnar client and server,
+// for implementing either side outside of this module.
+//
+// # Packets
+//
+// A packet is one byte of PacketType, the length of the payload as two
+// bytes big endian, then the payload, a json object of the Msg of the type:
+//
+//	+------+--------+-----------------+
+//	| type | length | payload (json)  |
+//	+------+--------+-----------------+
+//	  1 B    2 B      0-65535 B
+//
+// Marshal encodes a Msg into a packet, Read splits one off a conn and
+// Unmarshal decodes its payload, ReadMsg does both. Send and Recv are the
+// same for a conn and a Msg of a known type.
+//
+// # Sessions
+//
+// Every control conn starts with a MsgLogin of the client, the server
+// answers a refused one with a MsgLoginReject. Then the client sends one of
+//
+//   - MsgProxyReq to register a proxy, answered by a MsgProxyResp and an
+//     optional MsgBanner. The conn stays open for the server to send
+//     MsgHeartbeat, MsgExchange for every user conn and MsgProxyCancel when
+//     it cancels the proxy. The client sends MsgHeartbeat on it too, a
+//     MsgExchangeFail for a user conn it can't claim and a MsgProxyCancel to
+//     release the proxy, the server closes the conn once it did.
+//   - MsgExchange with the conn id of one the server sent, the conn is the
+//     tunnel of that user conn from then on, its data follows unframed.
+//   - MsgProxyCancel to cancel its proxy on the remote port, as older
+//     clients do.
+//
+// UDP proxys carry their datagrams as MsgUDPDatagram over the exchanged
+// conn.
+//
+// # Compatibility
+//
+// ProtoVersion is the version of the packets defined here, a client sends
+// it in its login and a server refuses the ones below MinProtoVersion. The
+// values of the packet types and the json names of the fields don't change
+// within a version. New fields are optional, peers that don't know them
+// ignore them, and peers skip packets of types they don't know, so a newer
+// server may send them to an older client. Changes that break this bump
+// ProtoVersion.
+package proto
@@ -3,9 +3,13 @@ package proto
 import "errors"
 
 var (
-	ErrInvalidMsg   = errors.New("invalid message")
-	ErrMsgRead      = errors.New("error reading from connection")
-	ErrMsgLength    = errors.New("invalid message length")
-	ErrInvalidToken = errors.New("invalid token")
-	ErrMsgUnmarshal = errors.New("error unmarshalling message")
+	ErrInvalidMsg    = errors.New("invalid message")
+	ErrMsgRead       = errors.New("error reading from connection")
+	ErrMsgWrite      = errors.New("error writing to connection")
+	ErrMsgLength     = errors.New("invalid message length")
+	ErrMsgTooLarge   = errors.New("message too large")
+	ErrInvalidToken  = errors.New("invalid token")
+	ErrMsgUnmarshal  = errors.New("error unmarshalling message")
+	ErrRejected      = errors.New("rejected by server")
+	ErrUnknownPacket = errors.New("unknown packet type")
 )
@@ -6,45 +6,138 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"runtime"
 	"time"
 
 	"github.com/abcdlsj/gnar/pkg/share"
 )
 
+// Msg is the payload of a packet, its Type is the one of the packet.
 type Msg interface {
 	Type() PacketType
 }
 
+// NewMsg returns an empty Msg of typ for decoding a payload into, nil for
+// the types it doesn't know.
+func NewMsg(typ PacketType) Msg {
+	switch typ {
+	case PacketLogin:
+		return &MsgLogin{}
+	case PacketHeartbeat:
+		return &MsgHeartbeat{}
+	case PacketProxyReq:
+		return &MsgProxyReq{}
+	case PacketProxyResp:
+		return &MsgProxyResp{}
+	case PacketProxyCancel:
+		return &MsgProxyCancel{}
+	case PacketExchange:
+		return &MsgExchange{}
+	case PacketUDPDatagram:
+		return &MsgUDPDatagram{}
+	case PacketLoginReject:
+		return &MsgLoginReject{}
+	case PacketBanner:
+		return &MsgBanner{}
+	case PacketExchangeFail:
+		return &MsgExchangeFail{}
+	default:
+		return nil
+	}
+}
+
+// Marshal encodes msg into a packet, a payload over MaxPacketSize fails with
+// ErrMsgLength.
+func Marshal(msg Msg) ([]byte, error) {
+	return packet(msg.Type(), msg)
+}
+
+// Unmarshal decodes the payload of a packet of typ. Types NewMsg doesn't
+// know fail with ErrUnknownPacket, a peer of an older version skips them.
+func Unmarshal(typ PacketType, payload []byte) (Msg, error) {
+	msg := NewMsg(typ)
+	if msg == nil {
+		return nil, fmt.Errorf("%w: 0x%02x", ErrUnknownPacket, byte(typ))
+	}
+	if err := json.Unmarshal(payload, msg); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrMsgUnmarshal, typ, err)
+	}
+	return msg, nil
+}
+
+// ReadMsg reads the next packet of r and decodes it, see Unmarshal.
+func ReadMsg(r io.Reader) (Msg, error) {
+	typ, payload, err := read(r)
+	if err != nil {
+		return nil, err
+	}
+	return Unmarshal(typ, payload)
+}
+
+// Send writes msg to w as one packet. A failed write returns ErrMsgWrite
+// with the cause, after a part of the packet the framing of w is broken and
+// it is best closed.
 func Send(w io.Writer, msg Msg) error {
-	buf, err := packet(msg.Type(), msg)
+	buf, err := Marshal(msg)
 	if err != nil {
 		return err
 	}
-	_, err = w.Write(buf)
-	return err
+	return writeFull(w, buf)
+}
+
+// writeFull writes buf with as many Writes as it takes. io.Writer only
+// allows short writes with an error, but not every wrapped conn keeps to
+// that. A writer that gets a whole packet in one Write, like a net.Conn,
+// keeps the packets of concurrent Sends apart.
+func writeFull(w io.Writer, buf []byte) error {
+	written := 0
+	for written < len(buf) {
+		n, err := w.Write(buf[written:])
+		written += n
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			if written > 0 {
+				return fmt.Errorf("%w: %d of %d bytes: %w", ErrMsgWrite, written, len(buf), err)
+			}
+			return fmt.Errorf("%w: %w", ErrMsgWrite, err)
+		}
+	}
+	return nil
 }
 
+// Recv reads the next packet of r into msg, a packet of another type fails
+// with ErrInvalidMsg. A login reject returns its *RejectError instead.
 func Recv(r io.Reader, msg Msg) error {
 	p, buf, err := read(r)
 	if err != nil {
 		return err
 	}
 
+	if p == PacketLoginReject && msg.Type() != PacketLoginReject {
+		return ParseRejectPacket(buf)
+	}
+
 	if p != msg.Type() {
 		return ErrInvalidMsg
 	}
 
 	if err := json.Unmarshal(buf, msg); err != nil {
-		return err
+		return fmt.Errorf("%w: %s: %v", ErrMsgUnmarshal, p, err)
 	}
 
 	return nil
 }
 
+// Read reads the next packet of r and returns its type and payload. A
+// packet over the size of SetMaxPacketSize fails with ErrMsgTooLarge.
 func Read(r io.Reader) (PacketType, []byte, error) {
 	return read(r)
 }
 
+// MsgHeartbeat is sent by the server on the conn of every proxy each
+// heartbeat interval, the client takes a silent conn for dead.
 type MsgHeartbeat struct{}
 
 func (m *MsgHeartbeat) Type() PacketType {
@@ -55,83 +148,232 @@ func NewMsgHeartbeat() *MsgHeartbeat {
 	return &MsgHeartbeat{}
 }
 
+// MsgLogin starts every control conn of a client. Token is the md5 of the
+// token and the unix Timestamp in hex, see NewMsgLogin.
 type MsgLogin struct {
-	Token     string `json:"token"`
-	Version   string `json:"version"`
-	Timestamp int64  `json:"timestamp"`
+	Token        string `json:"token"`
+	Version      string `json:"version"`
+	ProtoVersion int    `json:"proto_version"`
+	Timestamp    int64  `json:"timestamp"`
+
+	Platform string `json:"platform,omitempty"` // os/arch the client runs on, e.g. linux/amd64
 }
 
 func (m *MsgLogin) Type() PacketType {
 	return PacketLogin
 }
 
+// Proto returns the wire protocol version of the client, clients before
+// versioning don't send it and speak version 1.
+func (m *MsgLogin) Proto() int {
+	if m.ProtoVersion == 0 {
+		return 1
+	}
+	return m.ProtoVersion
+}
+
 func NewMsgLogin(token string) *MsgLogin {
 	ts := time.Now().Unix()
 	hash := md5.New()
 	hash.Write([]byte(token + fmt.Sprintf("%d", ts)))
 
 	return &MsgLogin{
-		Token:     fmt.Sprintf("%x", hash.Sum(nil)),
-		Version:   share.GetVersion(),
-		Timestamp: ts,
+		Token:        fmt.Sprintf("%x", hash.Sum(nil)),
+		Version:      share.GetVersion(),
+		ProtoVersion: ProtoVersion,
+		Timestamp:    ts,
+		Platform:     runtime.GOOS + "/" + runtime.GOARCH,
 	}
 }
 
+// MsgLoginReject answers any packet of a client the server won't serve.
+type MsgLoginReject struct {
+	Code   RejectCode `json:"code,omitempty"`
+	Reason string     `json:"reason"`
+}
+
+func (m *MsgLoginReject) Type() PacketType {
+	return PacketLoginReject
+}
+
+func NewMsgLoginReject(code RejectCode, reason string) *MsgLoginReject {
+	return &MsgLoginReject{
+		Code:   code,
+		Reason: reason,
+	}
+}
+
+// MsgProxyReq registers a proxy on RemotePort, 0 lets the server pick one.
 type MsgProxyReq struct {
-	RemotePort int    `json:"remote_port"`
-	ProxyName  string `json:"proxy_name"`
-	Subdomain  string `json:"subdomain"`
-	ProxyType  string `json:"proxy_type"`
+	RemotePort    int `json:"remote_port"`
+	RemotePortEnd int `json:"remote_port_end,omitempty"` // last port of a range from RemotePort, 0 means one port
+
+	ProxyName string `json:"proxy_name"`
+	Subdomain string `json:"subdomain"`
+	ProxyType string `json:"proxy_type"`
+	RateLimit int    `json:"rate_limit"`          // bytes per second, 0 means unlimited
+	BindHost  string `json:"bind_host,omitempty"` // ip to bind the remote port, empty means all interfaces
+	Network   string `json:"network,omitempty"`   // family of the remote port, tcp4 or tcp6, empty or tcp means both
+	Compress  bool   `json:"compress,omitempty"`  // ask to compress the tunnel traffic
+
+	// AllowIPs and DenyIPs are cidr or ip rules of user conns, with AllowIPs
+	// only matching ips are accepted.
+	AllowIPs []string `json:"allow_ips,omitempty"`
+	DenyIPs  []string `json:"deny_ips,omitempty"`
+
+	// MaxConns caps the concurrent user conns, 0 means unlimited. Overflow
+	// is what happens to conns over the cap, "reject" (default) or "queue".
+	MaxConns int    `json:"max_conns,omitempty"`
+	Overflow string `json:"overflow,omitempty"`
+
+	// ConnRate caps the new user conns per second of every remote ip, with
+	// ConnBurst at once, 0 means unlimited.
+	ConnRate  int `json:"conn_rate,omitempty"`
+	ConnBurst int `json:"conn_burst,omitempty"`
+
+	// ProxyProtocol asks to send a PROXY protocol header, "v1" or "v2", with
+	// the user addr to the local target before the user conn data.
+	ProxyProtocol string `json:"proxy_protocol,omitempty"`
+
+	// RequestHeaders and ResponseHeaders are the header rules of an http
+	// proxy, "Name: value" sets a header and "-Name" removes it.
+	RequestHeaders  []string `json:"request_headers,omitempty"`
+	ResponseHeaders []string `json:"response_headers,omitempty"`
+
+	// Hostname claims the full hostname of a tls proxy routed by sni, empty
+	// means the subdomain of the server domain.
+	Hostname string `json:"hostname,omitempty"`
+	// TerminateTLS asks the server to terminate the tls of a tls proxy with
+	// a certificate of its hostname, the client gets the plain conns.
+	TerminateTLS bool `json:"terminate_tls,omitempty"`
+
+	// Weight is the share of user conns the client takes among the clients
+	// of a load balanced proxy, 0 means 1.
+	Weight int `json:"weight,omitempty"`
+
+	// TTL is the seconds the proxy lives before the server cancels it, 0
+	// means the server default.
+	TTL int `json:"ttl,omitempty"`
 }
 
 func (m *MsgProxyReq) Type() PacketType {
 	return PacketProxyReq
 }
 
-func NewMsgProxy(proxyName, subdomain, proxyType string, remotePort int) *MsgProxyReq {
+func NewMsgProxy(proxyName, subdomain, proxyType, bindHost string, remotePort, rateLimit int, compress bool) *MsgProxyReq {
 	return &MsgProxyReq{
+		Compress:   compress,
+		BindHost:   bindHost,
 		ProxyName:  proxyName,
 		Subdomain:  subdomain,
 		RemotePort: remotePort,
 		ProxyType:  proxyType,
+		RateLimit:  rateLimit,
 	}
 }
 
+// MsgProxyResp answers a MsgProxyReq, Status is "success" for a registered
+// proxy, "rejected" or "failed" with Code and Reason for a refused one.
 type MsgProxyResp struct {
-	Domain string `json:"domain"`
-	Status string `json:"status"`
+	Domain     string     `json:"domain"`
+	Status     string     `json:"status"`
+	RemotePort int        `json:"remote_port"`
+	Reason     string     `json:"reason,omitempty"`   // why the proxy is not created
+	Code       RejectCode `json:"code,omitempty"`     // of the reason
+	Compress   bool       `json:"compress,omitempty"` // server agreed to compress the tunnel traffic
+
+	ProxyProtocol string `json:"proxy_protocol,omitempty"` // PROXY protocol version the server sends
+	Headers       bool   `json:"headers,omitempty"`        // server applies the header rules
+	TTL           int    `json:"ttl,omitempty"`            // seconds until the server cancels the proxy, 0 means never
+	TerminateTLS  bool   `json:"terminate_tls,omitempty"`  // server terminates the tls of the users
 }
 
 func (m *MsgProxyResp) Type() PacketType {
 	return PacketProxyResp
 }
 
-func NewMsgProxyResp(domain, status string) *MsgProxyResp {
+func NewMsgProxyResp(domain, status string, remotePort int, compress bool) *MsgProxyResp {
+	return &MsgProxyResp{
+		Compress:   compress,
+		Domain:     domain,
+		Status:     status,
+		RemotePort: remotePort,
+	}
+}
+
+// NewMsgProxyReject is the proxy resp for a refused proxy request, the
+// status is failed for invalid requests and rejected for the others.
+func NewMsgProxyReject(code RejectCode, reason string) *MsgProxyResp {
+	status := "rejected"
+	if code == RejectInvalidRequest || code == RejectInternal {
+		status = "failed"
+	}
 	return &MsgProxyResp{
-		Domain: domain,
 		Status: status,
+		Reason: reason,
+		Code:   code,
+	}
+}
+
+// Err is the refusal of a proxy resp that is no success, nil otherwise.
+// Servers before the codes send none, their refusals are retried.
+func (m *MsgProxyResp) Err() error {
+	if m.Status == "success" {
+		return nil
+	}
+	code := m.Code
+	if code == "" {
+		code = RejectInternal
 	}
+	return &RejectError{Code: code, Reason: m.Reason}
+}
+
+// MsgBanner is a message of the server operator, e.g. a maintenance window,
+// sent after the proxy resp for the client to log.
+type MsgBanner struct {
+	Text string `json:"text"`
+}
+
+func (m *MsgBanner) Type() PacketType {
+	return PacketBanner
+}
+
+func NewMsgBanner(text string) *MsgBanner {
+	return &MsgBanner{Text: text}
 }
 
-type NewProxyCancel struct {
+// MsgProxyCancel cancels the proxy on RemotePort, sent by the client on a
+// new control conn or by the server on the conn of the proxy.
+type MsgProxyCancel struct {
 	ProxyName  string `json:"proxy_name"`
 	RemotePort int    `json:"remote_port"`
+	Reason     string `json:"reason,omitempty"` // why the server canceled the proxy
 }
 
-func NewMsgCancel(token, proxyName string, remotePort int) *NewProxyCancel {
-	return &NewProxyCancel{
+// NewProxyCancel is the old name of MsgProxyCancel.
+//
+// Deprecated: use MsgProxyCancel.
+type NewProxyCancel = MsgProxyCancel
+
+// NewMsgCancel is the cancel of the proxy on remotePort, token is unused.
+func NewMsgCancel(token, proxyName string, remotePort int) *MsgProxyCancel {
+	return &MsgProxyCancel{
 		ProxyName:  proxyName,
 		RemotePort: remotePort,
 	}
 }
 
-func (m *NewProxyCancel) Type() PacketType {
+func (m *MsgProxyCancel) Type() PacketType {
 	return PacketProxyCancel
 }
 
+// MsgExchange announces a user conn with ConnId from the server, the client
+// answers it on a new control conn with the same ConnId which then carries
+// the data of the user conn.
 type MsgExchange struct {
 	ConnId    string `json:"conn_id"`
 	ProxyType string `json:"proxy_type"`
+	Port      int    `json:"port,omitempty"` // remote port of the user conn, set for port ranges
 }
 
 func (m *MsgExchange) Type() PacketType {
@@ -145,6 +387,27 @@ func NewMsgExchange(connId, typ string) *MsgExchange {
 	}
 }
 
+// MsgUDPDatagram is one datagram of a udp proxy, Addr is the user it comes
+// from or goes to.
+// MsgExchangeFail tells the server on the proxy conn that the client can't
+// claim the user conn of ConnId, e.g. it failed to open the conn for it. The
+// server closes the user conn instead of waiting for its exchange timeout.
+type MsgExchangeFail struct {
+	ConnId string `json:"conn_id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func (m *MsgExchangeFail) Type() PacketType {
+	return PacketExchangeFail
+}
+
+func NewMsgExchangeFail(connId, reason string) *MsgExchangeFail {
+	return &MsgExchangeFail{
+		ConnId: connId,
+		Reason: reason,
+	}
+}
+
 type MsgUDPDatagram struct {
 	Payload []byte       `json:"payload"`
 	Addr    *net.UDPAddr `json:"addr"`
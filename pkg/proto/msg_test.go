@@ -0,0 +1,134 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	msgs := []Msg{
+		NewMsgLogin("secret"),
+		NewMsgHeartbeat(),
+		&MsgProxyReq{RemotePort: 8080, RemotePortEnd: 8090, ProxyName: "web", ProxyType: "tcp",
+			AllowIPs: []string{"10.0.0.0/8"}, MaxConns: 10, Overflow: "queue", Weight: 2, TTL: 60},
+		&MsgProxyResp{Domain: "app.example.com", Status: "success", RemotePort: 8080, Compress: true, TTL: 60},
+		NewMsgProxyReject(RejectInUse, "port 8080 is in use"),
+		&MsgProxyCancel{ProxyName: "web", RemotePort: 8080, Reason: "ttl expired"},
+		&MsgExchange{ConnId: "0930af4885076301", ProxyType: "tcp", Port: 8081},
+		NewMsgUDPDatagram(&net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5353}, []byte{0, 1, 2}),
+		NewMsgLoginReject(RejectAuth, "invalid token"),
+		NewMsgBanner("Maintenance on sunday"),
+		NewMsgExchangeFail("0930af4885076301", "too many open files"),
+	}
+
+	var stream bytes.Buffer
+	for _, msg := range msgs {
+		buf, err := Marshal(msg)
+		if err != nil {
+			t.Fatalf("marshal %s: %v", msg.Type(), err)
+		}
+		if PacketType(buf[0]) != msg.Type() || int(buf[1])<<8+int(buf[2]) != len(buf)-3 {
+			t.Fatalf("%s: invalid packet header % x", msg.Type(), buf[:3])
+		}
+		stream.Write(buf)
+	}
+
+	for _, want := range msgs {
+		got, err := ReadMsg(&stream)
+		if err != nil {
+			t.Fatalf("read %s: %v", want.Type(), err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %+v, want %+v", want.Type(), got, want)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	if _, err := Unmarshal(PacketType(0x7f), []byte("{}")); !errors.Is(err, ErrUnknownPacket) {
+		t.Fatalf("unknown type: got %v, want ErrUnknownPacket", err)
+	}
+	if _, err := Unmarshal(PacketExchange, []byte("{")); !errors.Is(err, ErrMsgUnmarshal) {
+		t.Fatalf("invalid payload: got %v, want ErrMsgUnmarshal", err)
+	}
+
+	// the fields of a newer peer are ignored
+	msg, err := Unmarshal(PacketExchange, []byte(`{"conn_id":"a","proxy_type":"tcp","new_field":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex := msg.(*MsgExchange); ex.ConnId != "a" || ex.ProxyType != "tcp" {
+		t.Fatalf("got %+v", ex)
+	}
+
+	if _, err := Marshal(NewMsgBanner(strings.Repeat("a", MaxPacketSize))); !errors.Is(err, ErrMsgLength) {
+		t.Fatalf("oversized msg: got %v, want ErrMsgLength", err)
+	}
+}
+
+func TestRecv(t *testing.T) {
+	var buf bytes.Buffer
+	Send(&buf, NewMsgLoginReject(RejectVersion, "protocol version 9 not supported"))
+	var resp MsgProxyResp
+	var reject *RejectError
+	if err := Recv(&buf, &resp); !errors.As(err, &reject) || reject.Code != RejectVersion {
+		t.Fatalf("got %v, want a version reject", err)
+	}
+
+	Send(&buf, NewMsgHeartbeat())
+	if err := Recv(&buf, &resp); !errors.Is(err, ErrInvalidMsg) {
+		t.Fatalf("got %v, want ErrInvalidMsg", err)
+	}
+}
+
+// shortWriter writes at most max bytes per Write, without an error, and
+// fails once it took limit bytes.
+type shortWriter struct {
+	bytes.Buffer
+	max, limit int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if w.limit > 0 && w.Len() >= w.limit {
+		return 0, net.ErrClosed
+	}
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestSendShortWrites(t *testing.T) {
+	w := &shortWriter{max: 3}
+	want := &MsgExchange{ConnId: "0930af4885076301", ProxyType: "tcp"}
+	for i := 0; i < 2; i++ {
+		if err := Send(w, want); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		got, err := ReadMsg(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	}
+
+	w = &shortWriter{max: 3, limit: 6}
+	err := Send(w, want)
+	if !errors.Is(err, ErrMsgWrite) || !errors.Is(err, net.ErrClosed) || !strings.Contains(err.Error(), "6 of") {
+		t.Fatalf("got %v, want a write error after 6 bytes", err)
+	}
+
+	w = &shortWriter{max: 0}
+	if err := Send(w, want); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("got %v, want io.ErrShortWrite", err)
+	}
+}
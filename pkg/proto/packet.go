@@ -2,20 +2,51 @@ package proto
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 )
 
+// PacketType is the first byte of a packet, it tells the Msg of the payload.
 type PacketType byte
 
-var (
-	PacketUnknown     = PacketType(0x00)
-	PacketLogin       = PacketType(0x01)
-	PacketHeartbeat   = PacketType(0x02)
-	PacketProxyReq    = PacketType(0x03)
-	PacketProxyResp   = PacketType(0x04)
-	PacketProxyCancel = PacketType(0x05)
-	PacketExchange    = PacketType(0x06)
-	PacketUDPDatagram = PacketType(0x07)
+// The values are part of the protocol, new types get new values.
+const (
+	PacketUnknown     PacketType = 0x00
+	PacketLogin       PacketType = 0x01 // MsgLogin
+	PacketHeartbeat   PacketType = 0x02 // MsgHeartbeat
+	PacketProxyReq    PacketType = 0x03 // MsgProxyReq
+	PacketProxyResp   PacketType = 0x04 // MsgProxyResp
+	PacketProxyCancel PacketType = 0x05 // MsgProxyCancel
+	PacketExchange    PacketType = 0x06 // MsgExchange
+	PacketUDPDatagram PacketType = 0x07 // MsgUDPDatagram
+	PacketLoginReject PacketType = 0x08 // MsgLoginReject
+	// PacketBanner follows a proxy resp, clients that don't know it skip it
+	PacketBanner PacketType = 0x09 // MsgBanner
+	// PacketExchangeFail is sent by clients on the proxy conn, servers that
+	// don't know it skip it
+	PacketExchangeFail PacketType = 0x0a // MsgExchangeFail
+)
+
+// MaxPacketSize is the largest payload the 2 byte length of a packet holds.
+const MaxPacketSize = 65535
+
+// maxReadSize caps the declared length of the packets read, longer ones are
+// rejected before their payload is allocated.
+var maxReadSize = MaxPacketSize
+
+// SetMaxPacketSize caps the payload of the packets read at size bytes, sizes
+// out of 1-MaxPacketSize are ignored.
+func SetMaxPacketSize(size int) {
+	if size > 0 && size <= MaxPacketSize {
+		maxReadSize = size
+	}
+}
+
+const (
+	// ProtoVersion is bumped on every incompatible wire protocol change.
+	ProtoVersion = 1
+	// MinProtoVersion is the oldest client protocol the server still serves.
+	MinProtoVersion = 1
 )
 
 func (p PacketType) String() string {
@@ -34,6 +65,12 @@ func (p PacketType) String() string {
 		return "exchan"
 	case PacketUDPDatagram:
 		return "udpgram"
+	case PacketLoginReject:
+		return "lreject"
+	case PacketBanner:
+		return "banner"
+	case PacketExchangeFail:
+		return "exfail"
 	default:
 		return "unknown"
 	}
@@ -48,7 +85,7 @@ func packet(typ PacketType, msg any) ([]byte, error) {
 }
 
 func packet0(typ PacketType, buf []byte) ([]byte, error) {
-	if len(buf) > 65535 {
+	if len(buf) > MaxPacketSize {
 		return nil, ErrMsgLength
 	}
 	ret := make([]byte, 3+len(buf))
@@ -77,12 +114,18 @@ func read0(r io.Reader) (typ byte, buf []byte, err error) {
 	typ = buf[0]
 
 	buf = make([]byte, 2)
-	_, err = r.Read(buf)
+	_, err = io.ReadFull(r, buf)
 	if err != nil {
-		err = ErrMsgRead
+		// keep the cause, e.g. a read deadline is told apart from a conn
+		// closed mid packet
+		err = fmt.Errorf("%w: %w", ErrMsgRead, err)
 		return
 	}
 	l := int(buf[0])<<8 + int(buf[1])
+	if l > maxReadSize {
+		err = fmt.Errorf("%w: %d > %d", ErrMsgTooLarge, l, maxReadSize)
+		return
+	}
 	buf = make([]byte, l)
 	n, err := io.ReadFull(r, buf)
 	if err != nil {
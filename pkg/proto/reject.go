@@ -0,0 +1,63 @@
+package proto
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// RejectCode tells why the server refused a login or a proxy request, a
+// stable contract clients and tools act on instead of the reason text.
+type RejectCode string
+
+const (
+	RejectAuth           RejectCode = "auth"            // invalid token
+	RejectVersion        RejectCode = "version"         // protocol version not supported
+	RejectInvalidPort    RejectCode = "invalid_port"    // remote port out of the allowed range or not reserved
+	RejectInUse          RejectCode = "in_use"          // remote port or domain held by another proxy
+	RejectLimit          RejectCode = "limit"           // a server cap is reached, e.g. max proxys or a traffic cap
+	RejectUnsupported    RejectCode = "unsupported"     // the proxy type or feature is disabled on the server
+	RejectInvalidRequest RejectCode = "invalid_request" // the proxy options are invalid
+	RejectDenied         RejectCode = "denied"          // the policy of the server denies the proxy
+	RejectInternal       RejectCode = "internal"        // the server failed, e.g. to listen
+)
+
+// Temporary tells if the request may succeed later as it is, the others
+// need a change of the client config or the server. Codes of newer servers
+// are temporary.
+func (c RejectCode) Temporary() bool {
+	switch c {
+	case RejectAuth, RejectVersion, RejectInvalidPort, RejectUnsupported, RejectInvalidRequest, RejectDenied:
+		return false
+	}
+	return true
+}
+
+// RejectError is a refusal of the server, it matches ErrRejected.
+type RejectError struct {
+	Code   RejectCode
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("%v: %s", ErrRejected, e.Code)
+	}
+	return fmt.Sprintf("%v: %s (%s)", ErrRejected, e.Reason, e.Code)
+}
+
+func (e *RejectError) Is(target error) bool {
+	return target == ErrRejected
+}
+
+// ParseRejectPacket reads the body of a login reject packet into its error.
+// Servers before the codes only rejected logins for the protocol version.
+func ParseRejectPacket(buf []byte) *RejectError {
+	reject := MsgLoginReject{}
+	if err := json.Unmarshal(buf, &reject); err != nil {
+		return &RejectError{Code: RejectVersion}
+	}
+	if reject.Code == "" {
+		reject.Code = RejectVersion
+	}
+	return &RejectError{Code: reject.Code, Reason: reject.Reason}
+}
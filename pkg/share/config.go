@@ -0,0 +1,35 @@
+package share
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// ReadConfigFile reads the config file into viper, the format follows the file
+// extension, a file with unknown extension is tried as toml and then yaml.
+func ReadConfigFile(cfgFile string) error {
+	viper.SetConfigFile(cfgFile)
+
+	switch ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(cfgFile), ".")); ext {
+	case "toml", "yaml", "yml", "json":
+		viper.SetConfigType(ext)
+		return viper.ReadInConfig()
+	}
+
+	viper.SetConfigType("toml")
+	terr := viper.ReadInConfig()
+	if terr == nil {
+		return nil
+	}
+
+	viper.SetConfigType("yaml")
+	yerr := viper.ReadInConfig()
+	if yerr == nil {
+		return nil
+	}
+
+	return fmt.Errorf("neither toml (%v) nor yaml (%v)", terr, yerr)
+}
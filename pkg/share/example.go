@@ -0,0 +1,115 @@
+package share
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WriteExampleConfig writes cfg as a toml config file with a key for every
+// mapstructure tag of its struct, so the example can't drift from Config.
+// Zero keys are commented out, a slice of structs is a table, commented out
+// with zero keys when empty. usage is the comment of a key, the keys of a
+// table are asked as "table.key".
+func WriteExampleConfig(w io.Writer, cfg interface{}, usage func(key string) string) error {
+	e := &exampleWriter{usage: usage}
+	v := reflect.ValueOf(cfg)
+	// the keys after a table header belong to the table, so tables go last
+	tables := e.fields(v, "", "")
+
+	for _, t := range tables {
+		key, elems := t.key, t.elems
+		prefix := ""
+		if elems.Len() == 0 {
+			elems = reflect.Append(elems, reflect.Zero(elems.Type().Elem()))
+			prefix = "# "
+		}
+		e.b.WriteString("\n")
+		if comment := usage(key); comment != "" {
+			fmt.Fprintf(&e.b, "# %s\n", comment)
+		}
+		for i := 0; i < elems.Len(); i++ {
+			fmt.Fprintf(&e.b, "%s[[%s]]\n", prefix, key)
+			e.fields(elems.Index(i), key+".", prefix)
+		}
+	}
+
+	_, err := io.WriteString(w, e.b.String())
+	return err
+}
+
+type exampleTable struct {
+	key   string
+	elems reflect.Value
+}
+
+type exampleWriter struct {
+	b     strings.Builder
+	usage func(key string) string
+}
+
+// fields writes the keys of struct v, squashed structs inline, and returns
+// the tables it skipped.
+func (e *exampleWriter) fields(v reflect.Value, table, prefix string) []exampleTable {
+	var tables []exampleTable
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		tag := f.Tag.Get("mapstructure")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		fv := v.Field(i)
+		if tag == ",squash" {
+			tables = append(tables, e.fields(fv, table, prefix)...)
+			continue
+		}
+		if f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Struct {
+			tables = append(tables, exampleTable{key: tag, elems: fv})
+			continue
+		}
+
+		line := prefix
+		if fv.IsZero() {
+			line = "# "
+		}
+		line += tag + " = " + exampleValue(fv)
+		if comment := e.usage(table + tag); comment != "" {
+			line += " # " + comment
+		}
+		e.b.WriteString(line + "\n")
+	}
+	return tables
+}
+
+func exampleValue(v reflect.Value) string {
+	if d, ok := v.Interface().(time.Duration); ok {
+		return strconv.Quote(shortDuration(d))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return strconv.Quote(v.String())
+	case reflect.Slice:
+		elems := make([]string, v.Len())
+		for i := range elems {
+			elems[i] = exampleValue(v.Index(i))
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+// shortDuration drops the zero units of d, 5m instead of 5m0s.
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
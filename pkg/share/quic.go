@@ -0,0 +1,41 @@
+package share
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICProto is the alpn of the quic transport, both sides must offer it.
+const QUICProto = "gnar"
+
+// QUICConn is a quic stream as a net.Conn, with the addrs and the tls state
+// of the quic connection it belongs to.
+type QUICConn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func NewQUICConn(stream quic.Stream, conn quic.Connection) *QUICConn {
+	return &QUICConn{Stream: stream, conn: conn}
+}
+
+func (c *QUICConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *QUICConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *QUICConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+// Close closes both directions of the stream, closing a quic stream only
+// ends its send side.
+func (c *QUICConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
@@ -0,0 +1,59 @@
+package helpers
+
+import (
+	"net"
+	"sync"
+)
+
+// MemListener is an in memory net.Listener, every Dial hands the other end
+// of a net.Pipe to Accept. Passed to server.WithListener and
+// client.WithDialer it carries the control and data conns of a test without
+// binding a port.
+type MemListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func NewMemListener() *MemListener {
+	return &MemListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *MemListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *MemListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *MemListener) Addr() net.Addr {
+	return memAddr{}
+}
+
+// Dial connects to the listener, network and addr are ignored.
+func (l *MemListener) Dial(network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		client.Close()
+		server.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+type memAddr struct{}
+
+func (memAddr) Network() string { return "mem" }
+func (memAddr) String() string  { return "mem" }
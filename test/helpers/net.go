@@ -0,0 +1,57 @@
+package helpers
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// FreePort returns a loopback tcp port that is free right now.
+func FreePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// StartEchoServer serves a tcp echo on a loopback port, it returns the port
+// and a func that stops the server.
+func StartEchoServer() (func() error, int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Close, listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// WaitForPort dials addr until it is accepted, instead of sleeping for a
+// guessed time.
+func WaitForPort(addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			return conn.Close()
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s not up after %s: %v", addr, timeout, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
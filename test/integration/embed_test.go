@@ -0,0 +1,144 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abcdlsj/gnar/internal/auth"
+	"github.com/abcdlsj/gnar/internal/server"
+	"github.com/abcdlsj/gnar/pkg/proto"
+	"github.com/abcdlsj/gnar/test/helpers"
+	"github.com/abcdlsj/gnar/test/unit"
+)
+
+func TestEmbeddedServer(t *testing.T) {
+	if err := unit.BuildGnarBinary(); err != nil {
+		t.Fatalf("Failed to build gnar binary: %v", err)
+	}
+
+	stopPython, pythonPort, err := helpers.StartPythonServer()
+	if err != nil {
+		t.Fatalf("Failed to start Python server: %v", err)
+	}
+	defer stopPython()
+
+	cfg, err := server.LoadConfig("", nil)
+	if err != nil {
+		t.Fatalf("Failed to load default config: %v", err)
+	}
+	cfg.Port = 8915
+
+	var logins atomic.Int32
+	var clientID atomic.Value
+	srv := server.New(cfg, server.WithAuthenticator(auth.Func(func(*proto.MsgLogin) bool {
+		logins.Add(1)
+		return true
+	})), server.WithAuthorizer(func(client string, req *proto.MsgProxyReq) error {
+		clientID.Store(client)
+		if req.RemotePort == 10026 {
+			return errors.New("port 10026 is over quota")
+		}
+		return nil
+	}))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Run()
+	}()
+
+	helpers.WaitForServer(time.Second)
+
+	stopClient, err := helpers.StartGnarClient("127.0.0.1:8915", fmt.Sprintf("%s:10025", pythonPort), false)
+	if err != nil {
+		t.Fatalf("Failed to start gnar client: %v", err)
+	}
+	defer stopClient()
+
+	stopDenied, err := helpers.StartGnarClient("127.0.0.1:8915", fmt.Sprintf("%s:10026", pythonPort), false)
+	if err != nil {
+		t.Fatalf("Failed to start gnar client: %v", err)
+	}
+	defer stopDenied()
+
+	helpers.WaitForServer(time.Second)
+
+	if err := helpers.CheckHTTPResponse("http://127.0.0.1:10025", 200); err != nil {
+		t.Fatalf("HTTP check failed: %v", err)
+	}
+	if logins.Load() == 0 {
+		t.Fatal("Logins are not verified by the authenticator")
+	}
+	if id, _ := clientID.Load().(string); id != "127.0.0.1" {
+		t.Fatalf("Unexpected client id: %q", id)
+	}
+	if err := helpers.CheckHTTPResponse("http://127.0.0.1:10026", 200); err == nil {
+		t.Fatal("Proxy denied by the authorizer is served")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Failed to shutdown server: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Server run failed: %v", err)
+	}
+}
+
+func TestEmbeddedAdminShutdown(t *testing.T) {
+	// two servers in one process, each serves its own admin handlers
+	var addrs []string
+	var servers []*server.Server
+	var errChs []chan error
+	for i := 0; i < 2; i++ {
+		adminPort, err := helpers.FreePort()
+		if err != nil {
+			t.Fatalf("Failed to get free port: %v", err)
+		}
+		cfg, err := server.LoadConfig("", nil)
+		if err != nil {
+			t.Fatalf("Failed to load default config: %v", err)
+		}
+		cfg.AdminPort = adminPort
+
+		srv := server.New(cfg, server.WithListener(helpers.NewMemListener()))
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- srv.Run()
+		}()
+
+		addr := fmt.Sprintf("127.0.0.1:%d", adminPort)
+		if err := helpers.WaitForPort(addr, 5*time.Second); err != nil {
+			t.Fatalf("Admin server not up: %v", err)
+		}
+		addrs = append(addrs, addr)
+		servers = append(servers, srv)
+		errChs = append(errChs, errCh)
+	}
+
+	for _, addr := range addrs {
+		if err := helpers.CheckHTTPResponse("http://"+addr+"/metrics", 200); err != nil {
+			t.Fatalf("Admin metrics of %s failed: %v", addr, err)
+		}
+	}
+
+	for i, srv := range servers {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := srv.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("Failed to shutdown server: %v", err)
+		}
+		if err := <-errChs[i]; err != nil {
+			t.Fatalf("Server run failed: %v", err)
+		}
+		if conn, err := net.Dial("tcp", addrs[i]); err == nil {
+			conn.Close()
+			t.Fatalf("Admin server on %s still accepts after shutdown", addrs[i])
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abcdlsj/gnar/internal/client"
+	"github.com/abcdlsj/gnar/internal/server"
+	"github.com/abcdlsj/gnar/test/helpers"
+)
+
+func TestMemTransport(t *testing.T) {
+	tests := []struct {
+		name      string
+		multiplex bool
+		compress  bool
+		conns     int
+		fakeLocal bool // the local target is a name only the local dialer knows
+		acceptor  bool // the control conns come from an acceptor, not the server port
+	}{
+		{name: "tcp", conns: 1},
+		{name: "tcp concurrent", conns: 8},
+		{name: "multiplex", multiplex: true, conns: 8},
+		{name: "compress", compress: true, conns: 4},
+		{name: "multiplex compress", multiplex: true, compress: true, conns: 4},
+		{name: "local dialer", conns: 2, fakeLocal: true},
+		{name: "acceptor", conns: 2, acceptor: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stopEcho, echoPort, err := helpers.StartEchoServer()
+			if err != nil {
+				t.Fatalf("Failed to start echo server: %v", err)
+			}
+			defer stopEcho()
+
+			remotePort, err := helpers.FreePort()
+			if err != nil {
+				t.Fatalf("Failed to get free port: %v", err)
+			}
+
+			ln := helpers.NewMemListener()
+			srvCfg, err := server.LoadConfig("", nil)
+			if err != nil {
+				t.Fatalf("Failed to load server config: %v", err)
+			}
+			srvCfg.Multiplex = tt.multiplex
+			srvOpts := []server.Option{server.WithListener(ln)}
+			if tt.acceptor {
+				srvOpts = []server.Option{server.WithListener(helpers.NewMemListener()), server.WithAcceptor(ln)}
+			}
+			srv := server.New(srvCfg, srvOpts...)
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- srv.Run()
+			}()
+
+			cliCfg, err := client.LoadConfig("", []string{"mem", fmt.Sprintf("%d:%d", echoPort, remotePort)})
+			if err != nil {
+				t.Fatalf("Failed to load client config: %v", err)
+			}
+			cliCfg.Multiplex = tt.multiplex
+			cliCfg.Proxys[0].Compress = tt.compress
+			opts := []client.Option{client.WithDialer(ln)}
+			if tt.fakeLocal {
+				cliCfg.Proxys[0].LocalAddr = "echo.invalid:7"
+				opts = append(opts, client.WithLocalDialer(redirectDialer{
+					"echo.invalid:7": fmt.Sprintf("127.0.0.1:%d", echoPort),
+				}))
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cliDone := make(chan error, 1)
+			go func() {
+				cliDone <- client.New(cliCfg, opts...).Serve(ctx)
+			}()
+
+			addr := fmt.Sprintf("127.0.0.1:%d", remotePort)
+			if err := helpers.WaitForPort(addr, 5*time.Second); err != nil {
+				t.Fatalf("Proxy not registered: %v", err)
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, tt.conns)
+			for i := 0; i < tt.conns; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs <- echo(addr, 256<<10)
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Errorf("Echo through proxy failed: %v", err)
+				}
+			}
+
+			cancel()
+			if err := <-cliDone; err != nil {
+				t.Fatalf("Client serve failed: %v", err)
+			}
+			shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancelShutdown()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				t.Fatalf("Failed to shutdown server: %v", err)
+			}
+			if err := <-errCh; err != nil {
+				t.Fatalf("Server run failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestExchangeFail(t *testing.T) {
+	stopEcho, echoPort, err := helpers.StartEchoServer()
+	if err != nil {
+		t.Fatalf("Failed to start echo server: %v", err)
+	}
+	defer stopEcho()
+
+	remotePort, err := helpers.FreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+
+	ln := helpers.NewMemListener()
+	srvCfg, err := server.LoadConfig("", nil)
+	if err != nil {
+		t.Fatalf("Failed to load server config: %v", err)
+	}
+	srv := server.New(srvCfg, server.WithListener(ln))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Run()
+	}()
+
+	cliCfg, err := client.LoadConfig("", []string{"mem", fmt.Sprintf("%d:%d", echoPort, remotePort)})
+	if err != nil {
+		t.Fatalf("Failed to load client config: %v", err)
+	}
+	// the proxy registers, the conns for its user conns fail
+	ctx, cancel := context.WithCancel(context.Background())
+	cliDone := make(chan error, 1)
+	go func() {
+		cliDone <- client.New(cliCfg, client.WithDialer(&onceDialer{d: ln})).Serve(ctx)
+	}()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", remotePort)
+	if err := helpers.WaitForPort(addr, 5*time.Second); err != nil {
+		t.Fatalf("Proxy not registered: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	// well within the exchange timeout
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("User conn not closed after the failed exchange: %v", err)
+	}
+
+	cancel()
+	<-cliDone
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("Failed to shutdown server: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Server run failed: %v", err)
+	}
+}
+
+func TestServeRejected(t *testing.T) {
+	stopEcho, echoPort, err := helpers.StartEchoServer()
+	if err != nil {
+		t.Fatalf("Failed to start echo server: %v", err)
+	}
+	defer stopEcho()
+
+	remotePort, err := helpers.FreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+
+	ln := helpers.NewMemListener()
+	srvCfg, err := server.LoadConfig("", nil)
+	if err != nil {
+		t.Fatalf("Failed to load server config: %v", err)
+	}
+	srvCfg.MinPort, srvCfg.MaxPort = remotePort, remotePort
+	srv := server.New(srvCfg, server.WithListener(ln))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Run()
+	}()
+
+	cliCfg, err := client.LoadConfig("", []string{"mem", fmt.Sprintf("%d:%d", echoPort, remotePort)})
+	if err != nil {
+		t.Fatalf("Failed to load client config: %v", err)
+	}
+	// the second proxy is out of the range of the server, rejected for good
+	outside := cliCfg.Proxys[0]
+	outside.RemotePort = remotePort + 1
+	cliCfg.Proxys = append(cliCfg.Proxys, outside)
+	cliDone := make(chan error, 1)
+	go func() {
+		cliDone <- client.New(cliCfg, client.WithDialer(ln)).Serve(context.Background())
+	}()
+
+	select {
+	case err := <-cliDone:
+		if err == nil || !strings.Contains(err.Error(), "won't reconnect") {
+			t.Fatalf("Client serve returned %v, want the reject", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Client serve did not return on the reject")
+	}
+
+	// the proxy in range is canceled with it
+	addr := fmt.Sprintf("127.0.0.1:%d", remotePort)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("Proxy of the client still served after its serve returned")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("Failed to shutdown server: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Server run failed: %v", err)
+	}
+}
+
+// onceDialer dials the first conn with d, the later ones fail.
+type onceDialer struct {
+	d     *helpers.MemListener
+	dials atomic.Int32
+}
+
+func (o *onceDialer) Dial(network, addr string) (net.Conn, error) {
+	if o.dials.Add(1) > 1 {
+		return nil, errors.New("dial refused")
+	}
+	return o.d.Dial(network, addr)
+}
+
+// BenchmarkAcceptWorkers opens short user conns to a proxy from many
+// goroutines at once, a burst the accept loop has to keep up with.
+func BenchmarkAcceptWorkers(b *testing.B) {
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers %d", workers), func(b *testing.B) {
+			// the target answers once and closes, the client streams end with it
+			target, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatalf("Failed to listen: %v", err)
+			}
+			defer target.Close()
+			go func() {
+				for {
+					conn, err := target.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer conn.Close()
+						buf := make([]byte, 64)
+						if _, err := io.ReadFull(conn, buf); err == nil {
+							conn.Write(buf)
+						}
+					}()
+				}
+			}()
+			targetPort := target.Addr().(*net.TCPAddr).Port
+
+			remotePort, err := helpers.FreePort()
+			if err != nil {
+				b.Fatalf("Failed to get free port: %v", err)
+			}
+
+			ln := helpers.NewMemListener()
+			srvCfg, err := server.LoadConfig("", nil)
+			if err != nil {
+				b.Fatalf("Failed to load server config: %v", err)
+			}
+			srvCfg.AcceptWorkers = workers
+			srvCfg.ListenBacklog = 4096
+			srv := server.New(srvCfg, server.WithListener(ln))
+			go srv.Run()
+
+			cliCfg, err := client.LoadConfig("", []string{"mem", fmt.Sprintf("%d:%d", targetPort, remotePort)})
+			if err != nil {
+				b.Fatalf("Failed to load client config: %v", err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go client.New(cliCfg, client.WithDialer(ln)).Serve(ctx)
+
+			addr := fmt.Sprintf("127.0.0.1:%d", remotePort)
+			if err := helpers.WaitForPort(addr, 5*time.Second); err != nil {
+				b.Fatalf("Proxy not registered: %v", err)
+			}
+
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := echo(addr, 64); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+
+			cancel()
+			shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancelShutdown()
+			srv.Shutdown(shutdownCtx)
+		})
+	}
+}
+
+// redirectDialer dials the addr its keys are mapped to, others fail.
+type redirectDialer map[string]string
+
+func (d redirectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	target, ok := d[addr]
+	if !ok {
+		return nil, fmt.Errorf("unknown addr: %s", addr)
+	}
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, target)
+}
+
+// echo sends size random bytes to the echo server behind addr and checks
+// that the same bytes come back.
+func echo(addr string, size int) error {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	sent := make([]byte, size)
+	rand.Read(sent)
+	go conn.Write(sent)
+
+	got := make([]byte, size)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return fmt.Errorf("error reading echo: %v", err)
+	}
+	if !bytes.Equal(sent, got) {
+		return fmt.Errorf("echo differs from the %d bytes sent", size)
+	}
+	return nil
+}
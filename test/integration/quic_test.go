@@ -0,0 +1,106 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abcdlsj/gnar/internal/client"
+	"github.com/abcdlsj/gnar/internal/server"
+	"github.com/abcdlsj/gnar/test/helpers"
+)
+
+func TestQUICTransport(t *testing.T) {
+	certFile, keyFile, err := helpers.WriteSelfSignedCert(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+
+	stopEcho, echoPort, err := helpers.StartEchoServer()
+	if err != nil {
+		t.Fatalf("Failed to start echo server: %v", err)
+	}
+	defer stopEcho()
+
+	remotePort, err := helpers.FreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	quicPort, err := freeUDPPort()
+	if err != nil {
+		t.Fatalf("Failed to get free udp port: %v", err)
+	}
+
+	srvCfg, err := server.LoadConfig("", nil)
+	if err != nil {
+		t.Fatalf("Failed to load server config: %v", err)
+	}
+	srvCfg.QUICPort = quicPort
+	srvCfg.TLS.CertFile = certFile
+	srvCfg.TLS.KeyFile = keyFile
+	// the control conns come over quic only
+	srv := server.New(srvCfg, server.WithListener(helpers.NewMemListener()))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Run()
+	}()
+
+	cliCfg, err := client.LoadConfig("", []string{fmt.Sprintf("quic://localhost:%d", quicPort), fmt.Sprintf("%d:%d", echoPort, remotePort)})
+	if err != nil {
+		t.Fatalf("Failed to load client config: %v", err)
+	}
+	cliCfg.TLS.Enable = true
+	cliCfg.TLS.CAFile = certFile
+	ctx, cancel := context.WithCancel(context.Background())
+	cliDone := make(chan error, 1)
+	go func() {
+		cliDone <- client.New(cliCfg).Serve(ctx)
+	}()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", remotePort)
+	if err := helpers.WaitForPort(addr, 5*time.Second); err != nil {
+		t.Fatalf("Proxy not registered: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- echo(addr, 256<<10)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Echo through quic proxy failed: %v", err)
+		}
+	}
+
+	cancel()
+	if err := <-cliDone; err != nil {
+		t.Fatalf("Client serve failed: %v", err)
+	}
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("Failed to shutdown server: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Server run failed: %v", err)
+	}
+}
+
+func freeUDPPort() (int, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port, nil
+}